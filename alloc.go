@@ -0,0 +1,68 @@
+package lua
+
+import "unsafe"
+
+// An Allocation is a kind of object reported to an AllocHook.
+type Allocation int
+
+// The kinds of objects reported to an AllocHook.
+const (
+	AllocTable    Allocation = iota // a table, made by a constructor or CreateTable
+	AllocClosure                    // a Lua function, made by a function definition
+	AllocString                     // a string made by concatenation
+	AllocUserData                   // a userdata, made by PushUserData
+)
+
+var allocationNames = []string{"table", "closure", "string", "userdata"}
+
+func (a Allocation) String() string {
+	if a < 0 || int(a) >= len(allocationNames) {
+		return "unknown"
+	}
+	return allocationNames[a]
+}
+
+// An AllocHook is called for each object of the kinds listed by
+// Allocation that a State creates, with an approximation of its size in
+// bytes. The hook runs in the middle of the operation creating the object,
+// and must not change the stack of l, although it may inspect it with Stack
+// and Info.
+type AllocHook func(l *State, kind Allocation, size int)
+
+// SetAllocationHook sets the allocation hook of l and the threads sharing its
+// global state, or removes it if f is nil.
+func SetAllocationHook(l *State, f AllocHook) { l.global.allocationHook = f }
+
+// AllocationHook returns the current allocation hook.
+func AllocationHook(l *State) AllocHook { return l.global.allocationHook }
+
+// Approximate sizes of the Go values behind Lua objects.
+const (
+	valueSize     = int(unsafe.Sizeof(value(nil)))
+	mapEntrySize  = 2*valueSize + 8 // a key, a value and their share of the buckets' overhead
+	mapHeaderSize = 48
+)
+
+func (l *State) tableCreated(arraySize, hashSize int) {
+	if h := l.global.allocationHook; h != nil {
+		h(l, AllocTable, int(unsafe.Sizeof(table{}))+mapHeaderSize+arraySize*valueSize+hashSize*mapEntrySize)
+	}
+}
+
+func (l *State) closureCreated(c *luaClosure) {
+	if h := l.global.allocationHook; h != nil {
+		h(l, AllocClosure, int(unsafe.Sizeof(*c))+len(c.upValues)*int(unsafe.Sizeof(c)))
+	}
+}
+
+func (l *State) stringCreated(s string) {
+	if h := l.global.allocationHook; h != nil {
+		h(l, AllocString, len(s))
+	}
+}
+
+func (l *State) userDataCreated(u *userData) {
+	if h := l.global.allocationHook; h != nil {
+		h(l, AllocUserData, int(unsafe.Sizeof(*u)))
+	}
+}
@@ -0,0 +1,450 @@
+// Package ast declares the types used to represent syntax trees for Lua 5.2
+// source, as accepted by go-lua, along with a parser and a printer for them.
+//
+// Every node records where it starts and ends in the source. Statements and
+// table fields also carry the comments attached to them, so that printing a
+// parsed chunk reproduces its comments.
+package ast
+
+// A Position is a location in the source. Lines and columns count from 1;
+// columns count bytes.
+type Position struct {
+	Line, Column int
+}
+
+// A Span is the range of source covered by a node, from the first byte of its
+// first token to just past its last token.
+type Span struct {
+	From, To Position
+}
+
+// Start returns the position of the first byte of the node.
+func (s Span) Start() Position { return s.From }
+
+// End returns the position just past the last byte of the node.
+func (s Span) End() Position { return s.To }
+
+// A Node is any node of the syntax tree.
+type Node interface {
+	Start() Position
+	End() Position
+}
+
+// An Expr is an expression.
+type Expr interface {
+	Node
+	exprNode()
+}
+
+// A Stmt is a statement.
+type Stmt interface {
+	Node
+	Comments() *Attached
+	stmtNode()
+}
+
+// A Comment is a single short or long comment, including the leading "--".
+type Comment struct {
+	Span
+	Text string
+}
+
+// Attached holds the comments attached to a statement or a table field:
+// those on the lines before it, and one that follows it on its last line.
+type Attached struct {
+	Doc  []*Comment
+	Line *Comment
+}
+
+// Comments returns the comments attached to the node.
+func (a *Attached) Comments() *Attached { return a }
+
+// A Chunk is a parsed source file.
+type Chunk struct {
+	Name     string
+	Block    *Block
+	Comments []*Comment // every comment in the source, in order
+}
+
+// Start returns the position of the first statement of the chunk.
+func (c *Chunk) Start() Position { return c.Block.From }
+
+// End returns the position just past the last statement of the chunk.
+func (c *Chunk) End() Position { return c.Block.To }
+
+// A Block is a sequence of statements. Line is a comment that follows the
+// token opening the block on the same line, such as "then" or the closing
+// parenthesis of a function's parameters. Comments holds comments that follow
+// the last statement, before the token that closes the block.
+type Block struct {
+	Span
+	Line     *Comment
+	Stmts    []Stmt
+	Comments []*Comment
+}
+
+// Expressions.
+type (
+	// Nil is the literal nil.
+	Nil struct{ Span }
+
+	// True is the literal true.
+	True struct{ Span }
+
+	// False is the literal false.
+	False struct{ Span }
+
+	// Vararg is the expression "...".
+	Vararg struct{ Span }
+
+	// A Number is a numeric literal. Raw is the literal as written, if known.
+	Number struct {
+		Span
+		Value float64
+		Raw   string
+	}
+
+	// A String is a string literal. Raw is the literal as written, including
+	// its quotes or brackets, if known.
+	String struct {
+		Span
+		Value string
+		Raw   string
+	}
+
+	// A Name is a reference to a variable.
+	Name struct {
+		Span
+		Name string
+	}
+
+	// A Function is a function literal. Method is true for functions declared
+	// with the colon syntax, which have an implicit self parameter.
+	Function struct {
+		Span
+		Params   []*Name
+		IsVararg bool
+		Method   bool
+		Body     *Block
+	}
+
+	// A Table is a table constructor. Comments holds comments that follow
+	// the last field.
+	Table struct {
+		Span
+		Fields   []*Field
+		Comments []*Comment
+	}
+
+	// A Binary is a binary operation, such as a + b. Op is the operator as
+	// written, such as "+", "..", "and" or "~=".
+	Binary struct {
+		Span
+		Op   string
+		X, Y Expr
+	}
+
+	// A Unary is a unary operation: "-", "not" or "#".
+	Unary struct {
+		Span
+		Op string
+		X  Expr
+	}
+
+	// A Paren is a parenthesized expression, which truncates multiple results
+	// to one.
+	Paren struct {
+		Span
+		X Expr
+	}
+
+	// An Index is an indexing operation, t[k] or t.k. Dot is true for the
+	// latter form, in which case Key is a *String.
+	Index struct {
+		Span
+		X, Key Expr
+		Dot    bool
+	}
+
+	// A Call is a function or method call. Method is the name after the colon
+	// in a method call, and empty otherwise.
+	Call struct {
+		Span
+		Fn     Expr
+		Method string
+		Args   []Expr
+	}
+)
+
+// A Field is an entry in a table constructor: [Key] = Value, Name = Value
+// (Key is a *String and Named is true), or a positional Value (Key is nil).
+type Field struct {
+	Span
+	Attached
+	Key   Expr
+	Named bool
+	Value Expr
+}
+
+func (*Nil) exprNode()      {}
+func (*True) exprNode()     {}
+func (*False) exprNode()    {}
+func (*Vararg) exprNode()   {}
+func (*Number) exprNode()   {}
+func (*String) exprNode()   {}
+func (*Name) exprNode()     {}
+func (*Function) exprNode() {}
+func (*Table) exprNode()    {}
+func (*Binary) exprNode()   {}
+func (*Unary) exprNode()    {}
+func (*Paren) exprNode()    {}
+func (*Index) exprNode()    {}
+func (*Call) exprNode()     {}
+
+// Statements.
+type (
+	// An Empty statement is a lone semicolon.
+	Empty struct {
+		Span
+		Attached
+	}
+
+	// A Local statement declares local variables.
+	Local struct {
+		Span
+		Attached
+		Names  []*Name
+		Values []Expr
+	}
+
+	// An Assign statement assigns to variables, which are *Name or *Index.
+	Assign struct {
+		Span
+		Attached
+		Targets []Expr
+		Values  []Expr
+	}
+
+	// A CallStmt is a call whose results are discarded.
+	CallStmt struct {
+		Span
+		Attached
+		Call *Call
+	}
+
+	// A Do statement is an explicit block.
+	Do struct {
+		Span
+		Attached
+		Body *Block
+	}
+
+	// A While loop.
+	While struct {
+		Span
+		Attached
+		Cond Expr
+		Body *Block
+	}
+
+	// A Repeat loop. Cond is in the scope of the body's locals.
+	Repeat struct {
+		Span
+		Attached
+		Body *Block
+		Cond Expr
+	}
+
+	// An If statement, with one clause for the if and one for each elseif.
+	// Else is nil when there is no else part.
+	If struct {
+		Span
+		Attached
+		Clauses []*IfClause
+		Else    *Block
+	}
+
+	// A NumericFor loop. Step is nil when omitted.
+	NumericFor struct {
+		Span
+		Attached
+		Var               *Name
+		Init, Limit, Step Expr
+		Body              *Block
+	}
+
+	// A GenericFor loop.
+	GenericFor struct {
+		Span
+		Attached
+		Names []*Name
+		Exprs []Expr
+		Body  *Block
+	}
+
+	// A FunctionStmt declares a global or field function. Name is the path,
+	// such as a.b.c, and Func.Method is set for a.b:c.
+	FunctionStmt struct {
+		Span
+		Attached
+		Name []*Name
+		Func *Function
+	}
+
+	// A LocalFunction declares a local function.
+	LocalFunction struct {
+		Span
+		Attached
+		Name *Name
+		Func *Function
+	}
+
+	// A Return statement.
+	Return struct {
+		Span
+		Attached
+		Values []Expr
+	}
+
+	// A Break statement.
+	Break struct {
+		Span
+		Attached
+	}
+
+	// A Goto statement.
+	Goto struct {
+		Span
+		Attached
+		Label string
+	}
+
+	// A Label statement, ::name::.
+	Label struct {
+		Span
+		Attached
+		Name string
+	}
+)
+
+// An IfClause is a condition and the block it guards.
+type IfClause struct {
+	Span
+	Cond Expr
+	Body *Block
+}
+
+func (*Empty) stmtNode()         {}
+func (*Local) stmtNode()         {}
+func (*Assign) stmtNode()        {}
+func (*CallStmt) stmtNode()      {}
+func (*Do) stmtNode()            {}
+func (*While) stmtNode()         {}
+func (*Repeat) stmtNode()        {}
+func (*If) stmtNode()            {}
+func (*NumericFor) stmtNode()    {}
+func (*GenericFor) stmtNode()    {}
+func (*FunctionStmt) stmtNode()  {}
+func (*LocalFunction) stmtNode() {}
+func (*Return) stmtNode()        {}
+func (*Break) stmtNode()         {}
+func (*Goto) stmtNode()          {}
+func (*Label) stmtNode()         {}
+
+// Inspect traverses the tree rooted at n in depth-first order, calling f for
+// each node. If f returns false, the children of the node are skipped. Blocks,
+// fields and if clauses are visited as nodes too.
+func Inspect(n Node, f func(Node) bool) {
+	if n == nil || !f(n) {
+		return
+	}
+	exprs := func(es []Expr) {
+		for _, e := range es {
+			Inspect(e, f)
+		}
+	}
+	names := func(ns []*Name) {
+		for _, n := range ns {
+			Inspect(n, f)
+		}
+	}
+	switch n := n.(type) {
+	case *Chunk:
+		Inspect(n.Block, f)
+	case *Block:
+		for _, s := range n.Stmts {
+			Inspect(s, f)
+		}
+	case *Function:
+		names(n.Params)
+		Inspect(n.Body, f)
+	case *Table:
+		for _, field := range n.Fields {
+			Inspect(field, f)
+		}
+	case *Field:
+		if n.Key != nil {
+			Inspect(n.Key, f)
+		}
+		Inspect(n.Value, f)
+	case *Binary:
+		Inspect(n.X, f)
+		Inspect(n.Y, f)
+	case *Unary:
+		Inspect(n.X, f)
+	case *Paren:
+		Inspect(n.X, f)
+	case *Index:
+		Inspect(n.X, f)
+		Inspect(n.Key, f)
+	case *Call:
+		Inspect(n.Fn, f)
+		exprs(n.Args)
+	case *Local:
+		names(n.Names)
+		exprs(n.Values)
+	case *Assign:
+		exprs(n.Targets)
+		exprs(n.Values)
+	case *CallStmt:
+		Inspect(n.Call, f)
+	case *Do:
+		Inspect(n.Body, f)
+	case *While:
+		Inspect(n.Cond, f)
+		Inspect(n.Body, f)
+	case *Repeat:
+		Inspect(n.Body, f)
+		Inspect(n.Cond, f)
+	case *If:
+		for _, c := range n.Clauses {
+			Inspect(c, f)
+		}
+		if n.Else != nil {
+			Inspect(n.Else, f)
+		}
+	case *IfClause:
+		Inspect(n.Cond, f)
+		Inspect(n.Body, f)
+	case *NumericFor:
+		Inspect(n.Var, f)
+		Inspect(n.Init, f)
+		Inspect(n.Limit, f)
+		if n.Step != nil {
+			Inspect(n.Step, f)
+		}
+		Inspect(n.Body, f)
+	case *GenericFor:
+		names(n.Names)
+		exprs(n.Exprs)
+		Inspect(n.Body, f)
+	case *FunctionStmt:
+		names(n.Name)
+		Inspect(n.Func, f)
+	case *LocalFunction:
+		Inspect(n.Name, f)
+		Inspect(n.Func, f)
+	case *Return:
+		exprs(n.Values)
+	}
+}
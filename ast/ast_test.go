@@ -0,0 +1,226 @@
+package ast
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/go-lua"
+)
+
+const source = `-- A module.
+local M = {}
+
+local function helper(a, b, ...) -- adds
+	return a + b * 2 ^ -select("#", ...)
+end
+
+--[[ Long
+comment ]]
+function M.f(x) if x then return helper(x, 1) elseif not x then return nil else end end
+function M:g(...)
+	local t = {1, 2; n = 3, ["k" .. 1] = {}, [[raw]],
+		-- doc
+		last = function() end, -- trailing
+	}
+	t[#t + 1] = (self.f)(...)
+	;(print or error)(t.n)
+	for i = 10, 1, -1 do t[i] = i end
+	for k, v in pairs(t) do repeat local y = k until y end
+	while false do break end
+	do goto done end
+	::done::
+	return (-1) ^ 2, - -1, not (1 == 2), (1 + 2) * 3, 1 + (2 + 3), 2 ^ 3 ^ 2, "a" .. "b" .. "c", ("x"):rep(2)
+	-- end of g
+end
+
+return M
+`
+
+func parse(t *testing.T, s string) *Chunk {
+	c, err := Parse("test", strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func print(t *testing.T, n Node) string {
+	var b bytes.Buffer
+	if err := Fprint(&b, n); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestPositions(t *testing.T) {
+	c := parse(t, source)
+	if len(c.Comments) != 6 {
+		t.Errorf("expected 6 comments, got %d", len(c.Comments))
+	}
+	f := c.Block.Stmts[1].(*LocalFunction)
+	if got, want := f.Span, (Span{Position{4, 1}, Position{6, 4}}); got != want {
+		t.Errorf("local function at %v, expected %v", got, want)
+	}
+	if f.Func.Body.Line == nil || f.Func.Body.Line.Text != "-- adds" {
+		t.Errorf("expected line comment on local function body, got %v", f.Func.Body.Line)
+	}
+	ret := f.Func.Body.Stmts[0].(*Return)
+	if got, want := ret.Values[0].Start(), (Position{5, 9}); got != want {
+		t.Errorf("return value at %v, expected %v", got, want)
+	}
+	if g := c.Block.Stmts[2].(*FunctionStmt); len(g.Doc) != 1 || !strings.HasPrefix(g.Doc[0].Text, "--[[ Long") {
+		t.Errorf("expected doc comment on M.f, got %v", g.Doc)
+	}
+	g := c.Block.Stmts[3].(*FunctionStmt)
+	if !g.Func.Method || len(g.Func.Body.Comments) != 1 || g.Func.Body.Comments[0].Text != "-- end of g" {
+		t.Errorf("unexpected method %+v", g.Func)
+	}
+	table := g.Func.Body.Stmts[0].(*Local).Values[0].(*Table)
+	if last := table.Fields[len(table.Fields)-1]; len(last.Doc) != 1 || last.Line == nil || last.Line.Text != "-- trailing" {
+		t.Errorf("unexpected comments on last field: %v %v", last.Doc, last.Line)
+	}
+	var names int
+	Inspect(c, func(n Node) bool {
+		if _, ok := n.(*Name); ok {
+			names++
+		}
+		return true
+	})
+	if names != 35 {
+		t.Errorf("expected 35 names, found %d", names)
+	}
+}
+
+// run executes s and returns its results, converted to strings.
+func run(t *testing.T, s string) []string {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	top := l.Top()
+	if err := lua.DoString(l, s); err != nil {
+		t.Fatalf("%v in\n%s", err, s)
+	}
+	var results []string
+	for i := top + 1; i <= l.Top(); i++ {
+		s, _ := lua.ToStringMeta(l, i)
+		results = append(results, s)
+		l.Pop(1)
+	}
+	return results
+}
+
+func TestPrintRoundTrip(t *testing.T) {
+	programs := []string{strings.Replace(source, "return M\n", "return M:g(1, 2)\n", 1), `
+local t = setmetatable({}, {__index = function(_, k) return k * 2 end})
+local s = 0
+for i = 1, 10 do s = s + t[i] end
+local f = function(...) return select("#", ...), ... end
+return s, f(1, nil, 3), 2^-2, -2^2, #"abc" .. "d", 1 < 2 == true, "\0\"\n"`}
+	for _, s := range programs {
+		printed := checkPrint(t, s)
+		if got, want := strings.Join(run(t, printed), " "), strings.Join(run(t, s), " "); got != want {
+			t.Errorf("printed program returned %s, expected %s", got, want)
+		}
+	}
+}
+
+// checkPrint prints s and checks that printing is idempotent and keeps every
+// comment.
+func checkPrint(t *testing.T, s string) string {
+	printed := print(t, parse(t, s))
+	if again := print(t, parse(t, printed)); again != printed {
+		t.Errorf("printing is not idempotent:\n%s\n---\n%s", printed, again)
+	}
+	if len(parse(t, printed).Comments) != len(parse(t, s).Comments) {
+		t.Errorf("comments lost in\n%s", printed)
+	}
+	return printed
+}
+
+// TestPrintCorpus prints the fixtures and, when the submodule is checked out,
+// the Lua test suite, checking that Parse accepts the files lua.Load accepts
+// and only those.
+func TestPrintCorpus(t *testing.T) {
+	files, _ := filepath.Glob("../fixtures/*.lua")
+	suite, _ := filepath.Glob("../lua-tests/*.lua")
+	for _, file := range append(files, suite...) {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = Parse(file, bytes.NewReader(b))
+		if loadErr := lua.NewState().Load(bytes.NewReader(b), "@"+file, "t"); err == nil && loadErr != nil {
+			t.Errorf("%s: Parse accepted a chunk lua.Load rejects: %v", file, loadErr)
+		} else if err != nil && loadErr == nil {
+			t.Errorf("%s: lua.Load accepted a chunk Parse rejects: %v", file, err)
+		}
+		if err == nil {
+			checkPrint(t, string(b))
+		}
+	}
+}
+
+func TestParseGotos(t *testing.T) {
+	for _, source := range []string{
+		"do goto l; local x = 1; ::l:: end",
+		"do goto l; local x = 1; ::l:: ; ::m:: end",
+		"for i = 1, 3 do if i == 2 then goto continue end local y = i ::continue:: end",
+		"while true do local x = 1 do break end end",
+		"::top:: local x = 1 do goto top end",
+		"local function f() goto l ::l:: end ::l::",
+		"do ::a:: end ::a::",
+	} {
+		if err := lua.LoadString(lua.NewState(), source); err != nil {
+			t.Errorf("lua.Load rejected %q: %v", source, err)
+		}
+		if _, err := Parse("test", strings.NewReader(source)); err != nil {
+			t.Errorf("parsing %q: %v", source, err)
+		}
+	}
+}
+
+func TestPrintCanonical(t *testing.T) {
+	got := print(t, parse(t, "local   x=1  -- one\n\n\n\nif x then print( x ,{a=1;2}) end"))
+	want := "local x = 1 -- one\n\nif x then\n\tprint(x, {a = 1, 2})\nend\n"
+	if got != want {
+		t.Errorf("got\n%s\nexpected\n%s", got, want)
+	}
+	built := &Binary{Op: "*", X: &Binary{Op: "+", X: &Name{Name: "a"}, Y: &Number{Value: 1}}, Y: &Unary{Op: "-", X: &Number{Value: -2}}}
+	if got, want := print(t, built), "(a + 1) * -(-2)\n"; got != want {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+	index := &Index{X: &String{Value: "s"}, Key: &String{Value: "end"}, Dot: true}
+	if got, want := print(t, index), `("s")["end"]`+"\n"; got != want {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct{ source, message string }{
+		{"x = ", "test:1:5: unexpected symbol near <eof>"},
+		{"if x then\n\nx = 1", "test:3:6: 'end' expected (to close 'if' at line 1) near <eof>"},
+		{"f() = 1", "test:1:5: syntax error near '='"},
+		{"function f() return ... end", "test:1:21: cannot use '...' outside a vararg function near '...'"},
+		{"x = 'abc", "test:1:5: unfinished string near <eof>"},
+		{"local t = {a = 1 b = 2}", "test:1:18: '}' expected near b"},
+		{"if x then break end", "test:1:11: <break> at line 1 not inside a loop"},
+		{"goto nowhere", "test:1:1: no visible label 'nowhere' for <goto> at line 1"},
+		{"::a:: ::a::", "test:1:7: label 'a' already defined on line 1"},
+		{"do goto l; local x = 1; ::l:: print(x) end", "test:1:25: <goto l> at line 1 jumps into the scope of local 'x'"},
+		{"while x do goto l end local function f() ::l:: end", "test:1:12: no visible label 'l' for <goto> at line 1"},
+		{"repeat goto l; local x ::l:: until x", "test:1:24: <goto l> at line 1 jumps into the scope of local 'x'"},
+	}
+	for _, test := range tests {
+		l := lua.NewState()
+		if lua.LoadString(l, test.source) == nil {
+			t.Errorf("lua.Load accepted %q", test.source)
+		}
+		if _, err := Parse("test", strings.NewReader(test.source)); err == nil {
+			t.Errorf("expected error parsing %q", test.source)
+		} else if err.Error() != test.message {
+			t.Errorf("parsing %q: got %q, expected %q", test.source, err.Error(), test.message)
+		}
+	}
+}
@@ -0,0 +1,775 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Shopify/go-lua"
+)
+
+// An Error is a syntax error found by Parse.
+type Error struct {
+	Chunk   string
+	Pos     Position
+	Message string
+	Near    string // the offending token, if any
+}
+
+func (e *Error) Error() string {
+	s := fmt.Sprintf("%d:%d: %s", e.Pos.Line, e.Pos.Column, e.Message)
+	if e.Near != "" {
+		s += " near " + e.Near
+	}
+	if e.Chunk != "" {
+		s = e.Chunk + ":" + s
+	}
+	return s
+}
+
+// Parse parses the chunk named name from r. Tokens are read with
+// lua.Scanner, and gotos, labels and breaks are checked as lua.Load checks
+// them, so Parse accepts the same dialect as lua.Load. Syntax errors are
+// *Error. When name is empty, errors start with the line.
+func Parse(name string, r io.Reader) (chunk *Chunk, err error) {
+	p := &parser{s: lua.NewScanner("="+name, r), chunk: name}
+	defer func() {
+		if r := recover(); r != nil {
+			bail, ok := r.(bailout)
+			if !ok {
+				panic(r)
+			}
+			chunk, err = nil, bail.err
+		}
+	}()
+	p.function = &function{vararg: true} // the main function is vararg
+	p.next()
+	chunk = &Chunk{Name: name, Block: p.block()}
+	if p.tok.Kind != lua.TokenEOF {
+		p.errorExpected("<eof>")
+	}
+	chunk.Block.Comments = append(chunk.Block.Comments, p.takeComments()...)
+	chunk.Comments = p.comments
+	return
+}
+
+type bailout struct{ err error }
+
+type parser struct {
+	s         *lua.Scanner
+	chunk     string
+	tok, prev lua.Token
+	ahead     *lua.Token
+	comments  []*Comment // all comments
+	pending   []*Comment // comments not yet attached to a node
+	function  *function  // the function being parsed
+}
+
+// A label is a label or a pending goto, with the number of locals active at
+// its statement. Breaks are gotos to a "break" label closing each loop.
+type label struct {
+	name   string
+	pos    Position
+	active int
+}
+
+type scope struct {
+	previous              *scope
+	firstLabel, firstGoto int
+	active                int // the number of locals active when the scope opened
+	loop                  bool
+}
+
+type function struct {
+	previous *function
+	vararg   bool
+	scope    *scope
+	labels   []label  // labels visible in the open scopes
+	gotos    []label  // gotos not yet matched with a label
+	locals   []string // names of the active locals
+}
+
+func (p *parser) scan() lua.Token {
+	for {
+		t, err := p.s.Scan()
+		if e := (*lua.CompileError)(nil); errors.As(err, &e) {
+			panic(bailout{&Error{Chunk: p.chunk, Pos: Position{e.Line, e.Column}, Message: e.Message, Near: e.Near}})
+		} else if err != nil {
+			panic(bailout{err})
+		}
+		if t.Kind != lua.TokenComment {
+			return t
+		}
+		c := &Comment{Span: span(t, t), Text: t.Text}
+		p.comments, p.pending = append(p.comments, c), append(p.pending, c)
+	}
+}
+
+func (p *parser) next() {
+	p.prev = p.tok
+	if p.ahead != nil {
+		p.tok, p.ahead = *p.ahead, nil
+	} else {
+		p.tok = p.scan()
+	}
+}
+
+func (p *parser) lookAhead() lua.Token {
+	if p.ahead == nil {
+		t := p.scan()
+		p.ahead = &t
+	}
+	return *p.ahead
+}
+
+func start(t lua.Token) Position { return Position{t.Line, t.Column} }
+func end(t lua.Token) Position   { return Position{t.EndLine, t.EndColumn} }
+func span(from, to lua.Token) Span {
+	return Span{From: start(from), To: end(to)}
+}
+
+// close sets the end of s to the end of the last token consumed.
+func (p *parser) close(s *Span, from lua.Token) { *s = span(from, p.prev) }
+
+func (p *parser) takeComments() (c []*Comment) {
+	c, p.pending = p.pending, nil
+	return
+}
+
+// attach gives a a comment that follows the node on its last line, and doc.
+func (p *parser) attach(a *Attached, doc []*Comment) {
+	a.Doc = doc
+	if len(p.pending) > 0 && p.pending[0].From.Line == p.prev.EndLine {
+		a.Line, p.pending = p.pending[0], p.pending[1:]
+	}
+}
+
+func (p *parser) error(message string) {
+	near := p.tok.Text
+	switch p.tok.Kind {
+	case lua.TokenEOF:
+		near = "<eof>"
+	case lua.TokenName, lua.TokenString, lua.TokenNumber:
+	default:
+		near = "'" + near + "'"
+	}
+	panic(bailout{&Error{Chunk: p.chunk, Pos: start(p.tok), Message: message, Near: near}})
+}
+
+func (p *parser) errorExpected(what string) { p.error(what + " expected") }
+
+func (p *parser) semanticError(pos Position, message string) {
+	panic(bailout{&Error{Chunk: p.chunk, Pos: pos, Message: message}})
+}
+
+func (p *parser) is(text string) bool {
+	return (p.tok.Kind == lua.TokenKeyword || p.tok.Kind == lua.TokenSymbol) && p.tok.Text == text
+}
+
+func (p *parser) testNext(text string) bool {
+	if p.is(text) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *parser) checkNext(text string) {
+	if !p.testNext(text) {
+		p.errorExpected("'" + text + "'")
+	}
+}
+
+func (p *parser) checkMatch(what, who string, where lua.Token) {
+	if !p.testNext(what) {
+		if where.Line == p.tok.Line {
+			p.errorExpected("'" + what + "'")
+		}
+		p.error(fmt.Sprintf("'%s' expected (to close '%s' at line %d)", what, who, where.Line))
+	}
+}
+
+func (p *parser) name() *Name {
+	if p.tok.Kind != lua.TokenName {
+		p.errorExpected("<name>")
+	}
+	n := &Name{Span: span(p.tok, p.tok), Name: p.tok.Text}
+	p.next()
+	return n
+}
+
+func (p *parser) blockFollow(withUntil bool) bool {
+	if p.tok.Kind == lua.TokenEOF {
+		return true
+	} else if p.tok.Kind != lua.TokenKeyword {
+		return false
+	}
+	switch p.tok.Text {
+	case "else", "elseif", "end":
+		return true
+	case "until":
+		return withUntil
+	}
+	return false
+}
+
+func (p *parser) block() *Block {
+	from := p.tok
+	b := &Block{}
+	if len(p.pending) > 0 && p.pending[0].From.Line == p.prev.EndLine {
+		b.Line, p.pending = p.pending[0], p.pending[1:]
+	}
+	p.openScope(false)
+	labels := 0 // the labels ending the statements so far
+	for {
+		if labels > 0 && !p.is(";") && !p.is("::") {
+			p.matchLabels(labels, p.blockFollow(false))
+			labels = 0
+		}
+		if p.blockFollow(true) {
+			break
+		}
+		isReturn := p.is("return")
+		s := p.statement()
+		if e, ok := s.(*Empty); ok && len(b.Stmts) > 0 && e.Line != nil && len(e.Doc) == 0 {
+			// A comment after "x = 1;" belongs to the assignment.
+			if prev := b.Stmts[len(b.Stmts)-1].Comments(); prev.Line == nil && b.Stmts[len(b.Stmts)-1].End().Line == e.From.Line {
+				prev.Line, e.Line = e.Line, nil
+			}
+		}
+		b.Stmts = append(b.Stmts, s)
+		if _, ok := s.(*Label); ok {
+			labels++
+		}
+		if isReturn {
+			break
+		}
+	}
+	p.closeScope()
+	if len(b.Stmts) == 0 {
+		b.Span = Span{From: start(from), To: start(from)}
+	} else {
+		p.close(&b.Span, from)
+	}
+	b.Comments = p.takeComments()
+	return b
+}
+
+func (p *parser) openScope(loop bool) {
+	f := p.function
+	f.scope = &scope{previous: f.scope, firstLabel: len(f.labels), firstGoto: len(f.gotos), active: len(f.locals), loop: loop}
+}
+
+// closeScope matches the breaks of a loop, and moves the pending gotos of the
+// scope out to the enclosing one, or reports the first of them if the scope
+// is the function body.
+func (p *parser) closeScope() {
+	f, s := p.function, p.function.scope
+	if s.loop {
+		p.matchGotos(label{name: "break", active: len(f.locals)})
+	}
+	f.scope, f.labels, f.locals = s.previous, f.labels[:s.firstLabel], f.locals[:s.active]
+	if s.previous == nil {
+		if s.firstGoto < len(f.gotos) {
+			g := f.gotos[s.firstGoto]
+			if g.name == "break" {
+				p.semanticError(g.pos, fmt.Sprintf("<break> at line %d not inside a loop", g.pos.Line))
+			}
+			p.semanticError(g.pos, fmt.Sprintf("no visible label '%s' for <goto> at line %d", g.name, g.pos.Line))
+		}
+		return
+	}
+	for i := s.firstGoto; i < len(f.gotos); {
+		if f.gotos[i].active > s.active {
+			f.gotos[i].active = s.active
+		}
+		if !p.findLabel(i) {
+			i++
+		}
+	}
+}
+
+func (p *parser) label(name string, pos Position) {
+	f := p.function
+	for _, l := range f.labels[f.scope.firstLabel:] {
+		if l.name == name {
+			p.semanticError(pos, fmt.Sprintf("label '%s' already defined on line %d", name, l.pos.Line))
+		}
+	}
+	f.labels = append(f.labels, label{name: name, pos: pos, active: len(f.locals)})
+}
+
+// matchLabels matches the last n labels with the pending gotos of the scope.
+// Labels that end the block are outside the scope of its locals.
+func (p *parser) matchLabels(n int, endOfBlock bool) {
+	f := p.function
+	for i := len(f.labels) - 1; i >= len(f.labels)-n; i-- {
+		if endOfBlock {
+			f.labels[i].active = f.scope.active
+		}
+		p.matchGotos(f.labels[i])
+	}
+}
+
+func (p *parser) matchGotos(l label) {
+	f := p.function
+	for i := f.scope.firstGoto; i < len(f.gotos); {
+		if f.gotos[i].name == l.name {
+			p.closeGoto(i, l)
+		} else {
+			i++
+		}
+	}
+}
+
+func (p *parser) jump(name string, pos Position) {
+	f := p.function
+	f.gotos = append(f.gotos, label{name: name, pos: pos, active: len(f.locals)})
+	p.findLabel(len(f.gotos) - 1)
+}
+
+// findLabel closes the pending goto i if its label is visible in the current
+// scope.
+func (p *parser) findLabel(i int) bool {
+	f := p.function
+	for _, l := range f.labels[f.scope.firstLabel:] {
+		if l.name == f.gotos[i].name {
+			p.closeGoto(i, l)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *parser) closeGoto(i int, l label) {
+	f := p.function
+	if g := f.gotos[i]; g.active < l.active {
+		p.semanticError(l.pos, fmt.Sprintf("<goto %s> at line %d jumps into the scope of local '%s'", g.name, g.pos.Line, f.locals[g.active]))
+	}
+	f.gotos = append(f.gotos[:i], f.gotos[i+1:]...)
+}
+
+func (p *parser) statement() Stmt {
+	doc, from := p.takeComments(), p.tok
+	var s Stmt
+	switch {
+	case p.is(";"):
+		p.next()
+		s = &Empty{}
+	case p.is("if"):
+		s = p.ifStatement()
+	case p.is("while"):
+		p.next()
+		w := &While{Cond: p.expression()}
+		p.checkNext("do")
+		p.openScope(true)
+		w.Body = p.block()
+		p.checkMatch("end", "while", from)
+		p.closeScope()
+		s = w
+	case p.is("do"):
+		p.next()
+		d := &Do{Body: p.block()}
+		p.checkMatch("end", "do", from)
+		s = d
+	case p.is("for"):
+		s = p.forStatement()
+	case p.is("repeat"):
+		p.next()
+		p.openScope(true)
+		r := &Repeat{Body: p.block()}
+		p.checkMatch("until", "repeat", from)
+		r.Cond = p.expression()
+		p.closeScope()
+		s = r
+	case p.is("function"):
+		p.next()
+		f := &FunctionStmt{Name: []*Name{p.name()}}
+		for p.testNext(".") {
+			f.Name = append(f.Name, p.name())
+		}
+		method := p.testNext(":")
+		if method {
+			f.Name = append(f.Name, p.name())
+		}
+		f.Func = p.body(from, method)
+		s = f
+	case p.is("local"):
+		p.next()
+		if fn := p.tok; p.testNext("function") {
+			name := p.name()
+			p.function.locals = append(p.function.locals, name.Name)
+			s = &LocalFunction{Name: name, Func: p.body(fn, false)}
+			break
+		}
+		l := &Local{}
+		for first := true; first || p.testNext(","); first = false {
+			l.Names = append(l.Names, p.name())
+		}
+		if p.testNext("=") {
+			l.Values = p.expressionList()
+		}
+		for _, n := range l.Names {
+			p.function.locals = append(p.function.locals, n.Name)
+		}
+		s = l
+	case p.is("::"):
+		p.next()
+		n := p.name()
+		p.checkNext("::")
+		p.label(n.Name, start(from))
+		s = &Label{Name: n.Name}
+	case p.is("return"):
+		p.next()
+		r := &Return{}
+		if !p.blockFollow(true) && !p.is(";") {
+			r.Values = p.expressionList()
+		}
+		p.testNext(";")
+		s = r
+	case p.is("break"):
+		p.next()
+		p.jump("break", start(from))
+		s = &Break{}
+	case p.is("goto"):
+		p.next()
+		g := &Goto{Label: p.name().Name}
+		p.jump(g.Label, start(from))
+		s = g
+	default:
+		s = p.expressionStatement()
+	}
+	p.close(spanOf(s), from)
+	p.attach(s.Comments(), doc)
+	return s
+}
+
+func spanOf(s Stmt) *Span {
+	switch s := s.(type) {
+	case *Empty:
+		return &s.Span
+	case *Local:
+		return &s.Span
+	case *Assign:
+		return &s.Span
+	case *CallStmt:
+		return &s.Span
+	case *Do:
+		return &s.Span
+	case *While:
+		return &s.Span
+	case *Repeat:
+		return &s.Span
+	case *If:
+		return &s.Span
+	case *NumericFor:
+		return &s.Span
+	case *GenericFor:
+		return &s.Span
+	case *FunctionStmt:
+		return &s.Span
+	case *LocalFunction:
+		return &s.Span
+	case *Return:
+		return &s.Span
+	case *Break:
+		return &s.Span
+	case *Goto:
+		return &s.Span
+	case *Label:
+		return &s.Span
+	}
+	panic(fmt.Sprintf("unexpected statement %T", s))
+}
+
+func (p *parser) ifStatement() *If {
+	from, s := p.tok, &If{}
+	for p.is("if") || p.is("elseif") {
+		clauseFrom := p.tok
+		p.next()
+		c := &IfClause{Cond: p.expression()}
+		p.checkNext("then")
+		c.Body = p.block()
+		p.close(&c.Span, clauseFrom)
+		s.Clauses = append(s.Clauses, c)
+	}
+	if p.testNext("else") {
+		s.Else = p.block()
+	}
+	p.checkMatch("end", "if", from)
+	return s
+}
+
+func (p *parser) forStatement() Stmt {
+	from := p.tok
+	p.next()
+	first := p.name()
+	switch {
+	case p.testNext("="):
+		f := &NumericFor{Var: first, Init: p.expression()}
+		p.checkNext(",")
+		if f.Limit = p.expression(); p.testNext(",") {
+			f.Step = p.expression()
+		}
+		f.Body = p.forBody(from)
+		return f
+	case p.is(",") || p.is("in"):
+		f := &GenericFor{Names: []*Name{first}}
+		for p.testNext(",") {
+			f.Names = append(f.Names, p.name())
+		}
+		p.checkNext("in")
+		f.Exprs = p.expressionList()
+		f.Body = p.forBody(from)
+		return f
+	}
+	p.errorExpected("'=' or 'in'")
+	return nil
+}
+
+func (p *parser) forBody(from lua.Token) *Block {
+	p.checkNext("do")
+	p.openScope(true)
+	b := p.block()
+	p.checkMatch("end", "for", from)
+	p.closeScope()
+	return b
+}
+
+func (p *parser) body(from lua.Token, method bool) *Function {
+	f := &Function{Method: method}
+	p.checkNext("(")
+	if !p.is(")") {
+		for first := true; first || (!f.IsVararg && p.testNext(",")); first = false {
+			switch {
+			case p.tok.Kind == lua.TokenName:
+				f.Params = append(f.Params, p.name())
+			case p.testNext("..."):
+				f.IsVararg = true
+			default:
+				p.error("<name> or '...' expected")
+			}
+		}
+	}
+	p.checkNext(")")
+	p.function = &function{previous: p.function, vararg: f.IsVararg}
+	for _, n := range f.Params {
+		p.function.locals = append(p.function.locals, n.Name)
+	}
+	f.Body = p.block()
+	p.function = p.function.previous
+	p.checkMatch("end", "function", from)
+	p.close(&f.Span, from)
+	return f
+}
+
+func (p *parser) expressionStatement() Stmt {
+	e := p.suffixedExpression()
+	if p.is("=") || p.is(",") {
+		a := &Assign{Targets: []Expr{e}}
+		for p.testNext(",") {
+			a.Targets = append(a.Targets, p.suffixedExpression())
+		}
+		for _, t := range a.Targets {
+			switch t.(type) {
+			case *Name, *Index:
+			default:
+				p.error("syntax error")
+			}
+		}
+		p.checkNext("=")
+		a.Values = p.expressionList()
+		return a
+	}
+	c, ok := e.(*Call)
+	if !ok {
+		p.error("syntax error")
+	}
+	return &CallStmt{Call: c}
+}
+
+func (p *parser) expressionList() []Expr {
+	list := []Expr{p.expression()}
+	for p.testNext(",") {
+		list = append(list, p.expression())
+	}
+	return list
+}
+
+func (p *parser) primaryExpression() Expr {
+	switch from := p.tok; {
+	case p.tok.Kind == lua.TokenName:
+		return p.name()
+	case p.testNext("("):
+		e := &Paren{X: p.expression()}
+		p.checkMatch(")", "(", from)
+		p.close(&e.Span, from)
+		return e
+	}
+	p.error("unexpected symbol")
+	return nil
+}
+
+func (p *parser) suffixedExpression() Expr {
+	from := p.tok
+	e := p.primaryExpression()
+	for {
+		switch {
+		case p.testNext("."):
+			n := p.name()
+			i := &Index{X: e, Key: &String{Span: n.Span, Value: n.Name}, Dot: true}
+			p.close(&i.Span, from)
+			e = i
+		case p.testNext("["):
+			i := &Index{X: e, Key: p.expression()}
+			p.checkNext("]")
+			p.close(&i.Span, from)
+			e = i
+		case p.testNext(":"):
+			c := &Call{Fn: e, Method: p.name().Name}
+			c.Args = p.arguments()
+			p.close(&c.Span, from)
+			e = c
+		case p.is("(") || p.is("{") || p.tok.Kind == lua.TokenString:
+			c := &Call{Fn: e, Args: p.arguments()}
+			p.close(&c.Span, from)
+			e = c
+		default:
+			return e
+		}
+	}
+}
+
+func (p *parser) arguments() []Expr {
+	switch from := p.tok; {
+	case p.tok.Kind == lua.TokenString:
+		return []Expr{p.simpleExpression()}
+	case p.is("{"):
+		return []Expr{p.table()}
+	case p.testNext("("):
+		var args []Expr
+		if !p.is(")") {
+			args = p.expressionList()
+		}
+		p.checkMatch(")", "(", from)
+		return args
+	}
+	p.error("function arguments expected")
+	return nil
+}
+
+func (p *parser) table() *Table {
+	from, t := p.tok, &Table{}
+	p.checkNext("{")
+	for !p.is("}") {
+		doc, fieldFrom := p.takeComments(), p.tok
+		f := &Field{}
+		switch {
+		case p.tok.Kind == lua.TokenName && p.lookAhead().Text == "=" && p.lookAhead().Kind == lua.TokenSymbol:
+			n := p.name()
+			f.Key, f.Named = &String{Span: n.Span, Value: n.Name}, true
+			p.checkNext("=")
+		case p.testNext("["):
+			f.Key = p.expression()
+			p.checkNext("]")
+			p.checkNext("=")
+		}
+		f.Value = p.expression()
+		p.close(&f.Span, fieldFrom)
+		t.Fields = append(t.Fields, f)
+		more := p.testNext(",") || p.testNext(";")
+		p.attach(&f.Attached, doc)
+		if !more {
+			break
+		}
+	}
+	t.Comments = p.takeComments()
+	p.checkMatch("}", "{", from)
+	p.close(&t.Span, from)
+	return t
+}
+
+func (p *parser) simpleExpression() Expr {
+	from := p.tok
+	var e Expr
+	switch t := p.tok; {
+	case t.Kind == lua.TokenNumber:
+		e = &Number{Value: t.Number, Raw: t.Text}
+	case t.Kind == lua.TokenString:
+		e = &String{Value: t.Value, Raw: t.Text}
+	case p.is("nil"):
+		e = &Nil{}
+	case p.is("true"):
+		e = &True{}
+	case p.is("false"):
+		e = &False{}
+	case p.is("..."):
+		if !p.function.vararg {
+			p.error("cannot use '...' outside a vararg function")
+		}
+		e = &Vararg{}
+	case p.is("{"):
+		return p.table()
+	case p.is("function"):
+		p.next()
+		return p.body(from, false)
+	default:
+		return p.suffixedExpression()
+	}
+	p.next()
+	switch e := e.(type) {
+	case *Number:
+		e.Span = span(from, from)
+	case *String:
+		e.Span = span(from, from)
+	case *Nil:
+		e.Span = span(from, from)
+	case *True:
+		e.Span = span(from, from)
+	case *False:
+		e.Span = span(from, from)
+	case *Vararg:
+		e.Span = span(from, from)
+	}
+	return e
+}
+
+var priority = map[string]struct{ left, right int }{
+	"+": {6, 6}, "-": {6, 6}, "*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9}, "..": {5, 4}, // right associative
+	"==": {3, 3}, "<": {3, 3}, "<=": {3, 3}, "~=": {3, 3}, ">": {3, 3}, ">=": {3, 3},
+	"and": {2, 2}, "or": {1, 1},
+}
+
+const unaryPriority = 8
+
+func (p *parser) binaryOperator() (string, bool) {
+	if p.tok.Kind != lua.TokenSymbol && p.tok.Kind != lua.TokenKeyword {
+		return "", false
+	}
+	_, ok := priority[p.tok.Text]
+	return p.tok.Text, ok
+}
+
+func (p *parser) subExpression(limit int) Expr {
+	from := p.tok
+	var e Expr
+	if p.is("not") || p.is("-") || p.is("#") {
+		op := p.tok.Text
+		p.next()
+		u := &Unary{Op: op, X: p.subExpression(unaryPriority)}
+		p.close(&u.Span, from)
+		e = u
+	} else {
+		e = p.simpleExpression()
+	}
+	for op, ok := p.binaryOperator(); ok && priority[op].left > limit; op, ok = p.binaryOperator() {
+		p.next()
+		b := &Binary{Op: op, X: e, Y: p.subExpression(priority[op].right)}
+		p.close(&b.Span, from)
+		e = b
+	}
+	return e
+}
+
+func (p *parser) expression() Expr { return p.subExpression(0) }
@@ -0,0 +1,514 @@
+package ast
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Fprint writes node to w as Lua source in a canonical layout: one statement
+// per line, tab indentation, single spaces around binary operators and after
+// commas, and explicit parentheses around call arguments. Comments attached
+// to statements and fields are kept, as are single blank lines between
+// statements. node must be a *Chunk, *Block, Stmt or Expr.
+//
+// Literals are printed as written when their Raw form is known. Parentheses
+// are added where the tree's structure requires them, so that trees built by
+// hand print correctly too.
+func Fprint(w io.Writer, node Node) error {
+	p := &printer{w: bufio.NewWriter(w)}
+	switch n := node.(type) {
+	case *Chunk:
+		p.block(n.Block)
+	case *Block:
+		if n.Line != nil {
+			p.print(n.Line.Text)
+			p.newline()
+		}
+		p.block(n)
+	case Stmt:
+		p.statements([]Stmt{n})
+	case Expr:
+		p.expression(n)
+		p.newline()
+	default:
+		return fmt.Errorf("ast: unexpected node %T", node)
+	}
+	return p.w.Flush()
+}
+
+type printer struct {
+	w      *bufio.Writer
+	indent int
+	bol    bool // at the beginning of a line
+}
+
+func (p *printer) print(s ...string) {
+	for _, s := range s {
+		if p.bol {
+			for i := 0; i < p.indent; i++ {
+				p.w.WriteByte('\t')
+			}
+			p.bol = false
+		}
+		p.w.WriteString(s)
+	}
+}
+
+func (p *printer) newline() {
+	p.w.WriteByte('\n')
+	p.bol = true
+}
+
+func (p *printer) comments(cs []*Comment) {
+	for _, c := range cs {
+		p.print(c.Text)
+		p.newline()
+	}
+}
+
+func firstLine(s Stmt) int {
+	if doc := s.Comments().Doc; len(doc) > 0 {
+		return doc[0].From.Line
+	}
+	return s.Start().Line
+}
+
+func (p *printer) block(b *Block) {
+	p.statements(b.Stmts)
+	if len(b.Comments) > 0 && len(b.Stmts) > 0 {
+		last := b.Stmts[len(b.Stmts)-1]
+		if b.Comments[0].From.Line > last.End().Line+1 {
+			p.newline()
+		}
+	}
+	p.comments(b.Comments)
+}
+
+func (p *printer) statements(stmts []Stmt) {
+	var prev Stmt
+	for _, s := range stmts {
+		a := s.Comments()
+		if _, empty := s.(*Empty); empty {
+			if len(a.Doc) == 0 && a.Line == nil {
+				continue
+			}
+			p.comments(a.Doc)
+			if a.Line != nil {
+				p.print(a.Line.Text)
+				p.newline()
+			}
+			prev = s
+			continue
+		}
+		if prev != nil && prev.End().Line > 0 && firstLine(s) > prev.End().Line+1 {
+			p.newline()
+		}
+		p.comments(a.Doc)
+		if prev != nil && startsWithParen(s) {
+			p.print(";")
+		}
+		p.statement(s)
+		if a.Line != nil {
+			p.print(" ", a.Line.Text)
+		}
+		p.newline()
+		prev = s
+	}
+}
+
+// startsWithParen reports whether s starts with a parenthesis, which would
+// continue the previous statement as a call unless a semicolon separates them.
+func startsWithParen(s Stmt) bool {
+	var e Expr
+	switch s := s.(type) {
+	case *CallStmt:
+		e = s.Call
+	case *Assign:
+		e = s.Targets[0]
+	default:
+		return false
+	}
+	for {
+		switch x := e.(type) {
+		case *Call:
+			e = x.Fn
+		case *Index:
+			e = x.X
+		case *Name:
+			return false
+		default:
+			return true
+		}
+	}
+}
+
+func (p *printer) body(b *Block) {
+	if b.Line != nil {
+		p.print(" ", b.Line.Text)
+	}
+	p.newline()
+	p.indent++
+	p.block(b)
+	p.indent--
+}
+
+func (p *printer) statement(s Stmt) {
+	switch s := s.(type) {
+	case *Local:
+		p.print("local ")
+		p.names(s.Names)
+		if len(s.Values) > 0 {
+			p.print(" = ")
+			p.expressions(s.Values)
+		}
+	case *Assign:
+		p.expressions(s.Targets)
+		p.print(" = ")
+		p.expressions(s.Values)
+	case *CallStmt:
+		p.expression(s.Call)
+	case *Do:
+		p.print("do")
+		p.body(s.Body)
+		p.print("end")
+	case *While:
+		p.print("while ")
+		p.expression(s.Cond)
+		p.print(" do")
+		p.body(s.Body)
+		p.print("end")
+	case *Repeat:
+		p.print("repeat")
+		p.body(s.Body)
+		p.print("until ")
+		p.expression(s.Cond)
+	case *If:
+		for i, c := range s.Clauses {
+			if i == 0 {
+				p.print("if ")
+			} else {
+				p.print("elseif ")
+			}
+			p.expression(c.Cond)
+			p.print(" then")
+			p.body(c.Body)
+		}
+		if s.Else != nil {
+			p.print("else")
+			p.body(s.Else)
+		}
+		p.print("end")
+	case *NumericFor:
+		p.print("for ", s.Var.Name, " = ")
+		p.expression(s.Init)
+		p.print(", ")
+		p.expression(s.Limit)
+		if s.Step != nil {
+			p.print(", ")
+			p.expression(s.Step)
+		}
+		p.print(" do")
+		p.body(s.Body)
+		p.print("end")
+	case *GenericFor:
+		p.print("for ")
+		p.names(s.Names)
+		p.print(" in ")
+		p.expressions(s.Exprs)
+		p.print(" do")
+		p.body(s.Body)
+		p.print("end")
+	case *FunctionStmt:
+		p.print("function ")
+		for i, n := range s.Name {
+			if i == 0 {
+			} else if i == len(s.Name)-1 && s.Func.Method {
+				p.print(":")
+			} else {
+				p.print(".")
+			}
+			p.print(n.Name)
+		}
+		p.function(s.Func)
+	case *LocalFunction:
+		p.print("local function ", s.Name.Name)
+		p.function(s.Func)
+	case *Return:
+		p.print("return")
+		if len(s.Values) > 0 {
+			p.print(" ")
+			p.expressions(s.Values)
+		}
+	case *Break:
+		p.print("break")
+	case *Goto:
+		p.print("goto ", s.Label)
+	case *Label:
+		p.print("::", s.Name, "::")
+	case *Empty:
+		p.print(";")
+	}
+}
+
+// function prints the parameters and body of f.
+func (p *printer) function(f *Function) {
+	p.print("(")
+	p.names(f.Params)
+	if f.IsVararg {
+		if len(f.Params) > 0 {
+			p.print(", ")
+		}
+		p.print("...")
+	}
+	p.print(")")
+	if len(f.Body.Stmts) == 0 && len(f.Body.Comments) == 0 && f.Body.Line == nil {
+		p.print(" end")
+		return
+	}
+	p.body(f.Body)
+	p.print("end")
+}
+
+func (p *printer) names(ns []*Name) {
+	for i, n := range ns {
+		if i > 0 {
+			p.print(", ")
+		}
+		p.print(n.Name)
+	}
+}
+
+func (p *printer) expressions(es []Expr) {
+	for i, e := range es {
+		if i > 0 {
+			p.print(", ")
+		}
+		p.expression(e)
+	}
+}
+
+// operand prints e, parenthesized if needed.
+func (p *printer) operand(e Expr, paren bool) {
+	if paren {
+		p.print("(")
+		p.expression(e)
+		p.print(")")
+	} else {
+		p.expression(e)
+	}
+}
+
+func isPrefix(e Expr) bool {
+	switch e.(type) {
+	case *Name, *Index, *Call, *Paren:
+		return true
+	}
+	return false
+}
+
+func (p *printer) expression(e Expr) {
+	switch e := e.(type) {
+	case *Nil:
+		p.print("nil")
+	case *True:
+		p.print("true")
+	case *False:
+		p.print("false")
+	case *Vararg:
+		p.print("...")
+	case *Number:
+		if e.Raw != "" {
+			p.print(e.Raw)
+		} else {
+			p.print(formatNumber(e.Value))
+		}
+	case *String:
+		if e.Raw != "" {
+			p.print(e.Raw)
+		} else {
+			p.print(Quote(e.Value))
+		}
+	case *Name:
+		p.print(e.Name)
+	case *Function:
+		p.print("function")
+		p.function(e)
+	case *Table:
+		p.table(e)
+	case *Binary:
+		op := priority[e.Op]
+		left, right := false, false
+		switch x := e.X.(type) {
+		case *Binary:
+			left = op.left > priority[x.Op].right
+		case *Unary:
+			left = op.left > unaryPriority
+		case *Number:
+			left = e.Op == "^" && x.Raw == "" && math.Signbit(x.Value)
+		}
+		if y, ok := e.Y.(*Binary); ok {
+			right = priority[y.Op].left <= op.right
+		}
+		p.operand(e.X, left)
+		p.print(" ", e.Op, " ")
+		p.operand(e.Y, right)
+	case *Unary:
+		p.print(e.Op)
+		paren := false
+		switch x := e.X.(type) {
+		case *Binary:
+			paren = priority[x.Op].left <= unaryPriority
+		case *Unary:
+			if e.Op == "-" && x.Op == "-" {
+				p.print(" ")
+			}
+		case *Number:
+			paren = x.Raw == "" && math.Signbit(x.Value) && e.Op == "-"
+		}
+		if e.Op == "not" {
+			p.print(" ")
+		}
+		p.operand(e.X, paren)
+	case *Paren:
+		p.print("(")
+		p.expression(e.X)
+		p.print(")")
+	case *Index:
+		p.operand(e.X, !isPrefix(e.X))
+		if k, ok := e.Key.(*String); ok && e.Dot && isName(k.Value) {
+			p.print(".", k.Value)
+		} else {
+			p.print("[")
+			p.expression(e.Key)
+			p.print("]")
+		}
+	case *Call:
+		p.operand(e.Fn, !isPrefix(e.Fn))
+		if e.Method != "" {
+			p.print(":", e.Method)
+		}
+		p.print("(")
+		p.expressions(e.Args)
+		p.print(")")
+	}
+}
+
+// multiline reports whether t was written over several lines, or has comments
+// that force it to be.
+func multiline(t *Table) bool {
+	if len(t.Comments) > 0 {
+		return true
+	}
+	for _, f := range t.Fields {
+		if len(f.Doc) > 0 || f.Line != nil || f.From.Line > t.From.Line && t.From.Line > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *printer) table(t *Table) {
+	if len(t.Fields) == 0 && len(t.Comments) == 0 {
+		p.print("{}")
+		return
+	}
+	lines := multiline(t)
+	p.print("{")
+	if lines {
+		p.newline()
+		p.indent++
+	}
+	for i, f := range t.Fields {
+		if lines {
+			p.comments(f.Doc)
+		} else if i > 0 {
+			p.print(", ")
+		}
+		switch k, ok := f.Key.(*String); {
+		case f.Key == nil:
+		case ok && f.Named && isName(k.Value):
+			p.print(k.Value, " = ")
+		default:
+			p.print("[")
+			p.expression(f.Key)
+			p.print("] = ")
+		}
+		p.expression(f.Value)
+		if lines {
+			p.print(",")
+			if f.Line != nil {
+				p.print(" ", f.Line.Text)
+			}
+			p.newline()
+		}
+	}
+	if lines {
+		p.comments(t.Comments)
+		p.indent--
+	}
+	p.print("}")
+}
+
+func formatNumber(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "1e1000"
+	case math.IsInf(f, -1):
+		return "-1e1000"
+	case f != f:
+		return "(0/0)"
+	case f == math.Trunc(f) && math.Abs(f) < 1e15:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var keywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "goto": true, "if": true, "in": true,
+	"local": true, "nil": true, "not": true, "or": true, "repeat": true, "return": true,
+	"then": true, "true": true, "until": true, "while": true,
+}
+
+func isName(s string) bool {
+	if s == "" || keywords[s] {
+		return false
+	}
+	for i, c := range s {
+		if c != '_' && !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Quote returns s as a double-quoted Lua string literal.
+func Quote(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			if c < ' ' || c == 0x7f {
+				fmt.Fprintf(&b, `\%03d`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"reflect"
+	"runtime"
 	"strings"
 )
 
@@ -46,6 +48,36 @@ func countLevels(l *State) int {
 // nil it is appended at the beginning of the traceback. The level parameter
 // tells at which level to start the traceback.
 func Traceback(l, l1 *State, message string, level int) {
+	l.PushString(traceback(l, l1, message, level))
+}
+
+// SetTracebackGoFrames sets whether the tracebacks of l, and of the threads
+// sharing its global state, describe Go functions by their Go name and the
+// file and line where they are defined, rather than as [Go].
+func SetTracebackGoFrames(l *State, enabled bool) { l.global.goTracebacks = enabled }
+
+// SetErrorTracebacks sets whether the messages of the runtime errors raised
+// in l, and in the threads sharing its global state, end with the traceback
+// of the stack at the point the error was raised. These are the errors
+// returned by ProtectedCall, DoString and DoFile.
+func SetErrorTracebacks(l *State, enabled bool) { l.global.errorTracebacks = enabled }
+
+// goFunction returns the Go function running in the activation record f, if
+// any.
+func (l *State) goFunction(f Frame) *runtime.Func {
+	var fn interface{}
+	switch c := l.stack[f.function].(type) {
+	case *goFunction:
+		fn = c.Function
+	case *goClosure:
+		fn = c.function
+	default:
+		return nil
+	}
+	return runtime.FuncForPC(reflect.ValueOf(fn).Pointer())
+}
+
+func traceback(l, l1 *State, message string, level int) string {
 	const levels1, levels2 = 12, 10
 	levels := countLevels(l1)
 	mark := 0
@@ -63,17 +95,26 @@ func Traceback(l, l1 *State, message string, level int) {
 			level = levels - levels2
 		} else {
 			d, _ := Info(l1, "Slnt", f)
-			buf += "\n\t" + d.ShortSource + ":"
-			if d.CurrentLine > 0 {
-				buf += fmt.Sprintf("%d:", d.CurrentLine)
+			source, line, name := d.ShortSource, d.CurrentLine, functionName(l, d)
+			if rf := l1.goFunction(f); rf != nil && l.global.goTracebacks {
+				source, line = rf.FileLine(rf.Entry())
+				if name == "?" {
+					name = "function <" + rf.Name() + ">"
+				} else {
+					name += " <" + rf.Name() + ">"
+				}
+			}
+			buf += "\n\t" + source + ":"
+			if line > 0 {
+				buf += fmt.Sprintf("%d:", line)
 			}
-			buf += " in " + functionName(l, d)
+			buf += " in " + name
 			if d.IsTailCall {
 				buf += "\n\t(...tail calls...)"
 			}
 		}
 	}
-	l.PushString(buf)
+	return buf
 }
 
 // MetaField pushes onto the stack the field event from the metatable of the
@@ -512,9 +553,7 @@ func LoadFile(l *State, fileName, mode string) error {
 	if f != os.Stdin {
 		_ = f.Close()
 	}
-	switch err {
-	case nil, SyntaxError, MemoryError: // do nothing
-	default:
+	if _, ok := err.(*CompileError); err != nil && !ok && err != MemoryError {
 		l.SetTop(fileNameIndex)
 		return fileError("read")
 	}
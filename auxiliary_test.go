@@ -1,11 +1,14 @@
 package lua
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestLoadFileSyntaxError(t *testing.T) {
 	l := NewState()
 	err := LoadFile(l, "fixtures/syntax_error.lua", "")
-	if err != SyntaxError {
+	if !errors.Is(err, SyntaxError) {
 		t.Error("didn't return SyntaxError on file with syntax error")
 	}
 	if l.Top() != 1 {
@@ -23,7 +26,7 @@ func TestLoadFileSyntaxError(t *testing.T) {
 func TestLoadStringSyntaxError(t *testing.T) {
 	l := NewState()
 	err := LoadString(l, "this_is_a_syntax_error")
-	if err != SyntaxError {
+	if !errors.Is(err, SyntaxError) {
 		t.Error("didn't return SyntaxError on string with syntax error")
 	}
 	if l.Top() != 1 {
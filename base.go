@@ -200,7 +200,7 @@ var baseLibrary = []RegistryFunction{
 		CheckAny(l, 1)
 		l.PushNil()
 		l.Insert(1) // create space for status result
-		return finishProtectedCall(l, nil == l.ProtectedCallWithContinuation(l.Top()-2, MultipleReturns, 0, 0, protectedCallContinuation))
+		return finishProtectedCall(l, nil == l.protectedCallWithContinuation(l.Top()-2, MultipleReturns, 0, 0, protectedCallContinuation, true))
 	}},
 	{"print", func(l *State) int {
 		n := l.Top()
@@ -314,7 +314,7 @@ var baseLibrary = []RegistryFunction{
 		l.PushValue(1) // exchange function and error handler
 		l.Copy(2, 1)
 		l.Replace(2)
-		return finishProtectedCall(l, nil == l.ProtectedCallWithContinuation(n-2, MultipleReturns, 1, 0, protectedCallContinuation))
+		return finishProtectedCall(l, nil == l.protectedCallWithContinuation(n-2, MultipleReturns, 1, 0, protectedCallContinuation, true))
 	}},
 }
 
@@ -0,0 +1,203 @@
+package lua
+
+// An Action tells a breakpoint or step handler how execution should go on.
+type Action int
+
+// The actions a handler can return.
+const (
+	Continue Action = iota // run until the next breakpoint
+	StepIn                 // stop at the next line run, in any function
+	StepOver               // stop at the next line run in the same function or a caller
+	StepOut                // stop at the next line run in a caller
+)
+
+type breakpointHandler func(*State, Frame) Action
+
+// A debugger holds the breakpoints and stepping state of a State.
+type debugger struct {
+	breakpoints map[string]map[int]breakpointHandler // by chunk name, then line
+	generation  int                                  // incremented when breakpoints change
+	step        Action
+	stepDepth   int
+	stepHandler breakpointHandler
+	removeHook  func() // removes the debugger's hook, if added
+}
+
+// A lineMap holds the lines of a prototype where code starts, and the
+// breakpoints a debugger set on them. It is kept in the prototype, so that it
+// goes away with it.
+type lineMap struct {
+	valid       map[int]bool
+	debugger    *debugger
+	generation  int
+	breakpoints map[int]breakpointHandler
+}
+
+func (l *State) debuggerState() *debugger {
+	if l.debugger == nil {
+		l.debugger = &debugger{breakpoints: make(map[string]map[int]breakpointHandler)}
+	}
+	return l.debugger
+}
+
+// SetBreakpoint arranges for f to be called when execution reaches line of
+// chunk, before the line runs. chunk is the name given to Load, such as the
+// "@"-prefixed file name used by LoadFile; the prefix can be left out.
+// Breakpoints apply to the lines where code starts, as listed by Info's 'L'
+// option, and to the functions of chunk loaded before or after the call.
+//
+// f is called with the frame of the function at the breakpoint, and can
+// inspect it with Local, LocalByName, UpValueByName and Info, or call Lua
+// code. Its Action decides how execution goes on; step actions call f again
+// at the line they stop at.
+//
+// Breakpoints and stepping are implemented with a line hook added with
+// AddDebugHook, so they run along with the hook set by SetDebugHook and the
+// other hooks of l.
+func (l *State) SetBreakpoint(chunk string, line int, f func(*State, Frame) Action) {
+	d := l.debuggerState()
+	if d.breakpoints[chunk] == nil {
+		d.breakpoints[chunk] = make(map[int]breakpointHandler)
+	}
+	d.breakpoints[chunk][line] = f
+	d.generation++
+	l.installDebugger()
+}
+
+// ClearBreakpoint removes the breakpoint set on line of chunk, if any.
+func (l *State) ClearBreakpoint(chunk string, line int) {
+	if d := l.debugger; d != nil {
+		delete(d.breakpoints[chunk], line)
+		if len(d.breakpoints[chunk]) == 0 {
+			delete(d.breakpoints, chunk)
+		}
+		d.generation++
+		l.installDebugger()
+	}
+}
+
+// ClearBreakpoints removes all breakpoints.
+func (l *State) ClearBreakpoints() {
+	if d := l.debugger; d != nil {
+		d.breakpoints = make(map[string]map[int]breakpointHandler)
+		d.generation++
+		l.installDebugger()
+	}
+}
+
+// Step arranges for f to be called at the next line of Lua code run, as if a
+// handler had returned StepIn.
+func (l *State) Step(f func(*State, Frame) Action) {
+	d := l.debuggerState()
+	d.step, d.stepDepth, d.stepHandler = StepIn, 0, f
+	l.installDebugger()
+}
+
+// installDebugger adds the debugger's hook when there are breakpoints or a
+// step in progress, and removes it otherwise.
+func (l *State) installDebugger() {
+	d := l.debugger
+	if active := len(d.breakpoints) > 0 || d.step != Continue; active && d.removeHook == nil {
+		d.removeHook = AddDebugHook(l, debuggerHook, MaskLine, 0)
+	} else if !active && d.removeHook != nil {
+		d.removeHook()
+		d.removeHook = nil
+	}
+}
+
+// depth returns the number of active calls.
+func (l *State) depth() (n int) {
+	for ci := l.callInfo; ci != &l.baseCallInfo; ci = ci.previous {
+		n++
+	}
+	return
+}
+
+// lineMap returns the line map of p, with the breakpoints currently set in
+// it.
+func (d *debugger) lineMap(p *prototype) *lineMap {
+	m := p.lineMap
+	if m == nil {
+		m = &lineMap{valid: make(map[int]bool)}
+		for _, line := range p.lineInfo {
+			m.valid[int(line)] = true
+		}
+		p.lineMap = m
+	}
+	if m.debugger != d || m.generation != d.generation {
+		m.debugger, m.generation, m.breakpoints = d, d.generation, nil
+		names := []string{p.source}
+		if p.source != "" && (p.source[0] == '@' || p.source[0] == '=') {
+			names = append(names, p.source[1:])
+		}
+		for _, name := range names {
+			for line, f := range d.breakpoints[name] {
+				if m.valid[line] {
+					if m.breakpoints == nil {
+						m.breakpoints = make(map[int]breakpointHandler)
+					}
+					m.breakpoints[line] = f
+				}
+			}
+		}
+	}
+	return m
+}
+
+func debuggerHook(l *State, ar Debug) {
+	d, ci := l.debugger, l.callInfo
+	f := d.lineMap(l.prototype(ci)).breakpoints[ar.CurrentLine]
+	if f == nil {
+		switch d.step {
+		case Continue:
+			return
+		case StepOver:
+			if l.depth() > d.stepDepth {
+				return
+			}
+		case StepOut:
+			if l.depth() >= d.stepDepth {
+				return
+			}
+		}
+		f = d.stepHandler
+	}
+	d.step, d.stepHandler = f(l, ci), nil
+	if d.step != Continue {
+		d.stepDepth, d.stepHandler = l.depth(), f
+	}
+	l.installDebugger()
+}
+
+// LocalByName pushes the value of the innermost active local variable called
+// name in the activation record f, and reports whether there is one.
+func LocalByName(l *State, f Frame, name string) bool {
+	found := 0
+	for n := 1; ; n++ {
+		local, _, ok := l.findLocal(f, n)
+		if !ok {
+			break
+		} else if local == name {
+			found = n
+		}
+	}
+	if found == 0 {
+		return false
+	}
+	Local(l, f, found)
+	return true
+}
+
+// UpValueByName pushes the value of the upvalue called name of the function
+// running in the activation record f, and reports whether there is one.
+func UpValueByName(l *State, f Frame, name string) bool {
+	if c, ok := l.stack[f.function].(*luaClosure); ok {
+		for i, uv := range c.prototype.upValues {
+			if uv.name == name {
+				l.apiPush(c.upValue(i))
+				return true
+			}
+		}
+	}
+	return false
+}
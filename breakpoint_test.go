@@ -0,0 +1,121 @@
+package lua
+
+import (
+	"reflect"
+	"testing"
+)
+
+const breakpointProgram = `local function add(a, b)
+  local sum = a + b
+  return sum
+end
+
+local total = 0
+for i = 1, 3 do
+  total = add(total, i)
+end
+return total
+`
+
+func loadBreakpointProgram(t *testing.T, l *State) {
+	if err := LoadBuffer(l, breakpointProgram, "@program.lua", "t"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBreakpoint(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	var sums []int
+	l.SetBreakpoint("program.lua", 3, func(l *State, f Frame) Action {
+		if !LocalByName(l, f, "sum") {
+			t.Fatal("no local sum")
+		}
+		sums = append(sums, CheckInteger(l, -1))
+		l.Pop(1)
+		if LocalByName(l, f, "total") {
+			t.Error("total is a local of add")
+		}
+		return Continue
+	})
+	l.SetBreakpoint("program.lua", 5, func(*State, Frame) Action {
+		t.Error("stopped at a line without code")
+		return Continue
+	})
+	loadBreakpointProgram(t, l)
+	l.Call(0, 1)
+	if !reflect.DeepEqual(sums, []int{1, 3, 6}) || CheckInteger(l, -1) != 6 {
+		t.Errorf("sums %v, expected [1 3 6]", sums)
+	}
+	l.ClearBreakpoints()
+	if len(l.hooks) != 0 {
+		t.Error("hook left after clearing breakpoints")
+	}
+}
+
+func TestBreakpointWithHooks(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	var lines, calls, stops int
+	SetDebugHook(l, func(*State, Debug) { lines++ }, MaskLine, 0)
+	remove := AddDebugHook(l, func(*State, Debug) { calls++ }, MaskCall, 0)
+	l.SetBreakpoint("program.lua", 3, func(*State, Frame) Action {
+		stops++
+		return Continue
+	})
+	loadBreakpointProgram(t, l)
+	l.Call(0, 1)
+	if stops != 3 || lines == 0 || calls == 0 {
+		t.Errorf("%d stops, %d lines and %d calls seen with breakpoints set", stops, lines, calls)
+	}
+	l.ClearBreakpoints()
+	if DebugHook(l) == nil || len(l.hooks) != 2 {
+		t.Error("clearing breakpoints removed other hooks")
+	}
+	remove()
+	SetDebugHook(l, nil, 0, 0)
+	if len(l.hooks) != 0 {
+		t.Error("hooks left after removing them")
+	}
+}
+
+func TestStepping(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	var lines []int
+	actions := []Action{StepOver, StepOver, StepIn, StepOver, StepOut, StepOver, Continue}
+	l.SetBreakpoint("@program.lua", 6, func(l *State, f Frame) Action {
+		d, _ := Info(l, "l", f)
+		lines = append(lines, d.CurrentLine)
+		a := actions[0]
+		actions = actions[1:]
+		return a
+	})
+	loadBreakpointProgram(t, l)
+	l.Call(0, 0)
+	if expected := []int{6, 7, 8, 2, 3, 7, 8}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("stopped at %v, expected %v", lines, expected)
+	}
+}
+
+func TestUpValueByName(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	var seen int
+	l.Step(func(l *State, f Frame) Action {
+		if d, _ := Info(l, "S", f); d.What == "main" {
+			return StepIn
+		}
+		if !UpValueByName(l, f, "counter") {
+			t.Fatal("no upvalue counter")
+		}
+		seen = CheckInteger(l, -1)
+		return Continue
+	})
+	if err := DoString(l, "local counter = 41\nlocal function f()\n  return counter + 1\nend\nreturn f()"); err != nil {
+		t.Fatal(err)
+	}
+	if seen != 41 {
+		t.Errorf("counter is %d, expected 41", seen)
+	}
+}
@@ -0,0 +1,73 @@
+package lua
+
+import (
+	"crypto/sha256"
+	"strings"
+	"sync"
+)
+
+type chunkKey struct {
+	name              string
+	sum               [sha256.Size]byte
+	optimizationLevel int
+}
+
+// A ChunkCache holds compiled chunks, so that States loading the same chunk
+// share its code instead of compiling it again. Chunks are cached by name and
+// by a hash of their contents, so a changed chunk is compiled anew. A
+// ChunkCache may be used by any number of States, from any goroutine.
+//
+//	var chunks = lua.NewChunkCache()
+//
+//	func run(l *lua.State, script string) error {
+//	  if err := chunks.Load(l, script, "=script", ""); err != nil {
+//	    return err
+//	  }
+//	  return l.ProtectedCall(0, 0, 0)
+//	}
+type ChunkCache struct {
+	mu     sync.Mutex
+	chunks map[chunkKey]*prototype
+}
+
+// NewChunkCache returns an empty ChunkCache.
+func NewChunkCache() *ChunkCache {
+	return &ChunkCache{chunks: make(map[chunkKey]*prototype)}
+}
+
+// Load loads the chunk b as LoadBuffer does, compiling it only if it isn't
+// cached yet for the optimization level of l.
+func (c *ChunkCache) Load(l *State, b, name, mode string) error {
+	if name == "" {
+		name = "?"
+	}
+	kind := "text"
+	if strings.HasPrefix(b, Signature[:1]) {
+		kind = "binary"
+	}
+	if mode != "" && !strings.Contains(mode, kind[:1]) {
+		return LoadBuffer(l, b, name, mode) // let Load report the error
+	}
+	key := chunkKey{name: name, sum: sha256.Sum256([]byte(b)), optimizationLevel: l.global.optimizationLevel}
+	c.mu.Lock()
+	p := c.chunks[key]
+	c.mu.Unlock()
+	if p == nil {
+		if err := LoadBuffer(l, b, name, mode); err != nil {
+			return err
+		}
+		c.mu.Lock()
+		c.chunks[key] = l.stack[l.top-1].(*luaClosure).prototype.instance()
+		c.mu.Unlock()
+		return nil
+	}
+	f := l.newLuaClosure(p.instance())
+	for i := range f.upValues {
+		f.upValues[i] = l.newUpValue()
+	}
+	if f.upValueCount() == 1 {
+		f.setUpValue(0, l.global.registry.atInt(RegistryIndexGlobals))
+	}
+	l.apiPush(f)
+	return nil
+}
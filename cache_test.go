@@ -0,0 +1,58 @@
+package lua
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestChunkCache(t *testing.T) {
+	const chunk = `
+    local t = {}
+    for i = 1, 10 do t[i] = function() return i * n end end
+    return t[3]() + t[10]()
+  `
+	c := NewChunkCache()
+	if err := c.Load(newTestState(), chunk, "=chunk", ""); err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	shared := make(map[*instruction]bool)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			l := newTestState()
+			l.PushInteger(n)
+			l.SetGlobal("n")
+			if err := c.Load(l, chunk, "=chunk", "t"); err != nil {
+				t.Error(err)
+				return
+			}
+			mu.Lock()
+			shared[&l.stack[l.top-1].(*luaClosure).prototype.prototypes[0].code[0]] = true
+			mu.Unlock()
+			if err := l.ProtectedCall(0, 1, 0); err != nil {
+				t.Error(err)
+			} else if r, _ := l.ToInteger(-1); r != 13*n {
+				t.Errorf("%d, expected %d", r, 13*n)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if len(c.chunks) != 1 || len(shared) != 1 {
+		t.Errorf("%d chunks cached, %d copies of the code", len(c.chunks), len(shared))
+	}
+
+	l := newTestState()
+	if err := c.Load(l, "return 1", "=chunk", ""); err != nil {
+		t.Fatal(err)
+	} else if len(c.chunks) != 2 {
+		t.Errorf("%d chunks cached after a change", len(c.chunks))
+	}
+	var se *CompileError
+	if err := c.Load(l, chunk, "=chunk", "b"); !errors.As(err, &se) {
+		t.Errorf("unexpected error %v", err)
+	}
+}
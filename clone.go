@@ -0,0 +1,157 @@
+package lua
+
+// A copier deep-copies values into the State l, preserving the sharing and
+// cycles between them.
+type copier struct {
+	l          *State
+	from       *State            // raises errors for threads, which can't be copied
+	check      *State            // raises errors for values lanes can't transfer, if not nil
+	names      map[*table]string // tables to register by name in l when copied
+	values     map[value]value
+	upValues   map[*upValue]*upValue
+	prototypes map[*prototype]*prototype
+}
+
+func newCopier(l *State) *copier {
+	return &copier{l: l, values: make(map[value]value), upValues: make(map[*upValue]*upValue), prototypes: make(map[*prototype]*prototype)}
+}
+
+func (c *copier) copy(v value) value {
+	switch v := v.(type) {
+	case *table:
+		if t, ok := c.values[v]; ok {
+			return t
+		}
+		t := newTableWithSize(len(v.array), len(v.hash))
+		c.values[v] = t
+		if name, ok := c.names[v]; ok {
+			c.l.global.registry.hash[name] = t
+		}
+		if v.weak != nil {
+			v.forEach(func(k, e value) { t.put(nil, c.copy(k), c.copy(e)) })
+		}
+		for i, e := range v.array {
+			t.array[i] = c.copy(e)
+		}
+		for k, e := range v.hash {
+			t.hash[c.copy(k)] = c.copy(e)
+		}
+		t.setMetaTable(c.l, c.table(v.metaTable))
+		return t
+	case *luaClosure:
+		if f, ok := c.values[v]; ok {
+			return f
+		}
+		f := &luaClosure{prototype: c.prototype(v.prototype), upValues: make([]*upValue, len(v.upValues))}
+		c.values[v] = f
+		for i, uv := range v.upValues {
+			f.upValues[i] = c.upValue(uv)
+		}
+		return f
+	case *goClosure:
+		if f, ok := c.values[v]; ok {
+			return f
+		}
+		f := &goClosure{function: v.function, upValues: make([]value, len(v.upValues))}
+		c.values[v] = f
+		for i, uv := range v.upValues {
+			f.upValues[i] = c.copy(uv)
+		}
+		return f
+	case *userData:
+		if u, ok := c.values[v]; ok {
+			return u
+		}
+		u := &userData{data: v.data}
+		if c.check != nil {
+			t, ok := v.data.(Transferable)
+			if !ok {
+				Errorf(c.check, "cannot transfer a userdata")
+			}
+			u.data = t.Transfer()
+		}
+		c.values[v] = u
+		u.metaTable, u.env = c.table(v.metaTable), c.table(v.env)
+		return u
+	case *State:
+		if t, ok := c.values[v]; ok {
+			return t
+		} else if c.check != nil {
+			Errorf(c.check, "cannot transfer a thread")
+		}
+		Errorf(c.from, "cannot clone a thread")
+	}
+	return v // nil, booleans, numbers, strings and Go functions are immutable
+}
+
+func (c *copier) table(t *table) *table {
+	if t == nil {
+		return nil
+	}
+	return c.copy(t).(*table)
+}
+
+func (c *copier) upValue(uv *upValue) *upValue {
+	if u, ok := c.upValues[uv]; ok {
+		return u
+	}
+	u := &upValue{}
+	c.upValues[uv] = u
+	u.home = c.copy(uv.value())
+	return u
+}
+
+// prototype returns an instance of p for the copy, sharing the instance of
+// its nested prototypes with those of the closures it creates.
+func (c *copier) prototype(p *prototype) *prototype {
+	if q, ok := c.prototypes[p]; ok {
+		return q
+	}
+	q := p.instance()
+	var walk func(p, q *prototype)
+	walk = func(p, q *prototype) {
+		c.prototypes[p] = q
+		for i := range p.prototypes {
+			walk(&p.prototypes[i], &q.prototypes[i])
+		}
+	}
+	walk(p, q)
+	return q
+}
+
+// Clone returns a new State holding a deep copy of the registry, globals,
+// loaded modules and basic type metatables of l, which must not be running.
+// The tables, closures and userdata reachable from them are copied, keeping
+// any sharing and cycles between them, while the compiled code of Lua
+// functions, Go functions and the Go values of userdata are shared. Open
+// upvalues are copied closed with their current value.
+//
+// The copy has the engine, optimization level and error options of l, but no
+// hooks. It is independent of l: the two may run on different goroutines.
+// The main thread of l, which the registry holds, is copied as the main thread
+// of the copy. Other threads can't be copied: Clone raises an error in l if a
+// coroutine is reachable.
+//
+// Clone is a cheap way to start many States from a template that opened the
+// libraries and ran initialization scripts once.
+func (l *State) Clone() *State {
+	n := l.newStateLike()
+	c := newCopier(n)
+	c.from, c.values[l.global.mainThread] = l, n
+	n.global.registry = c.table(l.global.registry)
+	for t, m := range l.global.metaTables {
+		n.global.metaTables[t] = c.table(m)
+	}
+	return n
+}
+
+// newStateLike returns a new State with the options of l.
+func (l *State) newStateLike() *State {
+	n := NewState()
+	g, h := l.global, n.global
+	h.panicFunction, h.memoryErrorMessage = g.panicFunction, g.memoryErrorMessage
+	h.engine, h.optimizationLevel, h.allocationHook = g.engine, g.optimizationLevel, g.allocationHook
+	h.propagatePanics, h.goTracebacks, h.errorTracebacks = g.propagatePanics, g.goTracebacks, g.errorTracebacks
+	h.laneSetup = g.laneSetup
+	return n
+}
@@ -0,0 +1,81 @@
+package lua
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestClone(t *testing.T) {
+	template := newTestState()
+	OpenLibraries(template)
+	template.PushGoFunction(func(l *State) int {
+		l.PushString("from go")
+		return 1
+	})
+	template.SetGlobal("greet")
+	if err := DoString(template, `
+    package.preload.counter = function()
+      local n = 0
+      return {increment = function() n = n + 1; return n end, get = function() return n end}
+    end
+    counter = require("counter")
+    config = {name = "template"}
+    config.self = config
+    getmetatable("").__index.shout = function(s) return s:upper() .. "!" end
+  `); err != nil {
+		t.Fatal(err)
+	}
+	counter := func(l *State) *luaClosure {
+		l.Global("counter")
+		l.Field(-1, "increment")
+		defer l.Pop(2)
+		return l.ToValue(-1).(*luaClosure)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		l := template.Clone()
+		if l.ToValue(RegistryIndex) == template.ToValue(RegistryIndex) {
+			t.Fatal("the registry is shared")
+		} else if f, g := counter(l), counter(template); f == g || &f.prototype.code[0] != &g.prototype.code[0] {
+			t.Error("closures are shared, or their code is copied")
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := DoString(l, `
+        counter.increment()
+        assert(require("counter") == counter and counter.increment() == 2 and counter.get() == 2)
+        assert(config.self == config and config.name == "template")
+        config.name = "clone"
+        assert(("hi"):shout() == "HI!" and greet() == "from go")
+      `); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if err := DoString(template, `assert(counter.get() == 0 and config.name == "template")`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCloneThreads(t *testing.T) {
+	template := newTestState()
+	template.PushThread()
+	template.SetGlobal("main")
+	l := template.Clone()
+	l.Global("main")
+	if l.ToThread(-1) != l {
+		t.Error("the main thread isn't copied as the main thread of the copy")
+	}
+	template.NewThread()
+	template.SetGlobal("co")
+	template.PushGoFunction(func(l *State) int {
+		l.Clone()
+		return 0
+	})
+	if err := template.ProtectedCall(0, 0, 0); err == nil || err.Error() != "runtime error: cannot clone a thread" {
+		t.Errorf("expected an error cloning a coroutine, got %v", err)
+	}
+}
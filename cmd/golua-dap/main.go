@@ -0,0 +1,65 @@
+// Command golua-dap is a debug adapter for Lua scripts run by go-lua. It
+// speaks the Debug Adapter Protocol over the standard input and output, or
+// over TCP with -listen, and runs the program named by the client's launch
+// request in a State with the standard libraries opened.
+//
+// Usage:
+//
+//	golua-dap [-listen address]
+//
+// The output of print is sent to the client's debug console. Hosts that run
+// scripts in their own States can embed package dap instead.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Shopify/go-lua"
+	"github.com/Shopify/go-lua/dap"
+)
+
+var listen = flag.String("listen", "", "serve clients on the TCP `address` instead of stdio")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: golua-dap [-listen address]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	d := dap.Attach(l)
+	d.Run = func(program string, args []string) error {
+		l.CreateTable(len(args), 1)
+		l.PushString(program)
+		l.RawSetInt(-2, 0)
+		for i, arg := range args {
+			l.PushString(arg)
+			l.RawSetInt(-2, i+1)
+		}
+		l.SetGlobal("arg")
+		return lua.DoFile(l, program)
+	}
+	l.Register("print", func(l *lua.State) int {
+		s := make([]string, l.Top())
+		for i := range s {
+			s[i], _ = lua.ToStringMeta(l, i+1)
+			l.Pop(1)
+		}
+		d.Output("stdout", strings.Join(s, "\t")+"\n")
+		return 0
+	})
+	var err error
+	if *listen != "" {
+		err = d.ListenAndServe(*listen)
+	} else {
+		err = d.Serve(os.Stdin, os.Stdout)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
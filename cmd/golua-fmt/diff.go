@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const context = 3 // lines of context around changes
+
+type edit struct {
+	op   byte // ' ', '-' or '+'
+	line []byte
+}
+
+// lines splits b after each newline.
+func lines(b []byte) [][]byte {
+	var ls [][]byte
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, '\n') + 1
+		if i == 0 {
+			i = len(b)
+		}
+		ls, b = append(ls, b[:i]), b[i:]
+	}
+	return ls
+}
+
+// edits returns the shortest sequence of edits turning a into b, found from
+// the longest common subsequence of their lines.
+func edits(a, b [][]byte) []edit {
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if bytes.Equal(a[i], b[j]) {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+	var es []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && bytes.Equal(a[i], b[j]):
+			es = append(es, edit{' ', a[i]})
+			i, j = i+1, j+1
+		case j == len(b) || i < len(a) && common[i+1][j] >= common[i][j+1]:
+			es = append(es, edit{'-', a[i]})
+			i++
+		default:
+			es = append(es, edit{'+', b[j]})
+			j++
+		}
+	}
+	return es
+}
+
+// unifiedDiff returns the differences between the original source a and the
+// formatted source b of the file name, in the unified format of diff -u.
+func unifiedDiff(name string, a, b []byte) []byte {
+	es := edits(lines(a), lines(b))
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "--- %s.orig\n+++ %s\n", name, name)
+	aLine, bLine := 1, 1 // of es[at]
+	for at := 0; at < len(es); {
+		if es[at].op == ' ' {
+			aLine, bLine, at = aLine+1, bLine+1, at+1
+			continue
+		}
+		// Extend the hunk backward and forward by the context lines, and
+		// over unchanged runs short enough to join two changes.
+		start := at - context
+		if start < 0 {
+			start = 0
+		}
+		aStart, bStart := aLine-(at-start), bLine-(at-start)
+		end := at
+		for unchanged := 0; end < len(es) && unchanged <= 2*context; end++ {
+			if es[end].op == ' ' {
+				unchanged++
+			} else {
+				unchanged = 0
+			}
+		}
+		for end > at && es[end-1].op == ' ' && trailing(es[at:end]) > context {
+			end--
+		}
+		var aCount, bCount int
+		for _, e := range es[start:end] {
+			if e.op != '+' {
+				aCount++
+			}
+			if e.op != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(aStart, aCount), hunkRange(bStart, bCount))
+		for _, e := range es[start:end] {
+			out.WriteByte(e.op)
+			out.Write(e.line)
+			if !bytes.HasSuffix(e.line, []byte("\n")) {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		for _, e := range es[at:end] {
+			if e.op != '+' {
+				aLine++
+			}
+			if e.op != '-' {
+				bLine++
+			}
+		}
+		at = end
+	}
+	return out.Bytes()
+}
+
+// trailing returns the number of unchanged lines at the end of es.
+func trailing(es []edit) (n int) {
+	for i := len(es) - 1; i >= 0 && es[i].op == ' '; i-- {
+		n++
+	}
+	return
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start-- // an empty range is given by the line before it
+	}
+	if count == 1 {
+		return fmt.Sprint(start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
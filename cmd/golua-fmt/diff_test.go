@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "local x=1\nprint( x )\na = 1\nb = 2\nc = 3\nd = 4\ne = 5\nf = 6\ng = 7\nh = 8\ni = {1,\n2}"
+	b := "local x = 1\nprint(x)\na = 1\nb = 2\nc = 3\nd = 4\ne = 5\nf = 6\ng = 7\nh = 8\ni = {\n\t1,\n\t2,\n}\n"
+	expected := `--- t.lua.orig
++++ t.lua
+@@ -1,5 +1,5 @@
+-local x=1
+-print( x )
++local x = 1
++print(x)
+ a = 1
+ b = 2
+ c = 3
+@@ -8,5 +8,7 @@
+ f = 6
+ g = 7
+ h = 8
+-i = {1,
+-2}
+\ No newline at end of file
++i = {
++	1,
++	2,
++}
+`
+	if got := string(unifiedDiff("t.lua", []byte(a), []byte(b))); got != expected {
+		t.Errorf("got\n%s\nexpected\n%s", got, expected)
+	}
+	if got := string(unifiedDiff("t.lua", nil, []byte("x = 1\n"))); got != "--- t.lua.orig\n+++ t.lua\n@@ -0,0 +1 @@\n+x = 1\n" {
+		t.Errorf("got\n%s", got)
+	}
+}
@@ -0,0 +1,90 @@
+// Command golua-fmt formats Lua scripts in the canonical style of package
+// format.
+//
+// Usage:
+//
+//	golua-fmt [-d] [-l] [-w] [file ...]
+//
+// With no files, golua-fmt formats the standard input. By default the
+// formatted source is printed to the standard output.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Shopify/go-lua/format"
+)
+
+var (
+	list  = flag.Bool("l", false, "list files whose formatting differs from golua-fmt's")
+	write = flag.Bool("w", false, "write the result to the source file instead of the standard output")
+	diff  = flag.Bool("d", false, "display diffs instead of rewriting files")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: golua-fmt [-d] [-l] [-w] [file ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	status := 0
+	if flag.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "golua-fmt: cannot use -w with standard input")
+			os.Exit(2)
+		}
+		src, err := io.ReadAll(os.Stdin)
+		if err == nil {
+			err = process("<standard input>", src)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 2
+		}
+	}
+	for _, name := range flag.Args() {
+		src, err := os.ReadFile(name)
+		if err == nil {
+			err = process(name, src)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 2
+		}
+	}
+	os.Exit(status)
+}
+
+func process(name string, src []byte) error {
+	res, err := format.Format(src)
+	if err != nil {
+		return fmt.Errorf("%s:%v", name, err)
+	}
+	if !*list && !*write && !*diff {
+		_, err = os.Stdout.Write(res)
+		return err
+	} else if bytes.Equal(src, res) {
+		return nil
+	}
+	if *list {
+		fmt.Println(name)
+	}
+	if *write {
+		info, err := os.Stat(name)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(name, res, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	if *diff {
+		fmt.Printf("diff -u %s.orig %s\n", name, name)
+		os.Stdout.Write(unifiedDiff(name, src, res))
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// Command golua-lint reports likely mistakes in Lua scripts run by go-lua.
+//
+// Usage:
+//
+//	golua-lint [-globals name,...] [file ...]
+//
+// With no files, golua-lint reads the standard input. Each issue is printed as
+// file:line:column: message (check). The exit status is 1 if any issue or
+// error was reported. See package lint for the checks.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Shopify/go-lua/lint"
+)
+
+var globals = flag.String("globals", "", "comma-separated `names` of globals provided by the host")
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: golua-lint [-globals name,...] [file ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	var c lint.Config
+	if *globals != "" {
+		c.Globals = strings.Split(*globals, ",")
+	}
+	linter, failed := lint.New(c), false
+	check := func(name string, f *os.File) {
+		issues, err := linter.Lint(name, f)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+		}
+		for _, i := range issues {
+			fmt.Println(i)
+			failed = true
+		}
+	}
+	if flag.NArg() == 0 {
+		check("stdin", os.Stdin)
+	}
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			failed = true
+			continue
+		}
+		check(name, f)
+		f.Close()
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,48 @@
+// Command golua-lsp is a language server for Lua scripts run by go-lua. It
+// speaks the Language Server Protocol over the standard input and output.
+//
+// Usage:
+//
+//	golua-lsp [-globals name,...] [-libraries name.function,...]
+//
+// Hosts that register their own globals can name them with the flags, or
+// embed package lsp and describe them with lsp.Config.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Shopify/go-lua"
+	"github.com/Shopify/go-lua/lsp"
+)
+
+var (
+	globals   = flag.String("globals", "", "comma-separated `names` of global functions provided by the host")
+	libraries = flag.String("libraries", "", "comma-separated `table.function` names of library functions provided by the host")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: golua-lsp [-globals name,...] [-libraries name.function,...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	c := lsp.Config{Libraries: make(map[string][]lua.RegistryFunction)}
+	for _, name := range strings.Split(*globals, ",") {
+		if name != "" {
+			c.Functions = append(c.Functions, lua.RegistryFunction{Name: name})
+		}
+	}
+	for _, name := range strings.Split(*libraries, ",") {
+		if i := strings.Index(name, "."); i > 0 {
+			c.Libraries[name[:i]] = append(c.Libraries[name[:i]], lua.RegistryFunction{Name: name[i+1:]})
+		}
+	}
+	if err := lsp.NewServer(c).Serve(os.Stdin, os.Stdout); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,660 @@
+package lua
+
+import (
+	"fmt"
+	"math"
+)
+
+// A compiledOp executes one pre-decoded instruction of a prototype. Operands,
+// constants and jump targets are resolved when the prototype is compiled, so
+// the closure only does the work that depends on run-time values. It returns
+// true when the function that entered executeCompiled has returned.
+type compiledOp func(e *compiledEngine) bool
+
+type compiledEngine struct {
+	frame    []value
+	closure  *luaClosure
+	callInfo *callInfo
+	code     []compiledOp
+	l        *State
+	next     *compiledEngine // in the free list of l
+}
+
+func (e *compiledEngine) newFrame() {
+	ci := e.callInfo
+	e.frame = ci.frame
+	e.closure, _ = e.l.stack[ci.function].(*luaClosure)
+	e.code = e.closure.prototype.compiledCode()
+}
+
+func (e *compiledEngine) k(field int) value {
+	if isConstant(field) {
+		return e.closure.prototype.constants[constantIndex(field)]
+	}
+	return e.frame[field]
+}
+
+// jump transfers control to target, closing upvalues from register a-1 when
+// a > 0.
+func (e *compiledEngine) jump(a int, target pc) {
+	if a > 0 {
+		e.l.close(e.callInfo.stackIndex(a - 1))
+	}
+	e.callInfo.savedPC = target
+}
+
+// executeCompiled takes its engine from a free list, as ops are called
+// through a func value, which would move an engine on the stack to the heap
+// on every call from Go.
+func (l *State) executeCompiled() {
+	e := l.compiledEngines
+	if e == nil {
+		e = &compiledEngine{l: l}
+	} else {
+		l.compiledEngines = e.next
+	}
+	e.callInfo = l.callInfo
+	e.newFrame()
+	for {
+		ci := e.callInfo
+		if l.hookMask&(MaskLine|MaskCount|maskStats) != 0 {
+			if l.hookCount--; l.hookCount == 0 || l.hookMask&(MaskLine|maskStats) != 0 {
+				l.traceExecution()
+				e.frame = ci.frame
+			}
+		}
+		op := e.code[ci.savedPC]
+		ci.savedPC++
+		if op(e) {
+			e.frame, e.closure, e.callInfo, e.code = nil, nil, nil, nil
+			e.next, l.compiledEngines = l.compiledEngines, e
+			return
+		}
+	}
+}
+
+func (p *prototype) compiledCode() []compiledOp {
+	if p.compiled == nil {
+		code := make([]compiledOp, len(p.code))
+		for at := range p.code {
+			code[at] = p.compile(at)
+		}
+		p.compiled = code
+	}
+	return p.compiled
+}
+
+func (p *prototype) extraArg(at int) int {
+	if at+1 >= len(p.code) || p.code[at+1].opCode() != opExtraArg {
+		panic(fmt.Sprintf("expected opcode %s after '%s'", opNames[opExtraArg], p.code[at].String()))
+	}
+	return p.code[at+1].ax()
+}
+
+// compile specializes the instruction at index at. Tests and comparisons absorb the
+// jump that follows them, and the saved pc is kept exactly as the other
+// engines leave it so that hooks, errors and the debug API see no difference.
+func (p *prototype) compile(at int) compiledOp {
+	i := p.code[at]
+	switch a, b, c := i.a(), i.b(), i.c(); i.opCode() {
+	case opMove:
+		return func(e *compiledEngine) bool { e.frame[a] = e.frame[b]; return false }
+	case opLoadConstant:
+		k := p.constants[i.bx()]
+		return func(e *compiledEngine) bool { e.frame[a] = k; return false }
+	case opLoadConstantEx:
+		k := p.constants[p.extraArg(at)]
+		return func(e *compiledEngine) bool {
+			e.frame[a] = k
+			e.callInfo.skip()
+			return false
+		}
+	case opLoadBool:
+		v := b != 0
+		if c != 0 {
+			return func(e *compiledEngine) bool {
+				e.frame[a] = v
+				e.callInfo.skip()
+				return false
+			}
+		}
+		return func(e *compiledEngine) bool { e.frame[a] = v; return false }
+	case opLoadNil:
+		return func(e *compiledEngine) bool { clear(e.frame[a : a+b+1]); return false }
+	case opGetUpValue:
+		return func(e *compiledEngine) bool { e.frame[a] = e.closure.upValue(b); return false }
+	case opGetTableUp:
+		if isConstant(c) {
+			key, cache := p.constants[constantIndex(c)], p.inlineCache(pc(at))
+			return func(e *compiledEngine) bool {
+				tmp := e.l.cachedTableAt(e.closure.upValue(b), key, cache)
+				e.frame = e.callInfo.frame
+				e.frame[a] = tmp
+				return false
+			}
+		}
+		return func(e *compiledEngine) bool {
+			tmp := e.l.tableAt(e.closure.upValue(b), e.frame[c])
+			e.frame = e.callInfo.frame
+			e.frame[a] = tmp
+			return false
+		}
+	case opGetTable:
+		if isConstant(c) {
+			key, cache := p.constants[constantIndex(c)], p.inlineCache(pc(at))
+			return func(e *compiledEngine) bool {
+				tmp := e.l.cachedTableAt(e.frame[b], key, cache)
+				e.frame = e.callInfo.frame
+				e.frame[a] = tmp
+				return false
+			}
+		}
+		return func(e *compiledEngine) bool {
+			tmp := e.l.tableAt(e.frame[b], e.frame[c])
+			e.frame = e.callInfo.frame
+			e.frame[a] = tmp
+			return false
+		}
+	case opSetTableUp:
+		return func(e *compiledEngine) bool {
+			e.l.setTableAt(e.closure.upValue(a), e.k(b), e.k(c))
+			e.frame = e.callInfo.frame
+			return false
+		}
+	case opSetUpValue:
+		return func(e *compiledEngine) bool { e.closure.setUpValue(b, e.frame[a]); return false }
+	case opSetTable:
+		if isConstant(b) {
+			key := p.constants[constantIndex(b)]
+			if isConstant(c) {
+				v := p.constants[constantIndex(c)]
+				return func(e *compiledEngine) bool {
+					e.l.setTableAt(e.frame[a], key, v)
+					e.frame = e.callInfo.frame
+					return false
+				}
+			}
+			return func(e *compiledEngine) bool {
+				e.l.setTableAt(e.frame[a], key, e.frame[c])
+				e.frame = e.callInfo.frame
+				return false
+			}
+		}
+		return func(e *compiledEngine) bool {
+			e.l.setTableAt(e.frame[a], e.frame[b], e.k(c))
+			e.frame = e.callInfo.frame
+			return false
+		}
+	case opNewTable:
+		if b, c := float8(b), float8(c); b != 0 || c != 0 {
+			arraySize, hashSize := intFromFloat8(b), intFromFloat8(c)
+			return func(e *compiledEngine) bool {
+				e.frame[a] = newTableWithSize(arraySize, hashSize)
+				e.l.tableCreated(arraySize, hashSize)
+				clear(e.frame[a+1:])
+				return false
+			}
+		}
+		return func(e *compiledEngine) bool {
+			e.frame[a] = newTable()
+			e.l.tableCreated(0, 0)
+			clear(e.frame[a+1:])
+			return false
+		}
+	case opSelf:
+		if isConstant(c) {
+			key, cache := p.constants[constantIndex(c)], p.inlineCache(pc(at))
+			return func(e *compiledEngine) bool {
+				t := e.frame[b]
+				tmp := e.l.cachedTableAt(t, key, cache)
+				e.frame = e.callInfo.frame
+				e.frame[a+1], e.frame[a] = t, tmp
+				return false
+			}
+		}
+		return func(e *compiledEngine) bool {
+			t := e.frame[b]
+			tmp := e.l.tableAt(t, e.frame[c])
+			e.frame = e.callInfo.frame
+			e.frame[a+1], e.frame[a] = t, tmp
+			return false
+		}
+	case opAdd, opSub, opMul, opDiv, opMod, opPow:
+		return p.compileArith(i, a, b, c)
+	case opUnaryMinus:
+		return func(e *compiledEngine) bool {
+			if n, ok := e.frame[b].(float64); ok {
+				e.frame[a] = -n
+				return false
+			}
+			tmp := e.l.arith(e.frame[b], e.frame[b], tmUnaryMinus)
+			e.frame = e.callInfo.frame
+			e.frame[a] = tmp
+			return false
+		}
+	case opNot:
+		return func(e *compiledEngine) bool { e.frame[a] = isFalse(e.frame[b]); return false }
+	case opLength:
+		return func(e *compiledEngine) bool {
+			tmp := e.l.objectLength(e.frame[b])
+			e.frame = e.callInfo.frame
+			e.frame[a] = tmp
+			return false
+		}
+	case opConcat:
+		return func(e *compiledEngine) bool {
+			l, ci := e.l, e.callInfo
+			l.top = ci.stackIndex(c + 1) // mark the end of concat operands
+			l.concat(c - b + 1)
+			e.frame = ci.frame
+			e.frame[a] = e.frame[b]
+			if a >= b { // limit of live values
+				clear(e.frame[a+1:])
+			} else {
+				clear(e.frame[b:])
+			}
+			return false
+		}
+	case opJump:
+		target := pc(at + 1 + i.sbx())
+		if a > 0 {
+			return func(e *compiledEngine) bool { e.jump(a, target); return false }
+		}
+		return func(e *compiledEngine) bool { e.callInfo.savedPC = target; return false }
+	case opEqual, opLessThan, opLessOrEqual:
+		return p.compileComparison(at, i, a != 0, b, c)
+	case opTest:
+		test := c == 0
+		ja, target, next := p.jumpAfter(at)
+		return func(e *compiledEngine) bool {
+			if isFalse(e.frame[a]) == test {
+				e.jump(ja, target)
+			} else {
+				e.callInfo.savedPC = next
+			}
+			return false
+		}
+	case opTestSet:
+		test := c == 0
+		ja, target, next := p.jumpAfter(at)
+		return func(e *compiledEngine) bool {
+			if v := e.frame[b]; isFalse(v) == test {
+				e.frame[a] = v
+				e.jump(ja, target)
+			} else {
+				e.callInfo.savedPC = next
+			}
+			return false
+		}
+	case opCall:
+		n := c - 1
+		return func(e *compiledEngine) bool {
+			l, ci := e.l, e.callInfo
+			if b != 0 {
+				l.top = ci.stackIndex(a + b)
+			} // else previous instruction set top
+			if l.preCall(ci.stackIndex(a), n) { // go function
+				if n >= 0 {
+					l.top = ci.top // adjust results
+				}
+				e.frame = ci.frame
+			} else { // lua function
+				e.callInfo = l.callInfo
+				e.callInfo.setCallStatus(callStatusReentry)
+				e.newFrame()
+			}
+			return false
+		}
+	case opTailCall:
+		return func(e *compiledEngine) bool {
+			l, ci := e.l, e.callInfo
+			if b != 0 {
+				l.top = ci.stackIndex(a + b)
+			} // else previous instruction set top
+			if l.preCall(ci.stackIndex(a), MultipleReturns) { // go function
+				e.frame = ci.frame
+				return false
+			}
+			// tail call: put called frame (n) in place of caller one (o)
+			nci := l.callInfo                      // called frame
+			oci := nci.previous                    // caller frame
+			nfn, ofn := nci.function, oci.function // called & caller function
+			// last stack slot filled by 'precall'
+			lim := nci.base() + l.stack[nfn].(*luaClosure).prototype.parameterCount
+			if len(p.prototypes) > 0 { // close all upvalues from previous call
+				l.close(oci.base())
+			}
+			// move new frame into old one
+			for i := 0; nfn+i < lim; i++ {
+				l.stack[ofn+i] = l.stack[nfn+i]
+			}
+			base := ofn + (nci.base() - nfn) // correct base
+			oci.setTop(ofn + (l.top - nfn))  // correct top
+			oci.frame = l.stack[base:oci.top]
+			oci.savedPC, oci.code = nci.savedPC, nci.code // correct code (savedPC indexes nci->code)
+			oci.setCallStatus(callStatusTail)             // function was tail called
+			l.top, l.callInfo, e.callInfo = oci.top, oci, oci
+			e.newFrame()
+			return false
+		}
+	case opReturn:
+		closeUpValues := len(p.prototypes) > 0
+		return func(e *compiledEngine) bool {
+			l, ci := e.l, e.callInfo
+			if b != 0 {
+				l.top = ci.stackIndex(a + b - 1)
+			}
+			if closeUpValues {
+				l.close(ci.base())
+			}
+			n := l.postCall(ci.stackIndex(a))
+			if !ci.isCallStatus(callStatusReentry) { // ci still the called one?
+				return true // external invocation: return
+			}
+			e.callInfo = l.callInfo
+			if n {
+				l.top = e.callInfo.top
+			}
+			e.newFrame()
+			return false
+		}
+	case opForLoop:
+		target := pc(at + 1 + i.sbx())
+		return func(e *compiledEngine) bool {
+			frame := e.frame
+			index, limit, step := frame[a+0].(float64), frame[a+1].(float64), frame[a+2].(float64)
+			if index += step; (0 < step && index <= limit) || (step <= 0 && limit <= index) {
+				e.callInfo.savedPC = target
+				v := value(index) // OPT: Box the index once for both registers.
+				frame[a+0] = v    // update internal index...
+				frame[a+3] = v    // ... and external index
+			}
+			return false
+		}
+	case opForPrep:
+		target := pc(at + 1 + i.sbx())
+		return func(e *compiledEngine) bool {
+			l, frame := e.l, e.frame
+			if init, ok := l.toNumber(frame[a+0]); !ok {
+				l.runtimeError("'for' initial value must be a number")
+			} else if limit, ok := l.toNumber(frame[a+1]); !ok {
+				l.runtimeError("'for' limit must be a number")
+			} else if step, ok := l.toNumber(frame[a+2]); !ok {
+				l.runtimeError("'for' step must be a number")
+			} else {
+				frame[a+0], frame[a+1], frame[a+2] = init-step, limit, step
+				e.callInfo.savedPC = target
+			}
+			return false
+		}
+	case opTForCall:
+		next := p.code[at+1]
+		if next.opCode() != opTForLoop {
+			panic(fmt.Sprintf("expected opcode %s, got %s", opNames[opTForLoop], opNames[next.opCode()]))
+		}
+		la, target := next.a(), pc(at+2+next.sbx())
+		return func(e *compiledEngine) bool {
+			l, ci := e.l, e.callInfo
+			callBase := a + 3
+			copy(e.frame[callBase:callBase+3], e.frame[a:a+3])
+			callBase += ci.base()
+			l.top = callBase + 3 // function + 2 args (state and index)
+			l.call(callBase, c, true)
+			e.frame, l.top = ci.frame, ci.top
+			ci.skip()                 // the following opTForLoop
+			if e.frame[la+1] != nil { // continue loop?
+				e.frame[la] = e.frame[la+1] // save control variable
+				ci.savedPC = target         // jump back
+			}
+			return false
+		}
+	case opTForLoop:
+		target := pc(at + 1 + i.sbx())
+		return func(e *compiledEngine) bool {
+			if e.frame[a+1] != nil { // continue loop?
+				e.frame[a] = e.frame[a+1] // save control variable
+				e.callInfo.savedPC = target
+			}
+			return false
+		}
+	case opSetList:
+		skip := c == 0
+		if skip {
+			c = p.extraArg(at)
+		}
+		start := (c - 1) * listItemsPerFlush
+		return func(e *compiledEngine) bool {
+			l, ci, n := e.l, e.callInfo, b
+			if n == 0 {
+				n = l.top - ci.stackIndex(a) - 1
+			}
+			if skip {
+				ci.skip()
+			}
+			h := e.frame[a].(*table)
+			last := start + n
+			if last > len(h.array) {
+				h.extendArray(last)
+			}
+			copy(h.array[start:last], e.frame[a+1:a+1+n])
+			l.top = ci.top
+			return false
+		}
+	case opClosure:
+		np := &p.prototypes[i.bx()]
+		return func(e *compiledEngine) bool {
+			base := e.callInfo.base()
+			if ncl := cached(np, e.closure.upValues, base); ncl == nil { // no match?
+				e.frame[a] = e.l.newClosure(np, e.closure.upValues, base) // create a new one
+			} else {
+				e.frame[a] = ncl
+			}
+			clear(e.frame[a+1:])
+			return false
+		}
+	case opVarArg:
+		return func(e *compiledEngine) bool {
+			l, ci, b := e.l, e.callInfo, b-1
+			n := ci.base() - ci.function - p.parameterCount - 1
+			if b < 0 {
+				b = n // get all var arguments
+				l.checkStack(n)
+				l.top = ci.base() + a + n
+				if ci.top < l.top {
+					ci.setTop(l.top)
+					ci.frame = l.stack[ci.base():ci.top]
+				}
+				e.frame = ci.frame
+			}
+			for j := 0; j < b; j++ {
+				if j < n {
+					e.frame[a+j] = l.stack[ci.base()-n+j]
+				} else {
+					e.frame[a+j] = nil
+				}
+			}
+			return false
+		}
+	}
+	return func(*compiledEngine) bool {
+		panic(fmt.Sprintf("unexpected %s instruction, '%s'", opNames[i.opCode()], i.String()))
+	}
+}
+
+// jumpAfter decodes the jump following the test at index at: its upvalue
+// closing operand, its target, and the pc after it.
+func (p *prototype) jumpAfter(at int) (a int, target, next pc) {
+	j := p.code[at+1]
+	if j.opCode() != opJump {
+		panic(fmt.Sprintf("expected opcode %s, got %s", opNames[opJump], opNames[j.opCode()]))
+	}
+	return j.a(), pc(at + 2 + j.sbx()), pc(at + 2)
+}
+
+func (p *prototype) compileComparison(at int, i instruction, test bool, b, c int) compiledOp {
+	ja, target, next := p.jumpAfter(at)
+	branch := func(e *compiledEngine, taken bool) bool {
+		e.frame = e.callInfo.frame
+		if taken {
+			e.jump(ja, target)
+		} else {
+			e.callInfo.savedPC = next
+		}
+		return false
+	}
+	switch op := i.opCode(); {
+	case op == opEqual && !isConstant(b) && isConstant(c):
+		// Constants are never tables or userdata, so no __eq metamethod applies.
+		k := p.constants[constantIndex(c)]
+		return func(e *compiledEngine) bool { return branch(e, (e.frame[b] == k) == test) }
+	case op == opEqual:
+		return func(e *compiledEngine) bool { return branch(e, e.l.equalObjects(e.k(b), e.k(c)) == test) }
+	case op == opLessThan && !isConstant(b) && isConstant(c):
+		if k, ok := p.constants[constantIndex(c)].(float64); ok {
+			return func(e *compiledEngine) bool {
+				if n, ok := e.frame[b].(float64); ok {
+					return branch(e, (n < k) == test)
+				}
+				return branch(e, e.l.lessThan(e.frame[b], k) == test)
+			}
+		}
+	case op == opLessThan && isConstant(b) && !isConstant(c):
+		if k, ok := p.constants[constantIndex(b)].(float64); ok {
+			return func(e *compiledEngine) bool {
+				if n, ok := e.frame[c].(float64); ok {
+					return branch(e, (k < n) == test)
+				}
+				return branch(e, e.l.lessThan(k, e.frame[c]) == test)
+			}
+		}
+	case op == opLessOrEqual && !isConstant(b) && isConstant(c):
+		if k, ok := p.constants[constantIndex(c)].(float64); ok {
+			return func(e *compiledEngine) bool {
+				if n, ok := e.frame[b].(float64); ok {
+					return branch(e, (n <= k) == test)
+				}
+				return branch(e, e.l.lessOrEqual(e.frame[b], k) == test)
+			}
+		}
+	case op == opLessOrEqual && isConstant(b) && !isConstant(c):
+		if k, ok := p.constants[constantIndex(b)].(float64); ok {
+			return func(e *compiledEngine) bool {
+				if n, ok := e.frame[c].(float64); ok {
+					return branch(e, (k <= n) == test)
+				}
+				return branch(e, e.l.lessOrEqual(k, e.frame[c]) == test)
+			}
+		}
+	}
+	if i.opCode() == opLessThan {
+		return func(e *compiledEngine) bool { return branch(e, e.l.lessThan(e.k(b), e.k(c)) == test) }
+	}
+	return func(e *compiledEngine) bool { return branch(e, e.l.lessOrEqual(e.k(b), e.k(c)) == test) }
+}
+
+func (p *prototype) compileArith(i instruction, a, b, c int) compiledOp {
+	event := tmAdd + tm(i.opCode()-opAdd)
+	slow := func(e *compiledEngine, x, y value) bool {
+		tmp := e.l.arith(x, y, event)
+		e.frame = e.callInfo.frame
+		e.frame[a] = tmp
+		return false
+	}
+	if !isConstant(b) && isConstant(c) {
+		if k, ok := p.constants[constantIndex(c)].(float64); ok {
+			switch i.opCode() {
+			case opAdd:
+				return func(e *compiledEngine) bool {
+					if n, ok := e.frame[b].(float64); ok {
+						e.frame[a] = n + k
+						return false
+					}
+					return slow(e, e.frame[b], k)
+				}
+			case opSub:
+				return func(e *compiledEngine) bool {
+					if n, ok := e.frame[b].(float64); ok {
+						e.frame[a] = n - k
+						return false
+					}
+					return slow(e, e.frame[b], k)
+				}
+			case opMul:
+				return func(e *compiledEngine) bool {
+					if n, ok := e.frame[b].(float64); ok {
+						e.frame[a] = n * k
+						return false
+					}
+					return slow(e, e.frame[b], k)
+				}
+			case opDiv:
+				return func(e *compiledEngine) bool {
+					if n, ok := e.frame[b].(float64); ok {
+						e.frame[a] = n / k
+						return false
+					}
+					return slow(e, e.frame[b], k)
+				}
+			}
+		}
+	}
+	if !isConstant(b) && !isConstant(c) {
+		switch i.opCode() {
+		case opAdd:
+			return func(e *compiledEngine) bool {
+				if nb, ok := e.frame[b].(float64); ok {
+					if nc, ok := e.frame[c].(float64); ok {
+						e.frame[a] = nb + nc
+						return false
+					}
+				}
+				return slow(e, e.frame[b], e.frame[c])
+			}
+		case opSub:
+			return func(e *compiledEngine) bool {
+				if nb, ok := e.frame[b].(float64); ok {
+					if nc, ok := e.frame[c].(float64); ok {
+						e.frame[a] = nb - nc
+						return false
+					}
+				}
+				return slow(e, e.frame[b], e.frame[c])
+			}
+		case opMul:
+			return func(e *compiledEngine) bool {
+				if nb, ok := e.frame[b].(float64); ok {
+					if nc, ok := e.frame[c].(float64); ok {
+						e.frame[a] = nb * nc
+						return false
+					}
+				}
+				return slow(e, e.frame[b], e.frame[c])
+			}
+		}
+	}
+	var fast func(x, y float64) float64
+	switch i.opCode() {
+	case opAdd:
+		fast = func(x, y float64) float64 { return x + y }
+	case opSub:
+		fast = func(x, y float64) float64 { return x - y }
+	case opMul:
+		fast = func(x, y float64) float64 { return x * y }
+	case opDiv:
+		fast = func(x, y float64) float64 { return x / y }
+	case opMod:
+		fast = math.Mod
+	case opPow:
+		fast = math.Pow
+	}
+	return func(e *compiledEngine) bool {
+		x, y := e.k(b), e.k(c)
+		if nb, ok := x.(float64); ok {
+			if nc, ok := y.(float64); ok {
+				e.frame[a] = fast(nb, nc)
+				return false
+			}
+		}
+		return slow(e, x, y)
+	}
+}
@@ -0,0 +1,142 @@
+// Package coverage records the lines of Lua code run by go-lua States, and
+// reports them in the LCOV and Cobertura XML formats read by coverage
+// dashboards.
+//
+//	c := coverage.New()
+//	c.Start(l)
+//	lua.DoFile(l, "flow.lua")
+//	c.Stop(l)
+//	c.WriteLCOV(f)
+//
+// Every executable line of a chunk is reported once any of its code has run,
+// with a count of zero if it never ran. Recording coverage adds a line hook
+// to the State, so it can run along with profiling or tracing.
+package coverage
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/go-lua"
+)
+
+// A File holds the coverage of one chunk.
+type File struct {
+	// Name is the chunk's name without the '@' or '=' prefix, such as the
+	// file name given to LoadFile.
+	Name string
+
+	// Lines maps each executable line to the number of times it ran.
+	Lines map[int]int
+}
+
+// Covered returns the number of executable lines that ran.
+func (f File) Covered() (n int) {
+	for _, hits := range f.Lines {
+		if hits > 0 {
+			n++
+		}
+	}
+	return
+}
+
+// A Collector records coverage for any number of States.
+type Collector struct {
+	mu      sync.Mutex
+	files   map[string]*File
+	seen    map[function]bool
+	removes map[*lua.State]func() // remove the hooks of the States recorded
+}
+
+// A function identifies a Lua function by its source and the line where it is
+// defined.
+type function struct {
+	source string
+	line   int
+}
+
+// New returns a Collector with no coverage recorded.
+func New() *Collector {
+	return &Collector{files: make(map[string]*File), seen: make(map[function]bool), removes: make(map[*lua.State]func())}
+}
+
+// Start starts recording the lines run by l. It does nothing if c is already
+// recording l.
+func (c *Collector) Start(l *lua.State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.removes[l]; ok {
+		return
+	}
+	c.removes[l] = lua.AddDebugHook(l, c.line, lua.MaskLine, 0)
+}
+
+// Stop stops recording the lines run by l.
+func (c *Collector) Stop(l *lua.State) {
+	c.mu.Lock()
+	remove, ok := c.removes[l]
+	delete(c.removes, l)
+	c.mu.Unlock()
+	if ok {
+		remove()
+	}
+}
+
+func name(source string) string {
+	if strings.HasPrefix(source, "@") || strings.HasPrefix(source, "=") {
+		return source[1:]
+	}
+	return source
+}
+
+func (c *Collector) line(l *lua.State, ar lua.Debug) {
+	f, _ := lua.Stack(l, 0)
+	d, _ := lua.Info(l, "S", f)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	file := c.files[d.Source]
+	if fn := (function{d.Source, d.LineDefined}); !c.seen[fn] {
+		c.seen[fn] = true
+		if file == nil {
+			file = &File{Name: name(d.Source), Lines: make(map[int]int)}
+			c.files[d.Source] = file
+		}
+		lua.Info(l, "f", f)
+		for _, line := range lua.ExecutableLines(l, -1) {
+			if _, ok := file.Lines[line]; !ok {
+				file.Lines[line] = 0
+			}
+		}
+		l.Pop(1)
+	}
+	if hits, ok := file.Lines[ar.CurrentLine]; ok {
+		file.Lines[ar.CurrentLine] = hits + 1
+	}
+}
+
+// Files returns the coverage recorded so far, sorted by name.
+func (c *Collector) Files() []File {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	files := make([]File, 0, len(c.files))
+	for _, f := range c.files {
+		lines := make(map[int]int, len(f.Lines))
+		for line, hits := range f.Lines {
+			lines[line] = hits
+		}
+		files = append(files, File{Name: f.Name, Lines: lines})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files
+}
+
+// sortedLines returns the executable lines of f in increasing order.
+func (f File) sortedLines() []int {
+	lines := make([]int, 0, len(f.Lines))
+	for line := range f.Lines {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
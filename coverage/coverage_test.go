@@ -0,0 +1,103 @@
+package coverage
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/go-lua"
+)
+
+const program = `local function add(a, b)
+  return a + b
+end
+
+local function unused()
+  print("never")
+end
+
+local total = 0
+for i = 1, 3 do
+  total = add(total, i)
+end
+if total > 100 then
+  total = 0
+end
+`
+
+func run(t *testing.T, c *Collector) string {
+	name := filepath.Join(t.TempDir(), "program.lua")
+	if err := os.WriteFile(name, []byte(program), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	c.Start(l)
+	if err := lua.DoFile(l, name); err != nil {
+		t.Fatal(err)
+	}
+	c.Stop(l)
+	if err := lua.DoFile(l, name); err != nil { // not recorded
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestLines(t *testing.T) {
+	c := New()
+	name := run(t, c)
+	files := c.Files()
+	if len(files) != 1 || files[0].Name != name {
+		t.Fatalf("unexpected files %v", files)
+	}
+	expected := map[int]int{2: 3, 3: 1, 6: 0, 7: 1, 9: 1, 10: 4, 11: 3, 13: 1, 14: 0}
+	if !reflect.DeepEqual(files[0].Lines, expected) {
+		t.Errorf("lines %v, expected %v", files[0].Lines, expected)
+	}
+	if n := files[0].Covered(); n != 7 {
+		t.Errorf("%d lines covered, expected 7", n)
+	}
+}
+
+func TestLCOV(t *testing.T) {
+	c := New()
+	name := run(t, c)
+	var b bytes.Buffer
+	if err := c.WriteLCOV(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := "TN:\nSF:" + name + "\nDA:2,3\nDA:3,1\nDA:6,0\nDA:7,1\nDA:9,1\nDA:10,4\nDA:11,3\nDA:13,1\nDA:14,0\nLF:9\nLH:7\nend_of_record\n"
+	if b.String() != expected {
+		t.Errorf("got\n%s\nexpected\n%s", b.String(), expected)
+	}
+}
+
+func TestCobertura(t *testing.T) {
+	c := New()
+	name := run(t, c)
+	var b bytes.Buffer
+	if err := c.WriteCobertura(&b); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(b.String(), xml.Header) {
+		t.Error("missing XML header")
+	}
+	var report cobertura
+	if err := xml.Unmarshal(b.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.LinesValid != 9 || report.LinesCovered != 7 || report.LineRate != "0.7778" {
+		t.Errorf("unexpected totals %d/%d %s", report.LinesCovered, report.LinesValid, report.LineRate)
+	}
+	if len(report.Packages) != 1 || report.Packages[0].Name != filepath.Dir(name) || len(report.Packages[0].Classes) != 1 {
+		t.Fatalf("unexpected packages %+v", report.Packages)
+	}
+	class := report.Packages[0].Classes[0]
+	if class.Filename != name || class.Name != "program.lua" || len(class.Lines) != 9 || class.Lines[2] != (xmlLine{6, 0}) {
+		t.Errorf("unexpected class %+v", class)
+	}
+}
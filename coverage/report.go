@@ -0,0 +1,112 @@
+package coverage
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"time"
+)
+
+// WriteLCOV writes the coverage recorded so far in the LCOV tracefile format
+// read by genhtml and most coverage services.
+func (c *Collector) WriteLCOV(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	fmt.Fprintln(b, "TN:")
+	for _, f := range c.Files() {
+		fmt.Fprintf(b, "SF:%s\n", f.Name)
+		for _, line := range f.sortedLines() {
+			fmt.Fprintf(b, "DA:%d,%d\n", line, f.Lines[line])
+		}
+		fmt.Fprintf(b, "LF:%d\nLH:%d\nend_of_record\n", len(f.Lines), f.Covered())
+	}
+	return b.Flush()
+}
+
+type cobertura struct {
+	XMLName         xml.Name `xml:"coverage"`
+	LineRate        string   `xml:"line-rate,attr"`
+	BranchRate      string   `xml:"branch-rate,attr"`
+	LinesCovered    int      `xml:"lines-covered,attr"`
+	LinesValid      int      `xml:"lines-valid,attr"`
+	BranchesCovered int      `xml:"branches-covered,attr"`
+	BranchesValid   int      `xml:"branches-valid,attr"`
+	Complexity      int      `xml:"complexity,attr"`
+	Version         string   `xml:"version,attr"`
+	Timestamp       int64    `xml:"timestamp,attr"`
+	Sources         []string `xml:"sources>source"`
+	Packages        []pkg    `xml:"packages>package"`
+}
+
+type pkg struct {
+	Name       string  `xml:"name,attr"`
+	LineRate   string  `xml:"line-rate,attr"`
+	BranchRate string  `xml:"branch-rate,attr"`
+	Complexity int     `xml:"complexity,attr"`
+	Classes    []class `xml:"classes>class"`
+}
+
+type class struct {
+	Name       string    `xml:"name,attr"`
+	Filename   string    `xml:"filename,attr"`
+	LineRate   string    `xml:"line-rate,attr"`
+	BranchRate string    `xml:"branch-rate,attr"`
+	Complexity int       `xml:"complexity,attr"`
+	Methods    struct{}  `xml:"methods"`
+	Lines      []xmlLine `xml:"lines>line"`
+}
+
+type xmlLine struct {
+	Number int `xml:"number,attr"`
+	Hits   int `xml:"hits,attr"`
+}
+
+func rate(covered, valid int) string {
+	if valid == 0 {
+		return "1"
+	}
+	return fmt.Sprintf("%.4g", float64(covered)/float64(valid))
+}
+
+// WriteCobertura writes the coverage recorded so far in the Cobertura XML
+// format, with a package for each directory and a class for each chunk.
+func (c *Collector) WriteCobertura(w io.Writer) error {
+	report := cobertura{BranchRate: "0", Version: "go-lua", Timestamp: time.Now().UnixNano() / int64(time.Millisecond), Sources: []string{"."}}
+	packages := make(map[string]*pkg)
+	covered := make(map[string][2]int)
+	for _, f := range c.Files() {
+		dir := path.Dir(f.Name)
+		p := packages[dir]
+		if p == nil {
+			p = &pkg{Name: dir, BranchRate: "0"}
+			packages[dir] = p
+		}
+		cl := class{Name: path.Base(f.Name), Filename: f.Name, BranchRate: "0", LineRate: rate(f.Covered(), len(f.Lines))}
+		for _, line := range f.sortedLines() {
+			cl.Lines = append(cl.Lines, xmlLine{line, f.Lines[line]})
+		}
+		p.Classes = append(p.Classes, cl)
+		n := covered[dir]
+		covered[dir] = [2]int{n[0] + f.Covered(), n[1] + len(f.Lines)}
+		report.LinesCovered += f.Covered()
+		report.LinesValid += len(f.Lines)
+	}
+	for dir, p := range packages {
+		p.LineRate = rate(covered[dir][0], covered[dir][1])
+		report.Packages = append(report.Packages, *p)
+	}
+	sort.Slice(report.Packages, func(i, j int) bool { return report.Packages[i].Name < report.Packages[j].Name })
+	report.LineRate = rate(report.LinesCovered, report.LinesValid)
+	if _, err := io.WriteString(w, xml.Header+`<!DOCTYPE coverage SYSTEM "http://cobertura.sourceforge.net/xml/coverage-04.dtd">`+"\n"); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "\t")
+	if err := e.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,243 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/Shopify/go-lua"
+)
+
+const program = `local function add(a, b)
+  local sum = a + b
+  return sum
+end
+
+local total = 0
+for i = 1, 3 do
+  total = add(total, i)
+end
+result = total
+`
+
+type message struct {
+	Type       string          `json:"type"`
+	Event      string          `json:"event"`
+	RequestSeq int             `json:"request_seq"`
+	Success    bool            `json:"success"`
+	Message    string          `json:"message"`
+	Body       json.RawMessage `json:"body"`
+}
+
+type client struct {
+	t      *testing.T
+	path   string
+	w      io.Writer
+	in     *bufio.Reader
+	seq    int
+	events []message
+}
+
+func (c *client) read() message {
+	b, err := readMessage(c.in)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	var m message
+	if err := json.Unmarshal(b, &m); err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+func (c *client) request(command string, arguments interface{}, body interface{}) {
+	c.seq++
+	b, _ := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": arguments})
+	if _, err := io.WriteString(c.w, "Content-Length: "+strconv.Itoa(len(b))+"\r\n\r\n"+string(b)); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		m := c.read()
+		if m.Type == "event" {
+			c.events = append(c.events, m)
+		} else if m.RequestSeq == c.seq {
+			if !m.Success {
+				c.t.Fatalf("%s: %s", command, m.Message)
+			}
+			if body != nil {
+				json.Unmarshal(m.Body, body)
+			}
+			return
+		}
+	}
+}
+
+func (c *client) wait(name string, body interface{}) {
+	for {
+		var m message
+		if len(c.events) > 0 {
+			m, c.events = c.events[0], c.events[1:]
+		} else {
+			m = c.read()
+		}
+		if m.Type == "event" && m.Event == name {
+			if body != nil {
+				json.Unmarshal(m.Body, body)
+			}
+			return
+		}
+	}
+}
+
+type stopped struct {
+	Reason string `json:"reason"`
+}
+
+type stackTraceBody struct {
+	StackFrames []stackFrame `json:"stackFrames"`
+}
+
+type variablesBody struct {
+	Variables []variable `json:"variables"`
+}
+
+type evaluateBody struct {
+	Result string `json:"result"`
+}
+
+// start launches the program under a debugger with breakpoints at the given
+// lines of path, and returns a client connected to it.
+func start(t *testing.T, breakpoints []sourceBreakpoint, stopOnEntry bool) (*client, *lua.State) {
+	path := filepath.Join(t.TempDir(), "program.lua")
+	if err := os.WriteFile(path, []byte(program), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	d := Attach(l)
+	d.Run = func(program string, args []string) error { return lua.DoFile(l, program) }
+	requests, w := io.Pipe()
+	r, responses := io.Pipe()
+	go d.Serve(requests, responses)
+	c := &client{t: t, path: path, w: w, in: bufio.NewReader(r)}
+	t.Cleanup(func() { w.Close() })
+	c.request("initialize", map[string]string{"adapterID": "go-lua"}, nil)
+	c.wait("initialized", nil)
+	c.request("launch", map[string]interface{}{"program": path, "stopOnEntry": stopOnEntry}, nil)
+	c.request("setBreakpoints", setBreakpointsArguments{Source: source{Path: path}, Breakpoints: breakpoints}, nil)
+	c.request("configurationDone", nil, nil)
+	return c, l
+}
+
+func (c *client) line() int {
+	var st stackTraceBody
+	c.request("stackTrace", map[string]int{"threadId": 1}, &st)
+	return st.StackFrames[0].Line
+}
+
+func (c *client) evaluate(expression string) string {
+	var e evaluateBody
+	c.request("evaluate", map[string]interface{}{"expression": expression, "frameId": 1}, &e)
+	return e.Result
+}
+
+func TestBreakpoints(t *testing.T) {
+	c, l := start(t, []sourceBreakpoint{{Line: 2}}, false)
+	for i := 1; i <= 3; i++ {
+		var s stopped
+		c.wait("stopped", &s)
+		if s.Reason != "breakpoint" {
+			t.Errorf("stopped for %q, expected breakpoint", s.Reason)
+		}
+		var st stackTraceBody
+		c.request("stackTrace", map[string]int{"threadId": 1}, &st)
+		if n := len(st.StackFrames); n < 2 || st.StackFrames[0].Name != "add" || st.StackFrames[0].Line != 2 || st.StackFrames[1].Name != "main chunk" || st.StackFrames[1].Line != 8 {
+			t.Errorf("unexpected stack %+v", st.StackFrames)
+		}
+		if st.StackFrames[0].Source == nil || st.StackFrames[0].Source.Name != "program.lua" {
+			t.Errorf("unexpected source %+v", st.StackFrames[0].Source)
+		}
+		var scopes map[string][]scope
+		c.request("scopes", map[string]int{"frameId": 1}, &scopes)
+		var vars variablesBody
+		c.request("variables", map[string]int{"variablesReference": scopes["scopes"][0].VariablesReference}, &vars)
+		if len(vars.Variables) != 2 || vars.Variables[0].Name != "a" || vars.Variables[1].Name != "b" || vars.Variables[1].Value != strconv.Itoa(i) {
+			t.Errorf("unexpected locals %+v", vars.Variables)
+		}
+		c.request("continue", map[string]int{"threadId": 1}, nil)
+	}
+	c.wait("terminated", nil)
+	l.Global("result")
+	if n, _ := l.ToInteger(-1); n != 6 {
+		t.Errorf("result is %d, expected 6", n)
+	}
+}
+
+func TestConditionalBreakpoint(t *testing.T) {
+	c, _ := start(t, []sourceBreakpoint{{Line: 8, Condition: "i == 2"}}, false)
+	c.wait("stopped", nil)
+	if got := c.evaluate("i"); got != "2" {
+		t.Errorf("stopped with i = %s, expected 2", got)
+	}
+	c.request("continue", nil, nil)
+	c.wait("terminated", nil)
+}
+
+func TestStepping(t *testing.T) {
+	c, _ := start(t, nil, true)
+	var s stopped
+	c.wait("stopped", &s)
+	if s.Reason != "step" {
+		t.Errorf("stopped for %q, expected step", s.Reason)
+	}
+	steps := []struct {
+		command string
+		line    int
+	}{
+		{"next", 6}, {"next", 7}, {"next", 8}, {"stepIn", 2}, {"next", 3}, {"stepOut", 7}, {"next", 8},
+	}
+	if l := c.line(); l != 4 {
+		t.Errorf("stopped on entry at line %d, expected 4", l)
+	}
+	for _, step := range steps {
+		c.request(step.command, map[string]int{"threadId": 1}, nil)
+		c.wait("stopped", nil)
+		if l := c.line(); l != step.line {
+			t.Errorf("%s stopped at line %d, expected %d", step.command, l, step.line)
+		}
+	}
+	c.request("continue", nil, nil)
+	c.wait("terminated", nil)
+}
+
+func TestEvaluate(t *testing.T) {
+	c, l := start(t, []sourceBreakpoint{{Line: 3}}, false)
+	c.wait("stopped", nil)
+	for expression, expected := range map[string]string{
+		"sum":             "1",
+		"a + b":           "1",
+		"string.upper'x'": `"X"`,
+		"{}":              "table",
+	} {
+		if got := c.evaluate(expression); got != expected && !(expected == "table" && len(got) > 5 && got[:5] == "table") {
+			t.Errorf("%s evaluated to %s, expected %s", expression, got, expected)
+		}
+	}
+	c.evaluate("sum = 100")
+	c.request("continue", nil, nil)
+	c.wait("stopped", nil)
+	if got := c.evaluate("a"); got != "100" {
+		t.Errorf("assignment to a local did not persist, a = %s", got)
+	}
+	c.request("setBreakpoints", setBreakpointsArguments{Source: source{Path: c.path}}, nil)
+	c.request("continue", nil, nil)
+	c.wait("terminated", nil)
+	l.Global("result")
+	if n, _ := l.ToInteger(-1); n != 105 {
+		t.Errorf("result is %d, expected 105", n)
+	}
+}
@@ -0,0 +1,505 @@
+// Package dap implements a Debug Adapter Protocol server for go-lua.
+//
+// A Debugger attaches to a State with a line hook. Clients connect over any
+// stream, such as the standard input and output or a local TCP socket, and
+// can set line and conditional breakpoints, step in, over and out, inspect
+// the stack, the locals, upvalues and globals of each frame, and evaluate
+// expressions in a frame.
+//
+// While stopped, the State's goroutine waits in the hook and runs the
+// client's inspections, so the State is never used from two goroutines.
+//
+//	d := dap.Attach(l)
+//	go d.ListenAndServe("127.0.0.1:4711")
+//	d.WaitForConfiguration()
+//	lua.DoFile(l, "flow.lua")
+package dap
+
+import (
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/go-lua"
+)
+
+type stepKind int
+
+const (
+	stepNone stepKind = iota
+	stepIn
+	stepOver
+	stepOut
+)
+
+type breakpoint struct {
+	line      int
+	condition string
+}
+
+// A Debugger debugs the Lua code run by a State.
+type Debugger struct {
+	l *lua.State
+
+	// Run, when set, handles the launch request. It is called on a new
+	// goroutine once the client is configured, with the program and
+	// arguments named in the launch request, and should run the program in
+	// the debugger's State. The debugger reports the end of the program to
+	// the client when Run returns.
+	Run func(program string, args []string) error
+
+	mu           sync.Mutex
+	client       *conn
+	breakpoints  map[string][]breakpoint // by absolute path
+	lines        map[int]bool            // lines with a breakpoint in any source
+	step         stepKind
+	stepDepth    int
+	pause        bool
+	paths        map[string]string // chunk sources to absolute paths
+	work         chan func()       // while stopped, inspections to run
+	resume       chan struct{}     // while stopped, closed to resume
+	refs         []container       // while stopped, variable references
+	configured   chan struct{}
+	isConfigured bool
+}
+
+// Attach returns a Debugger for l, adding a line hook to l.
+func Attach(l *lua.State) *Debugger {
+	d := &Debugger{
+		l:           l,
+		breakpoints: make(map[string][]breakpoint),
+		lines:       make(map[int]bool),
+		paths:       make(map[string]string),
+		configured:  make(chan struct{}),
+	}
+	lua.AddDebugHook(l, d.hook, lua.MaskLine, 0)
+	return d
+}
+
+// WaitForConfiguration blocks until a client has set its breakpoints and sent
+// the configurationDone request.
+func (d *Debugger) WaitForConfiguration() { <-d.configured }
+
+// ListenAndServe accepts clients on the TCP address addr, serving one at a
+// time.
+func (d *Debugger) ListenAndServe(addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		d.Serve(c, c)
+		c.Close()
+	}
+}
+
+// Output sends text to the client's debug console, in the category "stdout",
+// "stderr" or "console". It does nothing without a client.
+func (d *Debugger) Output(category, text string) {
+	d.event("output", map[string]string{"category": category, "output": text})
+}
+
+func (d *Debugger) event(name string, body interface{}) {
+	d.mu.Lock()
+	c := d.client
+	d.mu.Unlock()
+	if c != nil {
+		c.send(&event{Event: name, Body: body})
+	}
+}
+
+// depth returns the number of active frames.
+func depth(l *lua.State) (n int) {
+	for ; ; n++ {
+		if _, ok := lua.Stack(l, n); !ok {
+			return
+		}
+	}
+}
+
+func (d *Debugger) path(src string) string {
+	if !strings.HasPrefix(src, "@") {
+		return ""
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p, ok := d.paths[src]
+	if !ok {
+		if abs, err := filepath.Abs(src[1:]); err == nil {
+			p = abs
+		} else {
+			p = src[1:]
+		}
+		d.paths[src] = p
+	}
+	return p
+}
+
+func (d *Debugger) hook(l *lua.State, ar lua.Debug) {
+	d.mu.Lock()
+	step, stepDepth, pause, onLine := d.step, d.stepDepth, d.pause, d.lines[ar.CurrentLine]
+	d.mu.Unlock()
+	if step == stepNone && !pause && !onLine {
+		return
+	}
+	if onLine {
+		f, _ := lua.Stack(l, 0)
+		info, _ := lua.Info(l, "S", f)
+		path := d.path(info.Source)
+		d.mu.Lock()
+		bps := d.breakpoints[path]
+		d.mu.Unlock()
+		for _, bp := range bps {
+			if bp.line == ar.CurrentLine && (bp.condition == "" || d.condition(l, bp.condition)) {
+				d.stop(l, "breakpoint")
+				return
+			}
+		}
+	}
+	switch {
+	case pause:
+		d.stop(l, "pause")
+	case step == stepIn:
+		d.stop(l, "step")
+	case step == stepOver && depth(l) <= stepDepth, step == stepOut && depth(l) < stepDepth:
+		d.stop(l, "step")
+	}
+}
+
+// condition evaluates a breakpoint condition in the current frame. Conditions
+// that fail to evaluate stop, so that mistakes are noticed.
+func (d *Debugger) condition(l *lua.State, expression string) bool {
+	f, _ := lua.Stack(l, 0)
+	if err := evaluate(l, f, expression); err != nil {
+		d.Output("console", fmt.Sprintf("breakpoint condition %q: %v\n", expression, err))
+		return true
+	}
+	defer l.Pop(1)
+	return l.ToBoolean(-1)
+}
+
+// stop reports a stop to the client and serves its inspections until it
+// resumes execution.
+func (d *Debugger) stop(l *lua.State, reason string) {
+	work, resume := make(chan func()), make(chan struct{})
+	d.mu.Lock()
+	d.work, d.resume, d.step, d.pause, d.refs = work, resume, stepNone, false, nil
+	d.stepDepth = depth(l)
+	d.mu.Unlock()
+	d.event("stopped", map[string]interface{}{"reason": reason, "threadId": 1, "allThreadsStopped": true})
+	for {
+		select {
+		case f := <-work:
+			f()
+		case <-resume:
+			return
+		}
+	}
+}
+
+// inspect runs f on the State's goroutine while it is stopped, and reports
+// whether it was.
+func (d *Debugger) inspect(f func(l *lua.State)) bool {
+	d.mu.Lock()
+	work, resume := d.work, d.resume
+	d.mu.Unlock()
+	if work == nil {
+		return false
+	}
+	done := make(chan struct{})
+	select {
+	case work <- func() {
+		defer close(done)
+		top := d.l.Top()
+		f(d.l)
+		d.l.SetTop(top)
+	}:
+	case <-resume:
+		return false
+	}
+	<-done
+	return true
+}
+
+// proceed resumes execution after a stop, stepping as asked.
+func (d *Debugger) proceed(step stepKind) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.resume == nil {
+		return false
+	}
+	d.step = step
+	close(d.resume)
+	d.work, d.resume, d.refs = nil, nil, nil
+	return true
+}
+
+// A container is something whose variables the client can list: the locals,
+// upvalues or globals of a frame, or a table reached from one of them.
+type container struct {
+	kind  string // "locals", "upvalues", "globals" or "table"
+	level int
+	path  []string // for tables, the names leading to it
+	table int      // for tables, the index in the references table
+}
+
+const refsKey = "go-lua/dap.refs"
+
+func (d *Debugger) reference(c container) int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refs = append(d.refs, c)
+	return len(d.refs)
+}
+
+func (d *Debugger) container(ref int) (container, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if ref < 1 || ref > len(d.refs) {
+		return container{}, false
+	}
+	return d.refs[ref-1], true
+}
+
+// remember stores the table at the top of the stack for later listing.
+func (d *Debugger) remember(l *lua.State) int {
+	l.Field(lua.RegistryIndex, refsKey)
+	if !l.IsTable(-1) {
+		l.Pop(1)
+		l.NewTable()
+		l.PushValue(-1)
+		l.SetField(lua.RegistryIndex, refsKey)
+	}
+	n := lua.LengthEx(l, -1) + 1
+	l.PushValue(-2)
+	l.RawSetInt(-2, n)
+	l.Pop(1)
+	return n
+}
+
+// variable describes the value at the top of the stack, giving tables a
+// reference so that the client can expand them.
+func (d *Debugger) variable(l *lua.State, name string) variable {
+	v := variable{Name: name, Type: lua.TypeNameOf(l, -1), Value: describe(l, -1)}
+	if l.IsTable(-1) {
+		v.VariablesReference = d.reference(container{kind: "table", table: d.remember(l)})
+	}
+	return v
+}
+
+// describe formats a value without calling metamethods.
+func describe(l *lua.State, index int) string {
+	switch l.TypeOf(index) {
+	case lua.TypeNil:
+		return "nil"
+	case lua.TypeBoolean:
+		return strconv.FormatBool(l.ToBoolean(index))
+	case lua.TypeNumber:
+		n, _ := l.ToNumber(index)
+		return fmt.Sprintf("%.14g", n)
+	case lua.TypeString:
+		s, _ := l.ToString(index)
+		return strconv.Quote(s)
+	}
+	return fmt.Sprintf("%s: %p", lua.TypeNameOf(l, index), l.ToValue(index))
+}
+
+func (d *Debugger) variables(l *lua.State, c container) []variable {
+	vars := []variable{}
+	switch c.kind {
+	case "locals":
+		f, ok := lua.Stack(l, c.level)
+		if !ok {
+			break
+		}
+		for n := 1; ; n++ {
+			name, ok := lua.Local(l, f, n)
+			if !ok {
+				break
+			}
+			if !strings.HasPrefix(name, "(") {
+				vars = append(vars, d.variable(l, name))
+			}
+			l.Pop(1)
+		}
+	case "upvalues":
+		f, ok := lua.Stack(l, c.level)
+		if !ok {
+			break
+		}
+		lua.Info(l, "f", f)
+		for n := 1; ; n++ {
+			name, ok := lua.UpValue(l, -1, n)
+			if !ok {
+				break
+			}
+			if name != "" && name != "_ENV" {
+				vars = append(vars, d.variable(l, name))
+			}
+			l.Pop(1)
+		}
+		l.Pop(1)
+	case "globals":
+		l.PushGlobalTable()
+		vars = d.fields(l)
+		l.Pop(1)
+	case "table":
+		l.Field(lua.RegistryIndex, refsKey)
+		l.RawGetInt(-1, c.table)
+		vars = d.fields(l)
+		l.Pop(2)
+	}
+	return vars
+}
+
+const maxFields = 1000
+
+// fields lists the fields of the table at the top of the stack, sorting
+// numeric keys numerically and the others by name.
+func (d *Debugger) fields(l *lua.State) []variable {
+	type field struct {
+		number  float64
+		numeric bool
+		v       variable
+	}
+	var fs []field
+	for l.PushNil(); l.Next(-2) && len(fs) < maxFields; l.Pop(1) {
+		f := field{}
+		switch l.TypeOf(-2) {
+		case lua.TypeNumber:
+			f.number, _ = l.ToNumber(-2)
+			f.numeric = true
+			f.v = d.variable(l, "["+describe(l, -2)+"]")
+		case lua.TypeString:
+			name, _ := l.ToString(-2)
+			f.v = d.variable(l, name)
+		default:
+			f.v = d.variable(l, "["+describe(l, -2)+"]")
+		}
+		fs = append(fs, f)
+	}
+	if len(fs) == maxFields {
+		l.Pop(2) // the key and value left by the interrupted traversal
+	}
+	sort.Slice(fs, func(i, j int) bool {
+		if fs[i].numeric != fs[j].numeric {
+			return fs[i].numeric
+		} else if fs[i].numeric {
+			return fs[i].number < fs[j].number
+		}
+		return fs[i].v.Name < fs[j].v.Name
+	})
+	vars := make([]variable, len(fs))
+	for i, f := range fs {
+		vars[i] = f.v
+	}
+	return vars
+}
+
+// evaluate evaluates expression, or runs it as a statement, in frame f, and
+// pushes its first result. Names resolve to the frame's locals, then its
+// upvalues, then globals, and assignments update them.
+func evaluate(l *lua.State, f lua.Frame, expression string) error {
+	if lua.LoadBuffer(l, "return "+expression, "=(debug)", "t") != nil {
+		l.Pop(1)
+		if lua.LoadBuffer(l, expression, "=(debug)", "t") != nil {
+			message, _ := l.ToString(-1)
+			l.Pop(1)
+			return fmt.Errorf("%s", message)
+		}
+	}
+	pushEnvironment(l, f)
+	lua.SetUpValue(l, -2, 1)
+	if err := l.ProtectedCall(0, 1, 0); err != nil {
+		message, _ := l.ToString(-1)
+		l.Pop(1)
+		return fmt.Errorf("%s", message)
+	}
+	return nil
+}
+
+// findLocal returns the number of the innermost active local called name in
+// frame f, or 0.
+func findLocal(l *lua.State, f lua.Frame, name string) (found int) {
+	for n := 1; ; n++ {
+		local, ok := lua.Local(l, f, n)
+		if !ok {
+			return
+		}
+		l.Pop(1)
+		if local == name {
+			found = n
+		}
+	}
+}
+
+// findUpValue returns the index of the upvalue called name of the function
+// at index, or 0.
+func findUpValue(l *lua.State, function int, name string) int {
+	for n := 1; ; n++ {
+		upValue, ok := lua.UpValue(l, function, n)
+		if !ok {
+			return 0
+		}
+		l.Pop(1)
+		if upValue == name {
+			return n
+		}
+	}
+}
+
+func pushEnvironment(l *lua.State, f lua.Frame) {
+	l.NewTable()
+	l.NewTable()
+	l.PushGoFunction(func(l *lua.State) int {
+		if name, ok := l.ToString(2); ok && l.TypeOf(2) == lua.TypeString {
+			if n := findLocal(l, f, name); n > 0 {
+				lua.Local(l, f, n)
+				return 1
+			}
+			lua.Info(l, "f", f)
+			if n := findUpValue(l, -1, name); n > 0 {
+				lua.UpValue(l, -1, n)
+				return 1
+			}
+			l.Pop(1)
+		}
+		l.PushGlobalTable()
+		l.PushValue(2)
+		l.Table(-2)
+		return 1
+	})
+	l.SetField(-2, "__index")
+	l.PushGoFunction(func(l *lua.State) int {
+		if name, ok := l.ToString(2); ok && l.TypeOf(2) == lua.TypeString {
+			if n := findLocal(l, f, name); n > 0 {
+				l.PushValue(3)
+				lua.SetLocal(l, f, n)
+				return 0
+			}
+			lua.Info(l, "f", f)
+			if n := findUpValue(l, -1, name); n > 0 {
+				l.PushValue(3)
+				lua.SetUpValue(l, -2, n)
+				return 0
+			}
+			l.Pop(1)
+		}
+		l.PushGlobalTable()
+		l.PushValue(2)
+		l.PushValue(3)
+		l.SetTable(-3)
+		return 0
+	})
+	l.SetField(-2, "__newindex")
+	l.SetMetaTable(-2)
+}
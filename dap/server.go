@@ -0,0 +1,278 @@
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/Shopify/go-lua"
+)
+
+type launchArguments struct {
+	Program     string   `json:"program"`
+	Args        []string `json:"args"`
+	StopOnEntry bool     `json:"stopOnEntry"`
+}
+
+// Serve reads requests from r and writes responses and events to w until the
+// client disconnects or r is exhausted. Messages are framed with
+// Content-Length headers, as over stdio. A Debugger serves one client at a
+// time.
+func (d *Debugger) Serve(r io.Reader, w io.Writer) error {
+	c := &conn{w: w}
+	d.mu.Lock()
+	d.client = c
+	d.mu.Unlock()
+	defer d.disconnect()
+	in := bufio.NewReader(r)
+	var launch *launchArguments
+	for {
+		b, err := readMessage(in)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var req request
+		if err := json.Unmarshal(b, &req); err != nil {
+			return err
+		}
+		body, err := d.handle(req, &launch)
+		resp := &response{RequestSeq: req.Seq, Command: req.Command, Success: err == nil, Body: body}
+		if err != nil {
+			resp.Message = err.Error()
+		}
+		if err := c.send(resp); err != nil {
+			return err
+		}
+		switch req.Command {
+		case "initialize":
+			c.send(&event{Event: "initialized"})
+		case "configurationDone":
+			if launch != nil {
+				d.launch(*launch)
+				launch = nil
+			}
+		case "disconnect":
+			return nil
+		}
+	}
+}
+
+// disconnect forgets the client, its breakpoints and its steps, and lets the
+// program run on.
+func (d *Debugger) disconnect() {
+	d.mu.Lock()
+	d.client = nil
+	d.breakpoints, d.lines = make(map[string][]breakpoint), make(map[int]bool)
+	d.pause = false
+	d.mu.Unlock()
+	d.proceed(stepNone)
+}
+
+func (d *Debugger) launch(a launchArguments) {
+	if a.StopOnEntry {
+		d.mu.Lock()
+		d.step = stepIn
+		d.mu.Unlock()
+	}
+	go func() {
+		code := 0
+		if err := d.Run(a.Program, a.Args); err != nil {
+			d.Output("stderr", err.Error()+"\n")
+			code = 1
+		}
+		d.event("exited", map[string]int{"exitCode": code})
+		d.event("terminated", nil)
+	}()
+}
+
+func (d *Debugger) handle(req request, launch **launchArguments) (interface{}, error) {
+	args := func(v interface{}) error {
+		if len(req.Arguments) == 0 {
+			return nil
+		}
+		return json.Unmarshal(req.Arguments, v)
+	}
+	switch req.Command {
+	case "initialize":
+		return map[string]bool{
+			"supportsConfigurationDoneRequest": true,
+			"supportsConditionalBreakpoints":   true,
+			"supportsEvaluateForHovers":        true,
+		}, nil
+	case "launch":
+		if d.Run == nil {
+			return nil, fmt.Errorf("launch is not supported by this host; attach instead")
+		}
+		var a launchArguments
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		*launch = &a
+		return nil, nil
+	case "attach", "setExceptionBreakpoints":
+		return nil, nil
+	case "configurationDone":
+		d.mu.Lock()
+		if !d.isConfigured {
+			d.isConfigured = true
+			close(d.configured)
+		}
+		d.mu.Unlock()
+		return nil, nil
+	case "setBreakpoints":
+		var a setBreakpointsArguments
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		return d.setBreakpoints(a), nil
+	case "threads":
+		return map[string]interface{}{"threads": []map[string]interface{}{{"id": 1, "name": "main"}}}, nil
+	case "stackTrace":
+		var frames []stackFrame
+		if !d.inspect(func(l *lua.State) { frames = stackTrace(l) }) {
+			return nil, errNotStopped
+		}
+		return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+	case "scopes":
+		var a struct {
+			FrameID int `json:"frameId"`
+		}
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		level := a.FrameID - 1
+		return map[string][]scope{"scopes": {
+			{Name: "Locals", VariablesReference: d.reference(container{kind: "locals", level: level})},
+			{Name: "Upvalues", VariablesReference: d.reference(container{kind: "upvalues", level: level})},
+			{Name: "Globals", VariablesReference: d.reference(container{kind: "globals"}), Expensive: true},
+		}}, nil
+	case "variables":
+		var a struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		c, ok := d.container(a.VariablesReference)
+		if !ok {
+			return nil, fmt.Errorf("unknown variables reference %d", a.VariablesReference)
+		}
+		var vars []variable
+		if !d.inspect(func(l *lua.State) { vars = d.variables(l, c) }) {
+			return nil, errNotStopped
+		}
+		return map[string][]variable{"variables": vars}, nil
+	case "evaluate":
+		var a struct {
+			Expression string `json:"expression"`
+			FrameID    int    `json:"frameId"`
+		}
+		if err := args(&a); err != nil {
+			return nil, err
+		}
+		var v variable
+		var err error
+		stopped := d.inspect(func(l *lua.State) {
+			level := a.FrameID - 1
+			if a.FrameID == 0 {
+				level = 0 // the innermost frame
+			}
+			f, ok := lua.Stack(l, level)
+			if !ok {
+				err = fmt.Errorf("unknown frame %d", a.FrameID)
+			} else if err = evaluate(l, f, a.Expression); err == nil {
+				v = d.variable(l, "")
+			}
+		})
+		if !stopped {
+			return nil, errNotStopped
+		} else if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"result": v.Value, "type": v.Type, "variablesReference": v.VariablesReference}, nil
+	case "continue":
+		if !d.proceed(stepNone) {
+			return nil, errNotStopped
+		}
+		return map[string]bool{"allThreadsContinued": true}, nil
+	case "next", "stepIn", "stepOut":
+		step := map[string]stepKind{"next": stepOver, "stepIn": stepIn, "stepOut": stepOut}[req.Command]
+		if !d.proceed(step) {
+			return nil, errNotStopped
+		}
+		return nil, nil
+	case "pause":
+		d.mu.Lock()
+		d.pause = true
+		d.mu.Unlock()
+		return nil, nil
+	case "disconnect":
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported request %q", req.Command)
+}
+
+var errNotStopped = fmt.Errorf("the program is not stopped")
+
+func (d *Debugger) setBreakpoints(a setBreakpointsArguments) map[string][]breakpointInfo {
+	path := a.Source.Path
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	bps := make([]breakpoint, len(a.Breakpoints))
+	infos := make([]breakpointInfo, len(a.Breakpoints))
+	for i, b := range a.Breakpoints {
+		bps[i] = breakpoint{line: b.Line, condition: b.Condition}
+		infos[i] = breakpointInfo{Verified: true, Line: b.Line}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(bps) == 0 {
+		delete(d.breakpoints, path)
+	} else {
+		d.breakpoints[path] = bps
+	}
+	d.lines = make(map[int]bool)
+	for _, bps := range d.breakpoints {
+		for _, b := range bps {
+			d.lines[b.line] = true
+		}
+	}
+	return map[string][]breakpointInfo{"breakpoints": infos}
+}
+
+func stackTrace(l *lua.State) []stackFrame {
+	frames := []stackFrame{}
+	for level := 0; ; level++ {
+		f, ok := lua.Stack(l, level)
+		if !ok {
+			return frames
+		}
+		info, _ := lua.Info(l, "Sln", f)
+		frame := stackFrame{ID: level + 1, Name: info.Name, Line: info.CurrentLine, Column: 1}
+		switch {
+		case info.What == "main":
+			frame.Name = "main chunk"
+		case frame.Name == "":
+			frame.Name = fmt.Sprintf("function <%s:%d>", info.ShortSource, info.LineDefined)
+		}
+		if strings.HasPrefix(info.Source, "@") {
+			path := info.Source[1:]
+			if abs, err := filepath.Abs(path); err == nil {
+				path = abs
+			}
+			frame.Source = &source{Name: filepath.Base(path), Path: path}
+		} else if info.What == "Go" {
+			frame.PresentationHint = "subtle"
+		}
+		if frame.Line < 0 {
+			frame.Line = 0
+		}
+		frames = append(frames, frame)
+	}
+}
@@ -2,6 +2,7 @@ package lua
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -132,7 +133,7 @@ func (l *State) errorMessage() {
 		l.top++
 		l.call(l.top-2, 1, false)
 	}
-	l.throw(RuntimeError(CheckString(l, -1)))
+	l.throw(l.newLuaError(l.stack[l.top-1]))
 }
 
 // SetDebugHook sets the debugging hook function.
@@ -167,20 +168,40 @@ func SetDebugHook(l *State, f Hook, mask byte, count int) {
 	if ci := l.callInfo; ci.isLua() {
 		l.oldPC = ci.savedPC
 	}
-	l.hooker, l.baseHookCount = f, count
-	l.resetHookCount()
-	l.hookMask = mask
+	l.settleHookCounts()
+	if l.primaryHook() != nil {
+		l.hooks = l.hooks[1:]
+	}
+	if f != nil {
+		l.hooks = append([]*debugHook{{f: f, mask: mask, count: count, left: count, primary: true}}, l.hooks...)
+	}
+	l.installHooks()
 	l.internalHook = false
 }
 
-// DebugHook returns the current hook function.
-func DebugHook(l *State) Hook { return l.hooker }
+// DebugHook returns the current hook function, set by SetDebugHook.
+func DebugHook(l *State) Hook {
+	if h := l.primaryHook(); h != nil {
+		return h.f
+	}
+	return nil
+}
 
-// DebugHookMask returns the current hook mask.
-func DebugHookMask(l *State) byte { return l.hookMask }
+// DebugHookMask returns the current hook mask, set by SetDebugHook.
+func DebugHookMask(l *State) byte {
+	if h := l.primaryHook(); h != nil {
+		return h.mask
+	}
+	return 0
+}
 
-// DebugHookCount returns the current hook count.
-func DebugHookCount(l *State) int { return l.hookCount }
+// DebugHookCount returns the current hook count, set by SetDebugHook.
+func DebugHookCount(l *State) int {
+	if h := l.primaryHook(); h != nil {
+		return h.count
+	}
+	return 0
+}
 
 // Stack gets information about the interpreter runtime stack.
 //
@@ -203,6 +224,62 @@ func Stack(l *State, level int) (f Frame, ok bool) {
 	return
 }
 
+func (l *State) findLocal(ci *callInfo, n int) (name string, index int, ok bool) {
+	var base int
+	if ci.isLua() {
+		base = ci.base()
+		if ci.savedPC > 0 {
+			name, ok = l.prototype(ci).localName(n, ci.savedPC-1)
+		}
+	} else {
+		base = ci.function + 1
+	}
+	if !ok {
+		limit := l.top
+		if ci != l.callInfo {
+			limit = ci.next.function
+		}
+		if n <= 0 || limit-base < n {
+			return
+		}
+		name = "(*temporary)" // a valid slot without a name
+	}
+	return name, base + n - 1, true
+}
+
+// Local gets information about local variable n of the activation record f,
+// as returned by Stack or given to a hook. It pushes the variable's value onto
+// the stack and returns its name. Variables count from 1 in the order they
+// are declared, and only the variables active at the current point of the
+// function are counted. Names starting with '(' denote slots without a
+// variable name, such as loop control values and temporaries.
+//
+// Local returns false, pushing nothing, when n is greater than the number of
+// active locals.
+//
+// http://www.lua.org/manual/5.2/manual.html#lua_getlocal
+func Local(l *State, f Frame, n int) (name string, ok bool) {
+	name, index, ok := l.findLocal(f, n)
+	if ok {
+		l.apiPush(l.stack[index])
+	}
+	return
+}
+
+// SetLocal sets the value of local variable n of the activation record f to
+// the value at the top of the stack, which it pops, and returns the
+// variable's name. f and n are as in Local.
+//
+// http://www.lua.org/manual/5.2/manual.html#lua_setlocal
+func SetLocal(l *State, f Frame, n int) (name string, ok bool) {
+	name, index, ok := l.findLocal(f, n)
+	if ok {
+		l.stack[index] = l.stack[l.top-1]
+	}
+	l.top--
+	return
+}
+
 func functionInfo(p Debug, f closure) (d Debug) {
 	d = p
 	if l, ok := f.(*luaClosure); !ok {
@@ -231,7 +308,7 @@ func (l *State) functionName(ci *callInfo) (name, kind string) {
 	}
 	var tm tm
 	p := l.prototype(ci)
-	pc := ci.savedPC
+	pc := ci.savedPC - 1 // the calling instruction
 	switch i := p.code[pc]; i.opCode() {
 	case opCall, opTailCall:
 		return p.objectName(i.a(), pc)
@@ -271,6 +348,39 @@ func (l *State) functionName(ci *callInfo) (name, kind string) {
 	return eventNames[tm], "metamethod"
 }
 
+// ExecutableLines returns, in increasing order, the lines of the Lua function
+// at index, and of the functions defined in it, where code starts. The line
+// of the return that ends each function without results is left out unless
+// other code starts there, as functions that return explicitly never run it.
+// ExecutableLines returns nil if the value at index is not a Lua function.
+func ExecutableLines(l *State, index int) []int {
+	c, ok := l.indexToValue(index).(*luaClosure)
+	if !ok {
+		return nil
+	}
+	set := make(map[int]bool)
+	var collect func(p *prototype)
+	collect = func(p *prototype) {
+		lines := p.lineInfo
+		if n := len(p.code); n > 0 && p.code[n-1].opCode() == opReturn && p.code[n-1].b() == 1 {
+			lines = lines[:n-1]
+		}
+		for _, line := range lines {
+			set[int(line)] = true
+		}
+		for i := range p.prototypes {
+			collect(&p.prototypes[i])
+		}
+	}
+	collect(c.prototype)
+	lines := make([]int, 0, len(set))
+	for line := range set {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
 func (l *State) collectValidLines(f closure) {
 	if lc, ok := f.(*luaClosure); !ok {
 		l.apiPush(nil)
@@ -477,13 +587,12 @@ var debugLibrary = []RegistryFunction{
 	{"gethook", func(l *State) int {
 		_, l1 := threadArg(l)
 		hooker, mask := DebugHook(l1), DebugHookMask(l1)
-		if hooker != nil && !l.internalHook {
+		if hooker != nil && !l1.internalHook {
 			l.PushString("external hook")
 		} else {
 			hookTable(l)
 			l1.PushThread()
-			//			XMove(l1, l, 1)
-			panic("XMove not implemented yet")
+			l1.XMove(l, 1)
 			l.RawGet(-2)
 			l.Remove(-2)
 		}
@@ -543,8 +652,7 @@ var debugLibrary = []RegistryFunction{
 			l.SetMetaTable(-2)
 		}
 		l1.PushThread()
-		//	 	XMove(l1, l, 1)
-		panic("XMove not yet implemented")
+		l1.XMove(l, 1)
 		l.PushValue(i + 1)
 		l.RawSet(-3)
 		SetDebugHook(l1, hook, mask, count)
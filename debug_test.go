@@ -0,0 +1,196 @@
+package lua
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLineHook(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	var lines []int
+	var names []string
+	SetDebugHook(l, func(l *State, ar Debug) {
+		f, _ := Stack(l, 0)
+		if d, _ := Info(l, "nl", f); d.CurrentLine != ar.CurrentLine {
+			t.Errorf("hook at line %d, but the frame is at line %d", ar.CurrentLine, d.CurrentLine)
+		} else if d.Name != "" {
+			names = append(names, d.Name)
+		}
+		lines = append(lines, ar.CurrentLine)
+	}, MaskLine, 0)
+	if err := DoString(l, "local function add(a, b)\n  return a + b\nend\nlocal x = add(1, 2)\nx = x + 1\n"); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []int{3, 4, 2, 5}; !reflect.DeepEqual(lines, expected) {
+		t.Errorf("line events %v, expected %v", lines, expected)
+	}
+	if !reflect.DeepEqual(names, []string{"add"}) {
+		t.Errorf("function names %v, expected [add]", names)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	l.Register("inspect", func(l *State) int {
+		f, _ := Stack(l, 1)
+		if name, ok := Local(l, f, 2); !ok || name != "y" || CheckInteger(l, -1) != 2 {
+			t.Errorf("local 2 is %q = %v, expected y = 2", name, l.ToValue(-1))
+		}
+		l.PushInteger(20)
+		if name, ok := SetLocal(l, f, 2); !ok || name != "y" {
+			t.Errorf("set local 2 %q, expected y", name)
+		}
+		if _, ok := Local(l, f, 10); ok {
+			t.Error("local 10 exists")
+		}
+		return 0
+	})
+	if err := DoString(l, "local x, y = 1, tonumber(\"2\"); inspect(); assert(x == 1 and y == 20)"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHookFunctionName(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	var calls []string
+	SetDebugHook(l, func(l *State, ar Debug) {
+		f, _ := Stack(l, 0)
+		if d, _ := Info(l, "nSl", f); d.What == "Lua" {
+			calls = append(calls, d.NameKind+" "+d.Name)
+		}
+	}, MaskCall, 0)
+	if err := DoString(l, `
+		local function add(a, b) return a + b end
+		function double(x) return add(x, x) end
+		local t = {}
+		function t:half(x) return x / 2 end
+		add(1, 2)
+		double(1)
+		t:half(2)
+	`); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"local add", "global double", " ", "method half"} // the tail call has no name
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("hooks saw calls %q, expected %q", calls, expected)
+	}
+}
+
+func TestCountHookLine(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	countLine, lines := 0, 0
+	SetDebugHook(l, func(l *State, ar Debug) {
+		f, _ := Stack(l, 0)
+		d, _ := Info(l, "l", f)
+		if ar.Event == HookCount {
+			countLine = d.CurrentLine
+		} else if lines++; countLine != ar.CurrentLine {
+			t.Errorf("count hook at line %d before the line hook at line %d", countLine, ar.CurrentLine)
+		}
+	}, MaskCount|MaskLine, 1)
+	if err := DoString(l, "local function f(n)\n  local a = n * 2\n  local b = a + 1\n  return b\nend\nassert(f(1) == 3)\n"); err != nil {
+		t.Fatal(err)
+	}
+	if lines != 5 { // lines 5, 6, 2, 3 and 4
+		t.Errorf("%d line events, expected 5", lines)
+	}
+}
+
+func TestAddDebugHook(t *testing.T) {
+	const program = "local x = 0\nfor i = 1, 100 do\n  x = x + i\nend\n"
+	events := make([]int, 3)
+	hooks := []struct {
+		mask  byte
+		count int
+	}{{MaskLine, 0}, {MaskCount, 3}, {MaskCount, 7}}
+	add := func(l *State, i int) func() {
+		return AddDebugHook(l, func(*State, Debug) { events[i]++ }, hooks[i].mask, hooks[i].count)
+	}
+	var alone []int
+	for i := range hooks {
+		l := newTestState()
+		add(l, i)
+		if err := DoString(l, program); err != nil {
+			t.Fatal(err)
+		}
+		alone = append(alone, events[i])
+		events[i] = 0
+	}
+	l := newTestState()
+	var primary int
+	SetDebugHook(l, func(*State, Debug) { primary++ }, MaskCount, 5)
+	removes := []func(){add(l, 0), add(l, 1), add(l, 2)}
+	if err := DoString(l, program); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(events, alone) {
+		t.Errorf("hooks together saw %v events, and %v alone", events, alone)
+	}
+	if primary == 0 || DebugHookCount(l) != 5 || DebugHookMask(l) != MaskCount {
+		t.Errorf("the hook set by SetDebugHook ran %d times, with mask %d and count %d", primary, DebugHookMask(l), DebugHookCount(l))
+	}
+	removes[1]()
+	SetDebugHook(l, nil, 0, 0)
+	events[0], events[1], events[2], primary = 0, 0, 0, 0
+	if err := DoString(l, program); err != nil {
+		t.Fatal(err)
+	}
+	if events[0] != alone[0] || events[1] != 0 || events[2] == 0 || primary != 0 {
+		t.Errorf("removed hooks ran, or remaining hooks saw %v events", events)
+	}
+}
+
+func TestDebugSetHook(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	l.NewThread()
+	l.SetGlobal("thread")
+	if err := DoString(l, `
+    local lines = {}
+    local function hook(event, line) lines[#lines + 1] = line end
+    debug.sethook(hook, "l")
+    local f, mask, count = debug.gethook()
+    debug.sethook()
+    assert(f == hook and mask == "l" and count == 0)
+    assert(#lines == 2 and lines[1] == 5, #lines)
+    assert(debug.gethook() == nil)
+    debug.sethook(thread, hook, "c", 3)
+    f, mask, count = debug.gethook(thread)
+    assert(f == hook and mask == "c" and count == 3)
+    assert(debug.gethook() == nil)
+  `); err != nil {
+		t.Fatal(err)
+	}
+	SetDebugHook(l, func(*State, Debug) {}, MaskCall, 0)
+	if err := DoString(l, `assert(debug.gethook() == "external hook")`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDebugSetHookThread(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	thread := l.NewThread()
+	l.SetGlobal("thread")
+	if err := DoString(l, `
+    lines = {}
+    debug.sethook(thread, function(event, line) lines[#lines + 1] = line end, "l")
+    assert(debug.gethook() == nil and debug.gethook(thread) ~= nil)
+  `); err != nil {
+		t.Fatal(err)
+	}
+	if err := DoString(thread, "local x = 1\nx = x + 1\nassert(select('#', debug.gethook()) == 3)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := DoString(l, `
+    assert(#lines == 3 and lines[1] == 1 and lines[3] == 3, #lines)
+    debug.sethook(thread)
+    assert(debug.gethook(thread) == nil)
+  `); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,214 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// A LuaError is a runtime error raised by Lua code, by the Lua VM or through
+// Error. It is returned by ProtectedCall, and unwraps to the RuntimeError of
+// its message.
+type LuaError struct {
+	// Message is the error value converted to a string, or a description
+	// of it when the value is neither a string nor a number.
+	Message string
+
+	// Chunk and Line locate the innermost Lua function running when the
+	// error was raised, by the chunk's name without its '@' or '=' prefix.
+	// Line is -1 if no Lua function was running.
+	Chunk string
+	Line  int
+
+	// Traceback is the stack traceback at the point the error was raised,
+	// as written by Traceback. It is only built for errors returned to Go,
+	// not for those caught by pcall or xpcall.
+	Traceback string
+
+	value     value
+	err       error // the Go error raised by RaiseError
+	traceback bool  // whether Error includes the traceback
+}
+
+func (e *LuaError) Error() string {
+	if e.traceback {
+		return RuntimeError(e.Message).Error() + "\n" + e.Traceback
+	}
+	return RuntimeError(e.Message).Error()
+}
+
+// Unwrap returns the RuntimeError of e's message, and the Go error raised
+// by RaiseError if the error value is one, so that errors.Is and errors.As
+// can match them.
+func (e *LuaError) Unwrap() []error {
+	if e.err != nil {
+		return []error{RuntimeError(e.Message), e.err}
+	}
+	return []error{RuntimeError(e.Message)}
+}
+
+// Push pushes the value raised by the error onto the stack of l, which can be
+// any thread of the State that raised it. It is a handle on the original
+// value, such as the table passed to error.
+func (e *LuaError) Push(l *State) { l.apiPush(e.value) }
+
+func (l *State) newLuaError(v value) *LuaError {
+	e := &LuaError{value: v, Line: -1, traceback: l.global.errorTracebacks}
+	if s, ok := toString(v); ok {
+		e.Message = s
+	} else if err := goErrorOf(v); err != nil {
+		e.err, e.Message = err, err.Error()
+	} else {
+		e.Message = fmt.Sprintf("(error object is a %s value)", l.valueToType(v))
+	}
+	for ci := l.callInfo; ci != &l.baseCallInfo; ci = ci.previous {
+		if ci.isLua() {
+			e.Chunk, e.Line = strings.TrimLeft(l.prototype(ci).source, "@="), l.currentLine(ci)
+			break
+		}
+	}
+	if l.luaProtected {
+		return e
+	}
+	ci, top := l.callInfo, l.callInfo.top
+	l.checkStack(MinStack)
+	ci.setTop(l.top + MinStack) // naming Go functions uses the stack
+	e.Traceback = traceback(l, l, "", 0)
+	ci.setTop(top)
+	return e
+}
+
+const goErrorMetaTable = "go-lua.error"
+
+// A goError is the userdata of a Go error pushed by PushError.
+type goError struct{ err error }
+
+// PushError pushes err onto the stack as a userdata that Lua code can use as
+// an error value. Converting it with tostring gives err's message, and its
+// is method tells whether err matches another error pushed by PushError, as
+// errors.Is does:
+//
+//	local ok, e = pcall(fetch, url)
+//	if not ok and e:is(ErrRateLimited) then
+//	  -- retry later
+//	end
+func PushError(l *State, err error) {
+	l.PushUserData(goError{err})
+	if NewMetaTable(l, goErrorMetaTable) {
+		SetFunctions(l, []RegistryFunction{{"__tostring", func(l *State) int {
+			l.PushString(CheckUserData(l, 1, goErrorMetaTable).(goError).err.Error())
+			return 1
+		}}}, 0)
+		l.NewTable()
+		SetFunctions(l, []RegistryFunction{{"is", func(l *State) int {
+			err := CheckUserData(l, 1, goErrorMetaTable).(goError).err
+			target := ToError(l, 2)
+			l.PushBoolean(target != nil && errors.Is(err, target))
+			return 1
+		}}}, 0)
+		l.SetField(-2, "__index")
+	}
+	l.SetMetaTable(-2)
+}
+
+// ToError returns the Go error of the value at index, if it was pushed by
+// PushError. Otherwise, it returns nil.
+func ToError(l *State, index int) error { return goErrorOf(l.indexToValue(index)) }
+
+func goErrorOf(v value) error {
+	if u, ok := v.(*userData); ok {
+		if g, ok := u.data.(goError); ok {
+			return g.err
+		}
+	}
+	return nil
+}
+
+// RaiseError raises err as a Lua error, with the value pushed by PushError
+// as its error object. If the error is not caught by Lua code, the error
+// returned by ProtectedCall is a *LuaError that unwraps to err.
+//
+// This function never returns. It is an idiom to use it in Go functions as:
+//
+//	lua.RaiseError(l, err)
+//	panic("unreachable")
+func RaiseError(l *State, err error) {
+	PushError(l, err)
+	l.Error()
+}
+
+// A PanicError is raised as a Lua error, in the way RaiseError raises
+// errors, when a Go function called from Lua panics with a value other than
+// a Lua error. ProtectedCall returns a PanicError itself if the VM panics
+// outside of a Go function.
+type PanicError struct {
+	Value interface{} // the value passed to panic
+	Stack []byte      // the stack of the panicking goroutine, as debug.Stack formats it
+}
+
+func (e *PanicError) Error() string { return fmt.Sprintf("panic: %v", e.Value) }
+
+// Unwrap returns the panic value if it is an error, such as a runtime.Error.
+func (e *PanicError) Unwrap() error {
+	err, _ := e.Value.(error)
+	return err
+}
+
+// SetPanicRecovery sets whether panics in Go functions called from Lua are
+// raised as Lua errors holding a *PanicError, which they are by default. When
+// disabled, such panics unwind through Lua and ProtectedCall, which is useful
+// to debug them.
+func SetPanicRecovery(l *State, enabled bool) { l.global.propagatePanics = !enabled }
+
+// goPanicError raises the value e, with which the Go function running in l
+// panicked, as a Lua error holding a *PanicError, and returns the error.
+func (l *State) goPanicError(e interface{}) error {
+	err := &PanicError{Value: e, Stack: debug.Stack()}
+	return l.protect(func() {
+		l.checkStack(MinStack)
+		l.callInfo.setTop(l.top + MinStack) // the function may have used all its stack
+		PushError(l, err)
+		l.errorMessage()
+	})
+}
+
+// A CompileError is an error compiling a chunk, returned by Load and the
+// functions that call it. It matches SyntaxError with errors.Is.
+type CompileError struct {
+	// Chunk is the name of the chunk, without its '@' or '=' prefix.
+	Chunk string
+
+	// Line and Column locate the token where the error was found, counting
+	// from 1. They are 0 for a chunk refused by Load's mode.
+	Line, Column int
+
+	// Near is the token where the error was found, as shown in the error
+	// message, such as "<eof>" or "'end'". It is empty if the message does
+	// not show one.
+	Near string
+
+	// Message describes the error, such as "unexpected symbol".
+	Message string
+
+	text string // the message pushed by Load
+}
+
+func (e *CompileError) Error() string { return "syntax error: " + e.text }
+
+// Is reports whether target is SyntaxError.
+func (e *CompileError) Is(target error) bool { return target == SyntaxError }
+
+func (s *scanner) syntaxErrorAt(message string, token rune) *CompileError {
+	e := &CompileError{Chunk: strings.TrimLeft(s.source, "@="), Line: s.lineNumber, Column: s.startColumn, Message: message}
+	if s.startLine != s.lineNumber { // the error is in a token spanning lines
+		e.Column = s.offset() - s.lineStart + 1
+	}
+	if token != 0 {
+		e.Near = s.tokenToString(token)
+		e.text = fmt.Sprintf("%s:%d: %s near %s", chunkID(s.source), s.lineNumber, message, e.Near)
+	} else {
+		e.text = fmt.Sprintf("%s:%d: %s", chunkID(s.source), s.lineNumber, message)
+	}
+	return e
+}
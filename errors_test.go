@@ -0,0 +1,204 @@
+package lua
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLuaErrorValue(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	err := LoadBuffer(l, "local function fail()\n  error({code = 42})\nend\nfail()\n", "@fail.lua", "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fmt.Errorf("running: %w", l.ProtectedCall(0, 0, 0))
+	var le *LuaError
+	if !errors.As(err, &le) {
+		t.Fatalf("%v is not a LuaError", err)
+	}
+	if le.Chunk != "fail.lua" || le.Line != 2 || le.Message != "(error object is a table value)" {
+		t.Errorf("unexpected error %+v", *le)
+	}
+	if !strings.HasPrefix(le.Traceback, "stack traceback:\n\t[Go]: in function 'error'\n\tfail.lua:2: in ") || !strings.Contains(le.Traceback, "fail.lua:4: in main chunk") {
+		t.Errorf("unexpected traceback %q", le.Traceback)
+	}
+	if !l.IsTable(-1) {
+		t.Error("the error value was not left on the stack")
+	}
+	l.SetTop(0)
+	le.Push(l)
+	l.Field(-1, "code")
+	if code, _ := l.ToInteger(-1); code != 42 {
+		t.Errorf("code %d, expected 42", code)
+	}
+	var re RuntimeError
+	if !errors.As(err, &re) || string(re) != le.Message {
+		t.Errorf("%v does not unwrap to its RuntimeError", err)
+	}
+}
+
+func TestLuaErrorMessage(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	err := DoString(l, "local t = nil\nreturn t.x")
+	var le *LuaError
+	if !errors.As(err, &le) {
+		t.Fatalf("%v is not a LuaError", err)
+	}
+	message := `[string "local t = nil"]:2: attempt to index local 't' (a nil value)`
+	if le.Message != message || le.Line != 2 || err.Error() != "runtime error: "+message {
+		t.Errorf("unexpected error %+v", *le)
+	}
+	if err := DoString(l, "local ok, e = pcall(error, {code = 42}); assert(not ok and e.code == 42)"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCompileError(t *testing.T) {
+	l := NewState()
+	err := LoadFile(l, "fixtures/syntax_error.lua", "")
+	var se *CompileError
+	if !errors.As(err, &se) || se.Chunk != "fixtures/syntax_error.lua" || se.Line != 4 || se.Column != 1 || se.Near != "<eof>" || se.Message != "syntax error" {
+		t.Errorf("unexpected error %v", err)
+	}
+	err = LoadString(l, "this_is_a_syntax_error")
+	if !errors.As(err, &se) || se.Line != 1 || se.Column != 23 || se.Near != "<eof>" || err.Error() != `syntax error: [string "this_is_a_syntax_error"]:1: syntax error near <eof>` {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestCompileErrorMode(t *testing.T) {
+	l := NewState()
+	err := LoadBuffer(l, "return 1", "=mode", "b")
+	var se *CompileError
+	if !errors.As(err, &se) || se.Chunk != "mode" || se.Line != 0 || se.Message != "attempt to load a text chunk (mode is 'b')" {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+var errRateLimited = errors.New("rate limited")
+
+func TestRaiseError(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	PushError(l, errRateLimited)
+	l.SetGlobal("ErrRateLimited")
+	l.Register("fetch", func(l *State) int {
+		RaiseError(l, fmt.Errorf("fetching %s: %w", CheckString(l, 1), errRateLimited))
+		panic("unreachable")
+	})
+	if err := DoString(l, `
+    local ok, e = pcall(fetch, "/a")
+    assert(not ok and e:is(ErrRateLimited) and not ErrRateLimited:is(e))
+    assert(tostring(e) == "fetching /a: rate limited")
+    assert(not e:is({}))
+  `); err != nil {
+		t.Fatal(err)
+	}
+	err := DoString(l, `local ok, e = pcall(fetch, "/b"); error(e)`)
+	var le *LuaError
+	if !errors.Is(err, errRateLimited) || !errors.As(err, &le) || le.Message != "fetching /b: rate limited" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if ToError(l, -1) == nil || ToError(l, -1).Error() != le.Message {
+		t.Error("the Go error was not left on the stack")
+	}
+}
+
+func TestGoPanic(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	l.Register("write", func(l *State) int {
+		var m map[string]int
+		m["x"] = 1
+		return 0
+	})
+	l.Register("fail", func(l *State) int { panic("boom") })
+	if err := DoString(l, `
+    local ok, e = pcall(fail)
+    assert(not ok and tostring(e) == "panic: boom")
+  `); err != nil {
+		t.Fatal(err)
+	}
+	err := DoString(l, "write()")
+	var pe *PanicError
+	var re runtime.Error
+	var le *LuaError
+	if !errors.As(err, &pe) || !errors.As(err, &re) || !strings.Contains(string(pe.Stack), "TestGoPanic") {
+		t.Fatalf("unexpected error %v", err)
+	} else if !errors.As(err, &le) || !strings.HasPrefix(le.Traceback, "stack traceback:\n\t[Go]: in function 'write'") {
+		t.Errorf("unexpected traceback %q", le.Traceback)
+	}
+	if DoString(l, "return 1") != nil {
+		t.Error("the State is unusable after a panic")
+	}
+
+	SetPanicRecovery(l, false)
+	defer func() {
+		if r := recover(); r != "boom" {
+			t.Errorf("recovered %v", r)
+		}
+	}()
+	DoString(l, "pcall(fail)")
+	t.Error("the panic did not propagate")
+}
+
+func TestGoTraceback(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	l.PushGoFunction(func(l *State) int {
+		Errorf(l, "failed")
+		return 0
+	})
+	l.SetGlobal("fail")
+	const chunk = "local function f() fail() end\nf()"
+	err := DoString(l, chunk)
+	var le *LuaError
+	if !errors.As(err, &le) || !strings.Contains(le.Traceback, "[Go]: in function 'fail'") || strings.Contains(err.Error(), "stack traceback") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	SetTracebackGoFrames(l, true)
+	SetErrorTracebacks(l, true)
+	err = DoString(l, chunk)
+	if !errors.As(err, &le) || le.Traceback == "" || !strings.HasSuffix(err.Error(), "\n"+le.Traceback) {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if !strings.Contains(le.Traceback, "errors_test.go:") || !strings.Contains(le.Traceback, ": in function 'fail' <github.com/Shopify/go-lua.TestGoTraceback.func1>") {
+		t.Errorf("unexpected traceback %q", le.Traceback)
+	}
+}
+
+func TestTracebackInsideProtectedCall(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	var le *LuaError
+	l.Register("call", func(l *State) int {
+		if err := l.ProtectedCall(0, 0, 0); !errors.As(err, &le) {
+			t.Errorf("unexpected error %v", err)
+		}
+		return 0
+	})
+	if err := DoString(l, `assert(not pcall(error, "caught")); pcall(call, function() error("returned") end)`); err != nil {
+		t.Fatal(err)
+	}
+	if le == nil || !strings.HasPrefix(le.Traceback, "stack traceback:\n\t[Go]: in function 'error'") || !strings.Contains(le.Traceback, "in function 'pcall'") {
+		t.Errorf("unexpected error %+v", le)
+	}
+}
+
+func BenchmarkProtectedCallError(b *testing.B) {
+	l := newTestState()
+	OpenLibraries(l)
+	l.PushInteger(b.N)
+	l.SetGlobal("n")
+	LoadString(l, "for i = 1, n do pcall(error, 'x') end")
+	b.ResetTimer()
+	if err := l.ProtectedCall(0, 0, 0); err != nil {
+		b.Error(err)
+	}
+}
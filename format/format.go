@@ -0,0 +1,97 @@
+// Package format implements canonical formatting of Lua source, in the style
+// printed by ast.Fprint.
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+
+	"github.com/Shopify/go-lua/ast"
+)
+
+// Format returns src in canonical style. src must be a chunk lua.Load
+// compiles, including its checks of gotos, labels and breaks; otherwise
+// Format returns the syntax error. Comments are kept, and a leading "#" line, which Load skips, is kept
+// as it is.
+func Format(src []byte) ([]byte, error) {
+	var b bytes.Buffer
+	if len(src) > 0 && src[0] == '#' {
+		line := len(src)
+		if i := bytes.IndexByte(src, '\n'); i >= 0 {
+			line = i + 1
+		}
+		b.Write(src[:line])
+		if line == len(src) && src[line-1] != '\n' {
+			b.WriteByte('\n')
+		}
+		src = append([]byte("\n"), src[line:]...) // keep line numbers
+	}
+	chunk, err := ast.Parse("", bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	start := b.Len()
+	if err := ast.Fprint(&b, chunk); err != nil {
+		return nil, err
+	}
+	formatted, err := ast.Parse("", bytes.NewReader(b.Bytes()[start:]))
+	if err != nil || len(formatted.Comments) != len(chunk.Comments) || !equal(reflect.ValueOf(formatted.Block), reflect.ValueOf(chunk.Block)) {
+		return nil, fmt.Errorf("format: internal error: formatting changed the chunk: %v", err)
+	}
+	return b.Bytes(), nil
+}
+
+var (
+	spanType     = reflect.TypeOf(ast.Span{})
+	attachedType = reflect.TypeOf(ast.Attached{})
+	commentType  = reflect.TypeOf(&ast.Comment{})
+	commentsType = reflect.TypeOf([]*ast.Comment{})
+)
+
+// elements returns the elements of the slice v, leaving out empty
+// statements, which the printer only keeps where they are needed.
+func elements(v reflect.Value) (es []reflect.Value) {
+	for i := 0; i < v.Len(); i++ {
+		if _, ok := v.Index(i).Interface().(*ast.Empty); !ok {
+			es = append(es, v.Index(i))
+		}
+	}
+	return
+}
+
+// equal reports whether a and b are the same syntax tree, ignoring positions,
+// comments, empty statements and how literals are written.
+func equal(a, b reflect.Value) bool {
+	if a.Kind() != b.Kind() {
+		return false
+	}
+	switch a.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if a.IsNil() || b.IsNil() {
+			return a.IsNil() == b.IsNil()
+		}
+		return a.Elem().Type() == b.Elem().Type() && equal(a.Elem(), b.Elem())
+	case reflect.Slice:
+		as, bs := elements(a), elements(b)
+		if len(as) != len(bs) {
+			return false
+		}
+		for i := range as {
+			if !equal(as[i], bs[i]) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			switch f := a.Type().Field(i); {
+			case f.Type == spanType, f.Type == attachedType, f.Type == commentType, f.Type == commentsType, f.Name == "Raw":
+			case !equal(a.Field(i), b.Field(i)):
+				return false
+			}
+		}
+		return true
+	}
+	return a.Interface() == b.Interface()
+}
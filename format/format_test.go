@@ -0,0 +1,65 @@
+package format
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/go-lua/ast"
+)
+
+func TestFormat(t *testing.T) {
+	tests := []struct{ source, formatted string }{
+		{"", ""},
+		{"local x=1;print( x )", "local x = 1\nprint(x)\n"},
+		{"x = 1; -- one\n\n\n-- two\ny = {a=1,\nb=2}", "x = 1 -- one\n\n-- two\ny = {\n\ta = 1,\n\tb = 2,\n}\n"},
+		{"#!/usr/bin/env lua\nreturn 1", "#!/usr/bin/env lua\nreturn 1\n"},
+		{"local f = function ( a , ... ) -- f\nreturn a end", "local f = function(a, ...) -- f\n\treturn a\nend\n"},
+		{"a = b\n;(f or g)()", "a = b\n;(f or g)()\n"},
+	}
+	for _, test := range tests {
+		got, err := Format([]byte(test.source))
+		if err != nil {
+			t.Errorf("%q: %v", test.source, err)
+		} else if string(got) != test.formatted {
+			t.Errorf("%q: got\n%s\nexpected\n%s", test.source, got, test.formatted)
+		} else if again, _ := Format(got); string(again) != string(got) {
+			t.Errorf("%q: formatting is not idempotent, got\n%s", test.source, again)
+		}
+	}
+}
+
+func TestFormatErrors(t *testing.T) {
+	for source, message := range map[string]string{
+		"x = = 1":              "1:5: unexpected symbol near '='",
+		"x = 'abc":             "1:5: unfinished string near <eof>",
+		"while x do end break": "1:16: <break> at line 1 not inside a loop",
+		"goto nowhere":         "1:1: no visible label 'nowhere' for <goto> at line 1",
+		"::a:: ::a::":          "1:7: label 'a' already defined on line 1",
+		"do goto l; local x = 1; ::l:: print(x) end": "1:25: <goto l> at line 1 jumps into the scope of local 'x'",
+	} {
+		if _, err := Format([]byte(source)); err == nil || err.Error() != message {
+			t.Errorf("%q: got %v, expected %s", source, err, message)
+		}
+	}
+}
+
+func TestEqual(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"x=1;;", "x = 1 -- one", true},
+		{"x = 0x10 .. 'a'", "x = 16 .. \"a\"", true},
+		{"x = 1 + 2 * 3", "x = (1 + 2) * 3", false},
+		{"return f(x), y", "return f(x, y)", false},
+		{"if a then end", "if a then else end", false},
+	}
+	for _, test := range tests {
+		a, _ := ast.Parse("", strings.NewReader(test.a))
+		b, _ := ast.Parse("", strings.NewReader(test.b))
+		if got := equal(reflect.ValueOf(a.Block), reflect.ValueOf(b.Block)); got != test.equal {
+			t.Errorf("equal(%q, %q) = %v", test.a, test.b, got)
+		}
+	}
+}
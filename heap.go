@@ -0,0 +1,392 @@
+package lua
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// A HeapObject is a table, function, userdata or thread in a HeapSnapshot.
+type HeapObject struct {
+	Type Type
+
+	// Size approximates the bytes used by the object itself, not counting
+	// the objects it references.
+	Size int
+
+	// Path is the shortest chain of references from a root to the object,
+	// such as globals.cache[3] or stack[0].t<metatable>.__index.
+	Path string
+
+	// References holds the indices in the snapshot of the objects the object
+	// refers to.
+	References []int
+}
+
+// A HeapSnapshot is the graph of the objects reachable from a State, sorted
+// by path.
+//
+// Paths start from the roots: globals for the global table, registry for the
+// registry, metatable(type) for the metatables of basic types, and stack for
+// the stack of the State. A path follows table fields with .name or [key],
+// and other references with <metatable>, <key> for a table key, <upvalue
+// name>, <uservalue> and <stack>. Keys that are objects are shown by type and
+// address, which differ between runs. A stack is followed with [level] for the
+// function at each call level, [level].name for its local variables, and
+// <slot n> for any value on it.
+//
+// A snapshot taken by TakeHeapSnapshot keeps its objects alive, so that Diff
+// can tell them apart from the objects created after it.
+type HeapSnapshot struct {
+	Objects []HeapObject
+	values  []value // the objects, in a snapshot taken rather than read
+}
+
+// A heapWalk visits the objects of a heap breadth first, so that each is
+// reached by its shortest path.
+type heapWalk struct {
+	objects []HeapObject
+	ids     map[value]int
+	queue   []value
+}
+
+func (w *heapWalk) visit(v value, path string) (int, bool) {
+	switch v.(type) {
+	case *table, *luaClosure, *goClosure, *userData, *State:
+	default:
+		return 0, false
+	}
+	if id, ok := w.ids[v]; ok {
+		return id, true
+	}
+	id := len(w.objects)
+	w.ids[v] = id
+	w.objects = append(w.objects, HeapObject{Type: objectType(v), Size: objectSize(v), Path: path})
+	w.queue = append(w.queue, v)
+	return id, true
+}
+
+type reference struct {
+	path string
+	v    value
+}
+
+// TakeHeapSnapshot walks the objects reachable from l's globals, registry,
+// basic type metatables and stack, and returns the graph they form.
+func TakeHeapSnapshot(l *State) *HeapSnapshot {
+	w := &heapWalk{ids: make(map[value]int)}
+	g := l.global
+	w.visit(g.registry.atInt(RegistryIndexGlobals), "globals")
+	w.visit(g.registry, "registry")
+	for t, mt := range g.metaTables {
+		if mt != nil {
+			w.visit(mt, "metatable("+Type(t).String()+")")
+		}
+	}
+	for _, r := range stackReferences(l, "stack") {
+		w.visit(r.v, r.path)
+	}
+	for i := 0; i < len(w.queue); i++ {
+		refs := references(w.queue[i], w.objects[i].Path)
+		sort.Slice(refs, func(a, b int) bool { return refs[a].path < refs[b].path })
+		for _, r := range refs {
+			if id, ok := w.visit(r.v, r.path); ok {
+				w.objects[i].References = append(w.objects[i].References, id)
+			}
+		}
+	}
+	return sortObjects(w.objects, w.queue)
+}
+
+// sortObjects returns a snapshot of objects sorted by path, renumbering their
+// references. values holds the objects themselves, if known.
+func sortObjects(objects []HeapObject, values []value) *HeapSnapshot {
+	order := make([]int, len(objects))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return objects[order[a]].Path < objects[order[b]].Path })
+	index := make([]int, len(objects))
+	for i, id := range order {
+		index[id] = i
+	}
+	s := &HeapSnapshot{Objects: make([]HeapObject, len(objects))}
+	if values != nil {
+		s.values = make([]value, len(values))
+	}
+	for i, id := range order {
+		o := objects[id]
+		for j, r := range o.References {
+			o.References[j] = index[r]
+		}
+		s.Objects[i] = o
+		if values != nil {
+			s.values[i] = values[id]
+		}
+	}
+	return s
+}
+
+func objectType(v value) Type {
+	switch v.(type) {
+	case *table:
+		return TypeTable
+	case *userData:
+		return TypeUserData
+	case *State:
+		return TypeThread
+	}
+	return TypeFunction
+}
+
+func objectSize(v value) int {
+	switch v := v.(type) {
+	case *table:
+		size := int(unsafe.Sizeof(*v)) + mapHeaderSize + cap(v.array)*valueSize + len(v.hash)*mapEntrySize
+		if v.weak != nil {
+			size += len(v.weak.entries) * mapEntrySize
+		}
+		return size
+	case *luaClosure:
+		return int(unsafe.Sizeof(*v)) + len(v.upValues)*int(unsafe.Sizeof(v))
+	case *goClosure:
+		return int(unsafe.Sizeof(*v)) + len(v.upValues)*valueSize
+	case *userData:
+		return int(unsafe.Sizeof(*v))
+	case *State:
+		return int(unsafe.Sizeof(*v)) + cap(v.stack)*valueSize
+	}
+	return 0
+}
+
+// references returns the values v refers to, with their paths.
+func references(v value, path string) (refs []reference) {
+	switch v := v.(type) {
+	case *table:
+		if v.metaTable != nil {
+			refs = append(refs, reference{path + "<metatable>", v.metaTable})
+		}
+		for i, x := range v.array {
+			if x != nil {
+				refs = append(refs, reference{path + "[" + strconv.Itoa(i+1) + "]", x})
+			}
+		}
+		for k, x := range v.hash {
+			p := fieldPath(path, k)
+			refs = append(refs, reference{p + "<key>", k}, reference{p, x})
+		}
+		if w := v.weak; w != nil { // weak keys and values aren't kept alive
+			for wk, wx := range w.entries {
+				if k, x := w.entry(wk, wx); k != nil && x != nil {
+					p := fieldPath(path, k)
+					if !w.keys {
+						refs = append(refs, reference{p + "<key>", k})
+					}
+					if !w.values {
+						refs = append(refs, reference{p, x})
+					}
+				}
+			}
+		}
+	case *luaClosure:
+		for i, uv := range v.prototype.upValues {
+			if v.upValues[i] != nil {
+				refs = append(refs, reference{path + "<upvalue " + uv.name + ">", v.upValue(i)})
+			}
+		}
+	case *goClosure:
+		for i, x := range v.upValues {
+			refs = append(refs, reference{path + "<upvalue " + strconv.Itoa(i+1) + ">", x})
+		}
+	case *userData:
+		if v.metaTable != nil {
+			refs = append(refs, reference{path + "<metatable>", v.metaTable})
+		}
+		if v.env != nil {
+			refs = append(refs, reference{path + "<uservalue>", v.env})
+		}
+	case *State:
+		refs = stackReferences(v, path+"<stack>")
+	}
+	return
+}
+
+// stackReferences returns the functions and locals of each call level of l,
+// then every value on its stack.
+func stackReferences(l *State, path string) (refs []reference) {
+	level := 0
+	for ci := l.callInfo; ci != &l.baseCallInfo; ci, level = ci.previous, level+1 {
+		frame := fmt.Sprintf("%s[%d]", path, level)
+		refs = append(refs, reference{frame, l.stack[ci.function]})
+		for n := 1; ; n++ {
+			name, index, ok := l.findLocal(ci, n)
+			if !ok {
+				break
+			} else if strings.HasPrefix(name, "(") {
+				name = fmt.Sprintf("<slot %d>", index)
+			} else {
+				name = "." + name
+			}
+			refs = append(refs, reference{frame + name, l.stack[index]})
+		}
+	}
+	for i := 0; i < l.top; i++ {
+		refs = append(refs, reference{fmt.Sprintf("%s<slot %d>", path, i), l.stack[i]})
+	}
+	return
+}
+
+func fieldPath(path string, k value) string {
+	switch k := k.(type) {
+	case string:
+		if isName(k) {
+			return path + "." + k
+		}
+		return path + "[" + strconv.Quote(k) + "]"
+	case float64:
+		return path + "[" + numberToString(k) + "]"
+	case bool:
+		return path + "[" + strconv.FormatBool(k) + "]"
+	}
+	return path + "[" + objectType(k).String() + fmt.Sprintf(" %p]", k)
+}
+
+func isName(s string) bool {
+	for i, c := range s {
+		if c != '_' && !('a' <= c && c <= 'z') && !('A' <= c && c <= 'Z') && (i == 0 || !('0' <= c && c <= '9')) {
+			return false
+		}
+	}
+	return s != "" && !isReserved(s)
+}
+
+// heapRecord is a HeapObject as written by HeapSnapshot.Write.
+type heapRecord struct {
+	Path       string   `json:"path"`
+	Type       string   `json:"type"`
+	Size       int      `json:"size"`
+	References []string `json:"references,omitempty"`
+}
+
+// Write writes s with one JSON object per line, holding an object's path,
+// type, size and the paths of the objects it references. As objects are
+// sorted by path, the files written for two snapshots can be compared with
+// a line based diff, as well as read back by ReadHeapSnapshot.
+func (s *HeapSnapshot) Write(w io.Writer) error {
+	b := bufio.NewWriter(w)
+	e := json.NewEncoder(b)
+	for _, o := range s.Objects {
+		r := heapRecord{Path: o.Path, Type: o.Type.String(), Size: o.Size}
+		for _, id := range o.References {
+			r.References = append(r.References, s.Objects[id].Path)
+		}
+		if err := e.Encode(r); err != nil {
+			return err
+		}
+	}
+	return b.Flush()
+}
+
+// ReadHeapSnapshot reads a snapshot written by HeapSnapshot.Write.
+func ReadHeapSnapshot(r io.Reader) (*HeapSnapshot, error) {
+	var records []heapRecord
+	d := json.NewDecoder(r)
+	for d.More() {
+		var rec heapRecord
+		if err := d.Decode(&rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	ids := make(map[string]int, len(records))
+	for i, rec := range records {
+		ids[rec.Path] = i
+	}
+	objects := make([]HeapObject, len(records))
+	for i, rec := range records {
+		o := HeapObject{Type: TypeNone, Size: rec.Size, Path: rec.Path}
+		for _, t := range []Type{TypeTable, TypeFunction, TypeUserData, TypeThread} {
+			if t.String() == rec.Type {
+				o.Type = t
+			}
+		}
+		for _, p := range rec.References {
+			id, ok := ids[p]
+			if !ok {
+				return nil, fmt.Errorf("reference to unknown object %s from %s", p, rec.Path)
+			}
+			o.References = append(o.References, id)
+		}
+		objects[i] = o
+	}
+	return sortObjects(objects, nil), nil
+}
+
+// A HeapChange is a difference between two snapshots for an object. An
+// object missing from one of the snapshots has a size of 0 in it.
+type HeapChange struct {
+	Path             string
+	OldPath          string // the path of the object in the old snapshot, if it moved
+	Type             Type
+	OldSize, NewSize int
+}
+
+// Diff returns the objects that are in only one of old and s, or whose size
+// or type differs between them, sorted by path. Objects are matched by
+// identity when both snapshots were taken by TakeHeapSnapshot, so that an
+// object that moved to another path is not reported unless it changed, and
+// by path otherwise. A change of type is reported with the new type.
+func (s *HeapSnapshot) Diff(old *HeapSnapshot) []HeapChange {
+	matched := make([]bool, len(old.Objects)) // whether each old object has a match in s
+	matches := make([]int, len(s.Objects))    // the index in old of each object, or -1
+	for i := range matches {
+		matches[i] = -1
+	}
+	if s.values != nil && old.values != nil {
+		ids := make(map[value]int, len(old.values))
+		for i, v := range old.values {
+			ids[v] = i
+		}
+		for i, v := range s.values {
+			if id, ok := ids[v]; ok {
+				matches[i], matched[id] = id, true
+			}
+		}
+	}
+	paths := make(map[string]int)
+	for i, o := range old.Objects {
+		if !matched[i] {
+			paths[o.Path] = i
+		}
+	}
+	for i, o := range s.Objects {
+		if id, ok := paths[o.Path]; ok && matches[i] < 0 {
+			matches[i], matched[id] = id, true
+			delete(paths, o.Path)
+		}
+	}
+	var changes []HeapChange
+	for i, o := range s.Objects {
+		if matches[i] < 0 {
+			changes = append(changes, HeapChange{Path: o.Path, Type: o.Type, NewSize: o.Size})
+		} else if b := old.Objects[matches[i]]; b.Type != o.Type || b.Size != o.Size {
+			c := HeapChange{Path: o.Path, Type: o.Type, OldSize: b.Size, NewSize: o.Size}
+			if b.Path != o.Path {
+				c.OldPath = b.Path
+			}
+			changes = append(changes, c)
+		}
+	}
+	for i, o := range old.Objects {
+		if !matched[i] {
+			changes = append(changes, HeapChange{Path: o.Path, Type: o.Type, OldSize: o.Size})
+		}
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
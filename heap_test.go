@@ -0,0 +1,89 @@
+package lua
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func heapObject(t *testing.T, s *HeapSnapshot, path string) HeapObject {
+	for _, o := range s.Objects {
+		if o.Path == path {
+			return o
+		}
+	}
+	t.Fatalf("no object at %s", path)
+	return HeapObject{}
+}
+
+func TestHeapSnapshot(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, `
+    local big = {}
+    for i = 1, 100 do big[i] = {} end
+    cache = {big = big, [true] = setmetatable({}, {__mode = "k"})}
+    function lookup(i) return big[i] end
+  `); err != nil {
+		t.Fatal(err)
+	}
+	l.NewTable()
+	l.SetField(RegistryIndex, "leak")
+	s := TakeHeapSnapshot(l)
+	big := heapObject(t, s, "globals.cache.big")
+	if big.Type != TypeTable || len(big.References) != 100 || s.Objects[big.References[99]].Path != "globals.cache.big[9]" {
+		t.Errorf("unexpected big table %+v", big)
+	}
+	if small := heapObject(t, s, "globals.cache.big[1]"); big.Size <= small.Size+100*valueSize {
+		t.Errorf("big table of %d bytes, small %d", big.Size, small.Size)
+	}
+	if f := heapObject(t, s, "globals.lookup"); f.Type != TypeFunction || len(f.References) != 1 || s.Objects[f.References[0]].Path != "globals.cache.big" {
+		t.Errorf("unexpected function %+v", f)
+	}
+	heapObject(t, s, "globals.cache[true]<metatable>")
+	heapObject(t, s, "registry.leak")
+	heapObject(t, s, "metatable(string)")
+
+	var b bytes.Buffer
+	if err := s.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	r, err := ReadHeapSnapshot(&b)
+	if err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(r.Objects, s.Objects) {
+		t.Error("snapshot changed by writing and reading it")
+	}
+
+	if err := DoString(l, "cache.big[1].grown = true; cache.big = nil; cache.more = {1, 2, 3}; cache[true] = {}"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []HeapChange{
+		{Path: "globals.cache.more", Type: TypeTable, NewSize: heapObject(t, TakeHeapSnapshot(l), "globals.cache.more").Size},
+		{Path: "globals.cache[true]<metatable>", Type: TypeTable, OldSize: heapObject(t, s, "globals.cache[true]<metatable>").Size},
+		{Path: "globals.lookup<upvalue big>[1]", OldPath: "globals.cache.big[1]", Type: TypeTable, OldSize: heapObject(t, s, "globals.cache.big[1]").Size, NewSize: heapObject(t, TakeHeapSnapshot(l), "globals.lookup<upvalue big>[1]").Size},
+	}
+	now := TakeHeapSnapshot(l)
+	if changes := now.Diff(s); !reflect.DeepEqual(changes, expected) {
+		t.Errorf("got changes %+v, expected %+v", changes, expected)
+	}
+
+	b.Reset()
+	if err := now.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+	read, err := ReadHeapSnapshot(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := 0 // read snapshots are matched by path, so the moved objects are removed and added
+	for _, c := range read.Diff(r) {
+		if strings.HasPrefix(c.Path, "globals.cache.big") && c.NewSize == 0 || strings.HasPrefix(c.Path, "globals.lookup<upvalue big>") && c.OldSize == 0 {
+			moved++
+		}
+	}
+	if moved != 202 {
+		t.Errorf("%d objects moved between read snapshots, expected 202", moved)
+	}
+}
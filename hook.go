@@ -0,0 +1,122 @@
+package lua
+
+// A debugHook is a hook function and the events it is called for.
+type debugHook struct {
+	f       Hook
+	mask    byte
+	count   int
+	left    int  // instructions until its next count event, with other hooks
+	primary bool // set by SetDebugHook rather than AddDebugHook
+}
+
+func (h *debugHook) counting() bool { return h.mask&MaskCount != 0 && h.count > 0 }
+
+// AddDebugHook adds f to the hooks of l, and returns a function removing it.
+// f is called for the events in mask, and every count instructions when mask
+// includes MaskCount, as explained for SetDebugHook.
+//
+// Any number of hooks can be added, each with its own mask and count. They
+// run along with each other and with the hook set by SetDebugHook, which is
+// called first, so that tools such as profilers, coverage collectors and
+// debuggers can run at the same time.
+func AddDebugHook(l *State, f Hook, mask byte, count int) (remove func()) {
+	h := &debugHook{f: f, mask: mask, count: count, left: count}
+	l.settleHookCounts()
+	l.hooks = append(l.hooks, h)
+	l.installHooks()
+	return func() { l.removeHook(h) }
+}
+
+func (l *State) removeHook(h *debugHook) {
+	for i, g := range l.hooks {
+		if g == h {
+			l.settleHookCounts()
+			l.hooks = append(l.hooks[:i:i], l.hooks[i+1:]...)
+			l.installHooks()
+			return
+		}
+	}
+}
+
+// primaryHook returns the hook set by SetDebugHook, or nil.
+func (l *State) primaryHook() *debugHook {
+	if len(l.hooks) > 0 && l.hooks[0].primary {
+		return l.hooks[0]
+	}
+	return nil
+}
+
+// settleHookCounts counts the instructions run since the last count event
+// against the hooks waiting for one.
+func (l *State) settleHookCounts() {
+	elapsed := l.baseHookCount - l.hookCount
+	for _, h := range l.hooks {
+		if h.counting() {
+			h.left -= elapsed
+		}
+	}
+}
+
+// installHooks sets the hook the VM calls: the only hook of l, or callHooks,
+// which calls each of them.
+func (l *State) installHooks() {
+	var mask byte
+	count := 0
+	switch len(l.hooks) {
+	case 0:
+		l.hooker = nil
+	case 1:
+		h := l.hooks[0]
+		l.hooker, mask, count = h.f, h.mask, h.count
+		h.left = h.count
+	default:
+		l.hooker = callHooks
+		for _, h := range l.hooks {
+			mask |= h.mask
+			if h.counting() && (count == 0 || h.left < count) {
+				count = h.left
+			}
+		}
+	}
+	l.hookMask = mask | l.hookMask&maskStats
+	l.baseHookCount = count
+	l.resetHookCount()
+}
+
+func eventMask(event int) byte {
+	switch event {
+	case HookCall, HookTailCall:
+		return MaskCall
+	case HookReturn:
+		return MaskReturn
+	case HookLine:
+		return MaskLine
+	}
+	return MaskCount
+}
+
+// callHooks is the hook of a State with several hooks. It calls those that
+// want the event, and keeps count of the instructions until each one's next
+// count event.
+func callHooks(l *State, ar Debug) {
+	mask := eventMask(ar.Event)
+	hooks := l.hooks
+	if mask == MaskCount {
+		for _, h := range hooks {
+			if h.counting() {
+				h.left -= l.baseHookCount
+			}
+		}
+	}
+	for _, h := range hooks {
+		if mask != MaskCount && h.mask&mask != 0 {
+			h.f(l, ar)
+		} else if mask == MaskCount && h.counting() && h.left <= 0 {
+			h.left = h.count
+			h.f(l, ar)
+		}
+	}
+	if mask == MaskCount {
+		l.installHooks()
+	}
+}
@@ -0,0 +1,256 @@
+package lua
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	laneMetaTable  = "go-lua.lane"
+	lindaMetaTable = "go-lua.linda"
+)
+
+// A Transferable is the Go value of a userdata that the lanes library can
+// copy to another State. Transfer returns the Go value of the copy. Values
+// safe for concurrent use, such as immutable ones, may return themselves.
+type Transferable interface {
+	Transfer() interface{}
+}
+
+// transfer returns a copier from the State from to the State to, which maps
+// the globals, the loaded modules and the values registered by name in from,
+// such as metatables, to those of to. Tables registered in from but not in to
+// are registered in to when copied. It raises errors in l for the values that
+// can't be transferred.
+func transfer(l, from, to *State) *copier {
+	c := newCopier(to)
+	c.check, c.names = l, make(map[*table]string)
+	seed := func(f, t *table, register bool) {
+		for k, v := range f.hash {
+			name, ok := k.(string)
+			if !ok {
+				continue
+			}
+			switch v := v.(type) {
+			case *table:
+				if w, ok := t.hash[k].(*table); ok {
+					c.values[v] = w
+				} else if register && t.hash[k] == nil {
+					c.names[v] = name
+				}
+			case *userData:
+				if w, ok := t.hash[k].(*userData); ok {
+					c.values[v] = w
+				}
+			}
+		}
+	}
+	registry, toRegistry := from.global.registry, to.global.registry
+	seed(registry, toRegistry, true)
+	if loaded, ok := registry.atString("_LOADED").(*table); ok {
+		if toLoaded, ok := toRegistry.atString("_LOADED").(*table); ok {
+			seed(loaded, toLoaded, false)
+		}
+	}
+	c.values[registry.atInt(RegistryIndexGlobals)] = toRegistry.atInt(RegistryIndexGlobals)
+	return c
+}
+
+// SetLaneSetup sets a function called to prepare the State of each lane
+// spawned by l, after it opened the standard libraries. It may register the
+// Go functions that lanes use. The States of lanes pass it on to the lanes
+// they spawn.
+func SetLaneSetup(l *State, f func(*State)) { l.global.laneSetup = f }
+
+func (l *State) newLaneState() *State {
+	n := l.newStateLike()
+	OpenLibraries(n)
+	Require(n, "lanes", LanesOpen, false)
+	n.Pop(1)
+	if f := l.global.laneSetup; f != nil {
+		f(n)
+	}
+	return n
+}
+
+type lane struct {
+	l      *State
+	done   context.Context // done when the lane returned
+	finish func()
+	err    error
+}
+
+type linda struct {
+	sync.Mutex
+	keeper  *State // maps the values in queues
+	queues  map[string][]value
+	arrival context.Context // done when a value is sent
+	arrived func()
+}
+
+func (d *linda) expect() { d.arrival, d.arrived = context.WithCancel(context.Background()) }
+
+func (d *linda) Transfer() interface{} { return d }
+
+func (e goError) Transfer() interface{} { return e }
+
+// timeout returns a channel receiving after the number of seconds at index,
+// or a nil channel if there is none.
+func timeout(l *State, index int) <-chan time.Time {
+	if l.IsNoneOrNil(index) {
+		return nil
+	}
+	return time.After(time.Duration(CheckNumber(l, index) * float64(time.Second)))
+}
+
+func spawn(l *State) int {
+	CheckType(l, 1, TypeFunction)
+	n := l.newLaneState()
+	c := transfer(l, l, n)
+	n.checkStack(l.Top())
+	for i, top := 1, l.Top(); i <= top; i++ {
+		n.push(c.copy(l.stack[l.callInfo.function+i]))
+	}
+	ln := &lane{l: n}
+	ln.done, ln.finish = context.WithCancel(context.Background())
+	go func() {
+		defer ln.finish()
+		ln.err = n.ProtectedCall(n.Top()-1, MultipleReturns, 0)
+	}()
+	l.PushUserData(ln)
+	MetaTableNamed(l, laneMetaTable)
+	l.SetMetaTable(-2)
+	return 1
+}
+
+func newLinda(l *State) int {
+	keeper := l.newStateLike()
+	OpenLibraries(keeper)
+	Require(keeper, "lanes", LanesOpen, false)
+	keeper.Pop(1)
+	d := &linda{keeper: keeper, queues: make(map[string][]value)}
+	d.expect()
+	l.PushUserData(d)
+	MetaTableNamed(l, lindaMetaTable)
+	l.SetMetaTable(-2)
+	return 1
+}
+
+var laneMethods = []RegistryFunction{
+	{"join", func(l *State) int {
+		ln := CheckUserData(l, 1, laneMetaTable).(*lane)
+		select {
+		case <-ln.done.Done():
+		case <-timeout(l, 2):
+			l.PushNil()
+			l.PushString("timeout")
+			return 2
+		}
+		l.PushBoolean(ln.err == nil)
+		n, c := ln.l, transfer(l, ln.l, l)
+		CheckStackWithMessage(l, n.Top(), "too many results")
+		for i := 0; i < n.Top(); i++ {
+			l.push(c.copy(n.stack[n.callInfo.function+1+i]))
+		}
+		return 1 + n.Top()
+	}},
+	{"status", func(l *State) int {
+		ln := CheckUserData(l, 1, laneMetaTable).(*lane)
+		select {
+		case <-ln.done.Done():
+			if ln.err != nil {
+				l.PushString("error")
+			} else {
+				l.PushString("done")
+			}
+		default:
+			l.PushString("running")
+		}
+		return 1
+	}},
+}
+
+var lindaMethods = []RegistryFunction{
+	{"send", func(l *State) int {
+		d := CheckUserData(l, 1, lindaMetaTable).(*linda)
+		key := CheckString(l, 2)
+		ArgumentCheck(l, !l.IsNoneOrNil(3), 3, "value expected")
+		d.Lock()
+		defer d.Unlock()
+		d.queues[key] = append(d.queues[key], transfer(l, l, d.keeper).copy(l.indexToValue(3)))
+		d.arrived()
+		d.expect()
+		l.PushBoolean(true)
+		return 1
+	}},
+	{"receive", func(l *State) int {
+		d := CheckUserData(l, 1, lindaMetaTable).(*linda)
+		key := CheckString(l, 2)
+		deadline := timeout(l, 3)
+		for {
+			d.Lock()
+			if q := d.queues[key]; len(q) > 0 {
+				defer d.Unlock()
+				l.apiPush(transfer(l, d.keeper, l).copy(q[0])) // the value stays queued if it can't be transferred
+				if d.queues[key] = q[1:]; len(q) == 1 {
+					delete(d.queues, key)
+				}
+				return 1
+			}
+			arrival := d.arrival
+			d.Unlock()
+			select {
+			case <-arrival.Done():
+			case <-deadline:
+				l.PushNil()
+				l.PushString("timeout")
+				return 2
+			}
+		}
+	}},
+}
+
+// LanesOpen opens the lanes library, which runs Lua functions in parallel.
+// It isn't opened by OpenLibraries; pass it to OpenLibraries as a preloaded
+// library, or to Require.
+//
+// lanes.spawn(f, ...) calls f with the given arguments in a lane: a new State
+// with the standard libraries, running on its own goroutine. It returns the
+// lane, whose join([timeout]) method waits for f to return and returns true
+// and its results, or false and the error it raised, or nil and "timeout"
+// after timeout seconds. The status method returns "running", "done" or
+// "error".
+//
+// lanes.linda() returns a linda, a set of queues shared by lanes. Its
+// send(key, value) method appends value to the queue named key, and its
+// receive(key [, timeout]) method removes and returns the first value of the
+// queue, waiting for one to be sent, or returns nil and "timeout" after
+// timeout seconds.
+//
+// Arguments, results and sent values are deep-copied between States, with
+// the globals, loaded modules and registered metatables of one State mapped
+// to those of the other. Lua functions share their compiled code. Userdata
+// are copied only if their Go value is a Transferable, as lindas and the
+// errors pushed by PushError are; threads are never copied.
+//
+//	local lanes = require("lanes")
+//	local results = lanes.linda()
+//	for _, url in ipairs(urls) do
+//	  lanes.spawn(function() results:send("pages", fetch(url)) end)
+//	end
+//	for _ = 1, #urls do print(results:receive("pages")) end
+func LanesOpen(l *State) int {
+	NewLibrary(l, []RegistryFunction{{"spawn", spawn}, {"linda", newLinda}})
+	for _, m := range []struct {
+		name    string
+		methods []RegistryFunction
+	}{{laneMetaTable, laneMethods}, {lindaMetaTable, lindaMethods}} {
+		NewMetaTable(l, m.name)
+		l.PushValue(-1)
+		l.SetField(-2, "__index")
+		SetFunctions(l, m.methods, 0)
+		l.Pop(1)
+	}
+	return 1
+}
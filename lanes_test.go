@@ -0,0 +1,91 @@
+package lua
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestLanes(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l, RegistryFunction{"lanes", LanesOpen})
+	SetLaneSetup(l, func(l *State) {
+		l.Register("square", func(l *State) int {
+			n := CheckNumber(l, 1)
+			l.PushNumber(n * n)
+			return 1
+		})
+		l.Register("newHandle", func(l *State) int {
+			l.PushUserData(struct{}{})
+			return 1
+		})
+		l.Register("newCounter", func(l *State) int {
+			l.PushUserData(&counter{})
+			return 1
+		})
+	})
+	l.PushUserData(struct{}{})
+	l.SetGlobal("handle")
+	PushError(l, errRateLimited)
+	l.SetGlobal("ErrRateLimited")
+	if err := DoString(l, `
+    local lanes = require("lanes")
+    local results = lanes.linda()
+    local offset = {by = 10}
+    local workers = {}
+    for i = 1, 4 do
+      workers[i] = lanes.spawn(function(n)
+        results:send("squares", {n = n, square = square(n) + offset.by})
+        return string.format("worker %d", n), offset
+      end, i)
+    end
+    local total = 0
+    for _ = 1, 4 do
+      local r = results:receive("squares", 5)
+      total = total + r.square
+    end
+    assert(total == 1 + 4 + 9 + 16 + 40, total)
+    local ok, name, copy = workers[2]:join()
+    assert(ok and name == "worker 2" and copy.by == 10 and copy ~= offset)
+    assert(workers[2]:status() == "done")
+
+    local v, err = results:receive("nothing", 0.01)
+    assert(v == nil and err == "timeout")
+    local blocked = lanes.spawn(function(d) return d:receive("go") end, results)
+    assert(blocked:join(0.01) == nil and blocked:status() == "running")
+    results:send("go", ErrRateLimited)
+    local ok, e = blocked:join()
+    assert(ok and tostring(e) == "rate limited" and e:is(ErrRateLimited))
+
+    local ok, same = lanes.spawn(function(s) return s == string end, string):join()
+    assert(ok and same)
+
+    local failed = lanes.spawn(function() error({code = 42}) end)
+    local ok, e = failed:join()
+    assert(not ok and e.code == 42 and failed:status() == "error")
+
+    assert(not pcall(results.send, results, "handle", handle))
+    assert(not pcall(lanes.spawn, print, handle))
+
+    local returned = lanes.spawn(function() return newHandle() end)
+    assert(not pcall(returned.join, returned))
+    counted = lanes.spawn(function() return newCounter() end)
+    ok, counted = counted:join()
+    assert(ok)
+  `); err != nil {
+		t.Fatal(err)
+	}
+	l.Global("counted")
+	if c, ok := l.ToUserData(-1).(*counter); !ok || c.transfers != 1 {
+		t.Errorf("expected a counter transferred once from the lane, got %#v", l.ToUserData(-1))
+	}
+	l.Pop(1)
+	var le *LuaError
+	if err := DoString(l, `require("lanes").linda():send("x", handle)`); !errors.As(err, &le) || !strings.HasSuffix(le.Message, ": cannot transfer a userdata") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+type counter struct{ transfers int }
+
+func (c *counter) Transfer() interface{} { return &counter{transfers: c.transfers + 1} }
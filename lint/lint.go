@@ -0,0 +1,442 @@
+// Package lint finds likely mistakes in Lua scripts before they run.
+//
+// Scripts are compiled with lua.Load, so syntax errors are reported exactly as
+// at run time, and then analyzed with the ast package. The checks are:
+//
+//	global-assign     assignment to a global the host does not provide
+//	undefined-global  read of a global that is neither standard, provided by
+//	                  the host, nor assigned anywhere in the chunk
+//	unused-local      local variable that is never read
+//	unused-param      function parameter that is never read
+//	shadow            local declaration hiding another local or parameter
+//	unreachable       statement after return, break or goto
+//	unimplemented     use of a standard library function that go-lua lacks
+//
+// Locals whose name starts with an underscore are never reported as unused,
+// and "_" is never reported as shadowing.
+package lint
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/Shopify/go-lua"
+	"github.com/Shopify/go-lua/ast"
+)
+
+// Config configures a Linter.
+type Config struct {
+	// Globals lists the globals the host defines beyond the standard
+	// libraries. Scripts may read and assign them.
+	Globals []string
+}
+
+// An Issue is a problem found in a chunk.
+type Issue struct {
+	Chunk   string
+	Pos     ast.Position
+	Check   string // the name of the check that found the issue
+	Message string
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s (%s)", i.Chunk, i.Pos.Line, i.Pos.Column, i.Message, i.Check)
+}
+
+// A Linter checks chunks against a configuration. It is safe for concurrent
+// use.
+type Linter struct {
+	globals       map[string]bool
+	unimplemented map[string]bool // "lib.name" or "name"
+}
+
+// standard lists the Lua 5.2 standard library by table, with "" for the
+// base library.
+var standard = map[string][]string{
+	"": {"_G", "_VERSION", "assert", "collectgarbage", "dofile", "error", "getmetatable", "ipairs", "load", "loadfile", "next",
+		"pairs", "pcall", "print", "rawequal", "rawget", "rawlen", "rawset", "require", "select", "setmetatable", "tonumber",
+		"tostring", "type", "xpcall"},
+	"bit32":     {"arshift", "band", "bnot", "bor", "btest", "bxor", "extract", "lrotate", "lshift", "replace", "rrotate", "rshift"},
+	"coroutine": {"create", "resume", "running", "status", "wrap", "yield"},
+	"debug": {"debug", "gethook", "getinfo", "getlocal", "getmetatable", "getregistry", "getupvalue", "getuservalue", "sethook",
+		"setlocal", "setmetatable", "setupvalue", "setuservalue", "traceback", "upvalueid", "upvaluejoin"},
+	"io": {"close", "flush", "input", "lines", "open", "output", "popen", "read", "stderr", "stdin", "stdout", "tmpfile", "type",
+		"write"},
+	"math": {"abs", "acos", "asin", "atan", "atan2", "ceil", "cos", "cosh", "deg", "exp", "floor", "fmod", "frexp", "huge", "ldexp",
+		"log", "max", "min", "modf", "pi", "pow", "rad", "random", "randomseed", "sin", "sinh", "sqrt", "tan", "tanh"},
+	"os":      {"clock", "date", "difftime", "execute", "exit", "getenv", "remove", "rename", "setlocale", "time", "tmpname"},
+	"package": {"config", "cpath", "loaded", "loadlib", "path", "preload", "searchers", "searchpath"},
+	"string": {"byte", "char", "dump", "find", "format", "gmatch", "gsub", "len", "lower", "match", "rep", "reverse", "sub",
+		"upper"},
+	"table": {"concat", "insert", "pack", "remove", "sort", "unpack"},
+}
+
+// New returns a Linter for c. The functions go-lua implements are found by
+// opening the standard libraries in a fresh State.
+func New(c Config) *Linter {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	has := func(lib, name string) bool {
+		if lib == "" {
+			l.Global(name)
+		} else if l.Global(lib); l.IsTable(-1) {
+			l.Field(-1, name)
+			l.Remove(-2)
+		}
+		defer l.Pop(1)
+		return !l.IsNil(-1)
+	}
+	lt := &Linter{globals: make(map[string]bool), unimplemented: make(map[string]bool)}
+	for lib, names := range standard {
+		if lib != "" {
+			lt.globals[lib] = true
+		}
+		for _, name := range names {
+			if lib == "" {
+				lt.globals[name] = true
+			}
+			if !has(lib, name) {
+				lt.unimplemented[qualified(lib, name)] = true
+			}
+		}
+	}
+	for _, g := range c.Globals {
+		lt.globals[g] = true
+	}
+	return lt
+}
+
+func qualified(lib, name string) string {
+	if lib == "" {
+		return name
+	}
+	return lib + "." + name
+}
+
+// Lint checks the chunk read from r. name is used in issues, and to name the
+// chunk for Load as a file would be. A chunk that does not compile is
+// reported as an error, with Load's message.
+func (lt *Linter) Lint(name string, r io.Reader) ([]Issue, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	l := lua.NewState()
+	if err := l.Load(bytes.NewReader(src), "@"+name, "t"); err != nil {
+		message, _ := l.ToString(-1)
+		return nil, errors.New(message)
+	}
+	chunk, err := ast.Parse(name, bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	c := &checker{Linter: lt, chunk: name, assigned: make(map[string]bool)}
+	c.collectAssigned(chunk.Block)
+	c.open()
+	c.block(chunk.Block)
+	c.close()
+	sort.SliceStable(c.issues, func(i, j int) bool {
+		a, b := c.issues[i].Pos, c.issues[j].Pos
+		return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+	})
+	return c.issues, nil
+}
+
+// A variable is a local or a parameter.
+type variable struct {
+	name     *ast.Name
+	param    bool
+	implicit bool // the self parameter of a method
+	used     bool
+	str      bool // initialized with a string
+}
+
+type scope struct {
+	parent *scope
+	vars   []*variable
+}
+
+type checker struct {
+	*Linter
+	chunk    string
+	assigned map[string]bool // globals assigned anywhere in the chunk
+	scope    *scope
+	issues   []Issue
+}
+
+// collectAssigned records the names assigned anywhere in b. Locals are not
+// resolved; a local that shares a global's name only hides an
+// undefined-global report.
+func (c *checker) collectAssigned(b *ast.Block) {
+	ast.Inspect(b, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Assign:
+			for _, t := range n.Targets {
+				if t, ok := t.(*ast.Name); ok {
+					c.assigned[t.Name] = true
+				}
+			}
+		case *ast.FunctionStmt:
+			if len(n.Name) == 1 {
+				c.assigned[n.Name[0].Name] = true
+			}
+		}
+		return true
+	})
+}
+
+func (c *checker) report(pos ast.Position, check, format string, args ...interface{}) {
+	c.issues = append(c.issues, Issue{Chunk: c.chunk, Pos: pos, Check: check, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *checker) open() { c.scope = &scope{parent: c.scope} }
+
+func (c *checker) close() {
+	for _, v := range c.scope.vars {
+		if v.used || v.implicit || strings.HasPrefix(v.name.Name, "_") {
+			continue
+		} else if v.param {
+			c.report(v.name.Start(), "unused-param", "unused parameter %s", v.name.Name)
+		} else {
+			c.report(v.name.Start(), "unused-local", "unused local %s", v.name.Name)
+		}
+	}
+	c.scope = c.scope.parent
+}
+
+func (c *checker) lookup(name string) *variable {
+	for s := c.scope; s != nil; s = s.parent {
+		for i := len(s.vars) - 1; i >= 0; i-- {
+			if v := s.vars[i]; v.name.Name == name {
+				return v
+			}
+		}
+	}
+	return nil
+}
+
+func (c *checker) declare(n *ast.Name, param bool) *variable {
+	v := &variable{name: n, param: param}
+	if old := c.lookup(n.Name); old != nil && n.Name != "_" {
+		kind := "local"
+		if old.param {
+			kind = "parameter"
+		}
+		c.report(n.Start(), "shadow", "%s shadows %s declared at line %d", n.Name, kind, old.name.Start().Line)
+	}
+	c.scope.vars = append(c.scope.vars, v)
+	return v
+}
+
+func (c *checker) read(n *ast.Name) {
+	if v := c.lookup(n.Name); v != nil {
+		v.used = true
+	} else if c.unimplemented[n.Name] {
+		c.report(n.Start(), "unimplemented", "%s is not implemented by go-lua", n.Name)
+	} else if !c.globals[n.Name] && !c.assigned[n.Name] {
+		c.report(n.Start(), "undefined-global", "undefined global %s", n.Name)
+	}
+}
+
+func (c *checker) assign(n *ast.Name) {
+	if c.lookup(n.Name) == nil && !c.globals[n.Name] {
+		c.report(n.Start(), "global-assign", "assignment to global %s", n.Name)
+	}
+}
+
+// terminates reports whether control never flows past s.
+func terminates(s ast.Stmt) bool {
+	switch s := s.(type) {
+	case *ast.Return, *ast.Break, *ast.Goto:
+		return true
+	case *ast.Do:
+		return blockTerminates(s.Body)
+	case *ast.If:
+		if s.Else == nil || !blockTerminates(s.Else) {
+			return false
+		}
+		for _, clause := range s.Clauses {
+			if !blockTerminates(clause.Body) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func blockTerminates(b *ast.Block) bool {
+	return len(b.Stmts) > 0 && terminates(b.Stmts[len(b.Stmts)-1])
+}
+
+func (c *checker) block(b *ast.Block) {
+	dead, reported := false, false
+	for _, s := range b.Stmts {
+		switch s.(type) {
+		case *ast.Label:
+			dead, reported = false, false // reachable by a goto
+		case *ast.Empty:
+		default:
+			if dead && !reported {
+				c.report(s.Start(), "unreachable", "unreachable code")
+				reported = true
+			}
+		}
+		c.statement(s)
+		dead = dead || terminates(s)
+	}
+}
+
+func (c *checker) statement(s ast.Stmt) {
+	switch s := s.(type) {
+	case *ast.Local:
+		c.expressions(s.Values)
+		for i, n := range s.Names {
+			v := c.declare(n, false)
+			v.str = i < len(s.Values) && c.isString(s.Values[i])
+		}
+	case *ast.LocalFunction:
+		c.declare(s.Name, false)
+		c.function(s.Func)
+	case *ast.Assign:
+		c.expressions(s.Values)
+		for _, t := range s.Targets {
+			if n, ok := t.(*ast.Name); ok {
+				c.assign(n)
+			} else {
+				c.expression(t)
+			}
+		}
+	case *ast.CallStmt:
+		c.expression(s.Call)
+	case *ast.Do:
+		c.scoped(s.Body)
+	case *ast.While:
+		c.expression(s.Cond)
+		c.scoped(s.Body)
+	case *ast.Repeat:
+		c.open()
+		c.block(s.Body)
+		c.expression(s.Cond)
+		c.close()
+	case *ast.If:
+		for _, clause := range s.Clauses {
+			c.expression(clause.Cond)
+			c.scoped(clause.Body)
+		}
+		if s.Else != nil {
+			c.scoped(s.Else)
+		}
+	case *ast.NumericFor:
+		c.expressions([]ast.Expr{s.Init, s.Limit})
+		if s.Step != nil {
+			c.expression(s.Step)
+		}
+		c.open()
+		c.declare(s.Var, false)
+		c.block(s.Body)
+		c.close()
+	case *ast.GenericFor:
+		c.expressions(s.Exprs)
+		c.open()
+		for _, n := range s.Names {
+			c.declare(n, false)
+		}
+		c.block(s.Body)
+		c.close()
+	case *ast.FunctionStmt:
+		if len(s.Name) == 1 {
+			if v := c.lookup(s.Name[0].Name); v == nil {
+				c.assign(s.Name[0])
+			}
+		} else {
+			c.read(s.Name[0])
+		}
+		c.function(s.Func)
+	case *ast.Return:
+		c.expressions(s.Values)
+	}
+}
+
+func (c *checker) scoped(b *ast.Block) {
+	c.open()
+	c.block(b)
+	c.close()
+}
+
+func (c *checker) function(f *ast.Function) {
+	c.open()
+	if f.Method {
+		c.scope.vars = append(c.scope.vars, &variable{name: &ast.Name{Span: f.Span, Name: "self"}, param: true, implicit: true})
+	}
+	for _, n := range f.Params {
+		c.declare(n, true)
+	}
+	c.block(f.Body)
+	c.close()
+}
+
+func (c *checker) expressions(es []ast.Expr) {
+	for _, e := range es {
+		c.expression(e)
+	}
+}
+
+func (c *checker) expression(e ast.Expr) {
+	switch e := e.(type) {
+	case *ast.Name:
+		c.read(e)
+	case *ast.Function:
+		c.function(e)
+	case *ast.Table:
+		for _, f := range e.Fields {
+			if f.Key != nil && !f.Named {
+				c.expression(f.Key)
+			}
+			c.expression(f.Value)
+		}
+	case *ast.Binary:
+		c.expression(e.X)
+		c.expression(e.Y)
+	case *ast.Unary:
+		c.expression(e.X)
+	case *ast.Paren:
+		c.expression(e.X)
+	case *ast.Index:
+		if lib, ok := e.X.(*ast.Name); ok && c.lookup(lib.Name) == nil {
+			if k, ok := e.Key.(*ast.String); ok && c.unimplemented[qualified(lib.Name, k.Value)] {
+				c.report(e.Start(), "unimplemented", "%s.%s is not implemented by go-lua", lib.Name, k.Value)
+				return
+			}
+		}
+		c.expression(e.X)
+		c.expression(e.Key)
+	case *ast.Call:
+		if c.unimplemented[qualified("string", e.Method)] && e.Method != "" && c.isString(e.Fn) {
+			c.report(e.Start(), "unimplemented", "string.%s is not implemented by go-lua", e.Method)
+		}
+		c.expression(e.Fn)
+		c.expressions(e.Args)
+	}
+}
+
+// isString reports whether e is known to be a string: a literal, a
+// concatenation, or a local initialized with one and never assigned.
+func (c *checker) isString(e ast.Expr) bool {
+	switch e := e.(type) {
+	case *ast.String:
+		return true
+	case *ast.Binary:
+		return e.Op == ".."
+	case *ast.Paren:
+		return c.isString(e.X)
+	case *ast.Name:
+		v := c.lookup(e.Name)
+		return v != nil && v.str && !c.assigned[e.Name]
+	}
+	return false
+}
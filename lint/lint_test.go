@@ -0,0 +1,71 @@
+package lint
+
+import (
+	"strings"
+	"testing"
+)
+
+func lint(t *testing.T, c Config, s string) []string {
+	issues, err := New(c).Lint("test.lua", strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r []string
+	for _, i := range issues {
+		r = append(r, i.String())
+	}
+	return r
+}
+
+func TestChecks(t *testing.T) {
+	tests := []struct {
+		source string
+		issues []string
+	}{
+		{"local x = 1\nprint(x)", nil},
+		{"count = 1", []string{"test.lua:1:1: assignment to global count (global-assign)"}},
+		{"function handler() end", []string{"test.lua:1:10: assignment to global handler (global-assign)"}},
+		{"print(undefined)", []string{"test.lua:1:7: undefined global undefined (undefined-global)"}},
+		{"print(request.path)", nil}, // a host global
+		{"x = 1\nprint(x)", []string{"test.lua:1:1: assignment to global x (global-assign)"}},
+		{"local x = 1", []string{"test.lua:1:7: unused local x (unused-local)"}},
+		{"local _x, _ = 1, 2", nil},
+		{"local x\nx = 1", []string{"test.lua:1:7: unused local x (unused-local)"}},
+		{"return function(a, b) return a end", []string{"test.lua:1:20: unused parameter b (unused-param)"}},
+		{"local t = {}\nfunction t:m() return 1 end\nreturn t", nil},
+		{"local x = 1\ndo local x = 2 print(x) end\nprint(x)", []string{"test.lua:2:10: x shadows local declared at line 1 (shadow)"}},
+		{"return function(a) local a = 1 return a end", []string{
+			"test.lua:1:17: unused parameter a (unused-param)",
+			"test.lua:1:26: a shadows parameter declared at line 1 (shadow)",
+		}},
+		{"for _, v in ipairs({}) do for _, w in ipairs(v) do print(w) end end", nil},
+		{"do return end\nprint(1)", []string{"test.lua:2:1: unreachable code (unreachable)"}},
+		{"while true do break print(1) print(2) end", []string{"test.lua:1:21: unreachable code (unreachable)"}},
+		{"goto done\nprint(1)\n::done::\nprint(2)", []string{"test.lua:2:1: unreachable code (unreachable)"}},
+		{"local x = ...\nif x then return 1 else return 2 end\nprint(x)", []string{"test.lua:3:1: unreachable code (unreachable)"}},
+		{`return string.gsub("a", "a", "b")`, []string{"test.lua:1:8: string.gsub is not implemented by go-lua (unimplemented)"}},
+		{`local s = "a" .. ... return s:match("a"), s:upper()`, []string{"test.lua:1:29: string.match is not implemented by go-lua (unimplemented)"}},
+		{`return ("a"):gsub("a", "b")`, []string{"test.lua:1:8: string.gsub is not implemented by go-lua (unimplemented)"}},
+		{`local obj = {gsub = print} return obj:gsub(2)`, nil},
+		{`local s = "a" s = {gsub = print} return s:gsub(2)`, nil},
+		{`local string = {gsub = print} return string.gsub`, nil},
+		{"return coroutine.wrap", []string{"test.lua:1:8: coroutine.wrap is not implemented by go-lua (unimplemented)"}},
+	}
+	c := Config{Globals: []string{"request"}}
+	for _, test := range tests {
+		if got := lint(t, c, test.source); strings.Join(got, "\n") != strings.Join(test.issues, "\n") {
+			t.Errorf("%q: got\n%s\nexpected\n%s", test.source, strings.Join(got, "\n"), strings.Join(test.issues, "\n"))
+		}
+	}
+}
+
+func TestSyntaxError(t *testing.T) {
+	_, err := New(Config{}).Lint("test.lua", strings.NewReader("x = = 1"))
+	if err == nil || err.Error() != "test.lua:1: unexpected symbol near =" {
+		t.Errorf("unexpected error %v", err)
+	}
+	_, err = New(Config{}).Lint("test.lua", strings.NewReader("goto nowhere"))
+	if err == nil || !strings.Contains(err.Error(), "nowhere") {
+		t.Errorf("expected an error for a missing label, got %v", err)
+	}
+}
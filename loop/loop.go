@@ -0,0 +1,338 @@
+// Package loop runs many Lua threads of a go-lua State concurrently, as an
+// event loop resuming them with lua.Resume. A thread runs until it waits for
+// Go work, such as a timer or a network call, which lets the other threads
+// run, and is resumed with the results once the work is done. Lua code waits
+// with straight-line code, as if it blocked:
+//
+//	local loop = require("loop")
+//	for i = 1, 3 do
+//	  loop.spawn(function()
+//	    loop.sleep(0.1 * i)
+//	    print(fetch("/page/" .. i))
+//	  end)
+//	end
+//
+// Go functions wait by calling Await:
+//
+//	l.Register("fetch", func(l *lua.State) int {
+//	  url := lua.CheckString(l, 1)
+//	  var body string
+//	  loop.Await(l, func() { body = get(url) })
+//	  l.PushString(body)
+//	  return 1
+//	})
+//	lp := loop.New(l)
+//	if err := lua.LoadFile(l, "flow.lua", ""); err != nil {
+//	  return err
+//	}
+//	lp.Spawn(0)
+//	return lp.Run()
+//
+// The loop library provides:
+//
+//	loop.spawn(f, ...)       calls f with the given arguments in a new thread
+//	loop.sleep(seconds)      suspends the calling thread
+//	loop.timer(seconds, f)   calls f in a new thread after seconds, unless the
+//	                         stop method of the timer it returns is called
+//	channel:receive([timeout])
+//	                         receives a value from a Go channel pushed by
+//	                         PushChannel, or returns nil and "closed" or
+//	                         "timeout"
+package loop
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/Shopify/go-lua"
+)
+
+const (
+	registryKey      = "go-lua.loop"
+	timerMetaTable   = "go-lua.loop.timer"
+	channelMetaTable = "go-lua.loop.channel"
+)
+
+type thread struct {
+	l        *lua.State
+	argCount int // of the function to start it with, if not started
+}
+
+// A Loop runs the threads of a State.
+type Loop struct {
+	l         *lua.State
+	ready     []*thread
+	waiting   int                  // threads waiting for Go work or a timer
+	suspended map[*thread]struct{} // threads waiting in Await, or ready to continue
+	wake      chan *thread         // receives the threads whose wait is over, or nil
+	stopped   chan struct{}        // closed when RunContext is canceled
+	errs      []error
+}
+
+// New returns a Loop running threads of l, and opens the loop library in l,
+// for scripts to require.
+func New(l *lua.State) *Loop {
+	lp := &Loop{l: l, suspended: make(map[*thread]struct{}), wake: make(chan *thread), stopped: make(chan struct{})}
+	l.PushUserData(lp)
+	l.SetField(lua.RegistryIndex, registryKey)
+	lua.Require(l, "loop", open, false)
+	l.Pop(1)
+	return lp
+}
+
+func loopOf(l *lua.State) *Loop {
+	l.Field(lua.RegistryIndex, registryKey)
+	lp, _ := l.ToUserData(-1).(*Loop)
+	l.Pop(1)
+	return lp
+}
+
+// Spawn pops a function and argCount arguments from the stack of the State
+// of lp, and calls the function with them in a new thread once Run runs.
+func (lp *Loop) Spawn(argCount int) { lp.spawn(lp.l, argCount, nil) }
+
+// spawn moves the function and arguments on top of the stack of l to a new
+// thread, which is ready to run once start, if not nil, returns true.
+func (lp *Loop) spawn(l *lua.State, argCount int, start func() bool) {
+	t := &thread{l: l.NewThread(), argCount: argCount}
+	l.Insert(-(argCount + 2))
+	l.XMove(t.l, argCount+1)
+	l.Pop(1)
+	if start == nil {
+		lp.ready = append(lp.ready, t)
+		return
+	}
+	lp.waiting++
+	go func() {
+		if !start() {
+			t = nil
+		}
+		lp.wakeUp(t)
+	}()
+}
+
+// wakeUp sends t to Run, unless the loop was stopped.
+func (lp *Loop) wakeUp(t *thread) {
+	select {
+	case lp.wake <- t:
+	case <-lp.stopped:
+	}
+}
+
+// Run runs the threads spawned, and those they spawn, until they all
+// returned. It returns the errors they raised, joined.
+func (lp *Loop) Run() error { return lp.RunContext(context.Background()) }
+
+// RunContext is like Run, but stops when ctx is done. It then cancels the
+// threads waiting for Go work, as lua.State.Cancel does, and the pending
+// timers, and returns the error of ctx joined with those the threads raised.
+// The sleeps, timers and channel receives of the library return at once, but
+// RunContext waits for the other Go work of the canceled threads to return.
+// The Loop can't be run again once it stopped.
+func (lp *Loop) RunContext(ctx context.Context) error {
+	for len(lp.ready) > 0 || lp.waiting > 0 {
+		if ctx.Err() != nil {
+			lp.stop()
+			lp.errs = append(lp.errs, ctx.Err())
+			break
+		}
+		if len(lp.ready) == 0 {
+			select {
+			case t := <-lp.wake:
+				if t != nil {
+					lp.ready = append(lp.ready, t)
+				}
+				lp.waiting--
+			case <-ctx.Done():
+			}
+			continue
+		}
+		t := lp.ready[0]
+		lp.ready = lp.ready[1:]
+		ready, err := t.l.Resume(t.argCount)
+		t.argCount = 0
+		if err != nil {
+			lp.errs = append(lp.errs, err)
+		}
+		if ready == nil {
+			delete(lp.suspended, t)
+			continue
+		}
+		lp.suspended[t] = struct{}{}
+		lp.waiting++
+		go func() {
+			<-ready
+			lp.wakeUp(t)
+		}()
+	}
+	err := errors.Join(lp.errs...)
+	lp.errs = nil
+	return err
+}
+
+// stop cancels the timers of lp, and its threads once the Go work they wait
+// for is done.
+func (lp *Loop) stop() {
+	close(lp.stopped)
+	for t := range lp.suspended {
+		t.l.Cancel()
+	}
+	lp.ready, lp.waiting = nil, 0
+	clear(lp.suspended)
+}
+
+// Await calls lua.Await, letting the other threads of the loop run until f
+// returns. It is called by Go functions running in a thread of a loop, and f
+// must not use the State. Outside of a loop, Await just calls f.
+func Await(l *lua.State, f func()) { lua.Await(l, f) }
+
+// PushChannel pushes a userdata whose receive method receives from ch, which
+// must be a channel. Received values are converted as follows: nil, booleans,
+// strings, byte slices and numbers to the Lua values they represent, errors
+// as by lua.PushError, Go functions of type lua.Function to functions, and
+// other values to userdata.
+func PushChannel(l *lua.State, ch interface{}) {
+	v := reflect.ValueOf(ch)
+	if v.Kind() != reflect.Chan {
+		panic("loop: PushChannel of a " + v.Kind().String())
+	}
+	l.PushUserData(v)
+	metaTable(l, channelMetaTable, channelMethods)
+	l.SetMetaTable(-2)
+}
+
+func push(l *lua.State, x interface{}) {
+	switch x := x.(type) {
+	case nil:
+		l.PushNil()
+	case bool:
+		l.PushBoolean(x)
+	case string:
+		l.PushString(x)
+	case []byte:
+		l.PushString(string(x))
+	case error:
+		lua.PushError(l, x)
+	case lua.Function:
+		l.PushGoFunction(x)
+	default:
+		switch v := reflect.ValueOf(x); v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			l.PushNumber(float64(v.Int()))
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			l.PushNumber(float64(v.Uint()))
+		case reflect.Float32, reflect.Float64:
+			l.PushNumber(v.Float())
+		default:
+			l.PushUserData(x)
+		}
+	}
+}
+
+type timer struct {
+	stop chan struct{}
+	once sync.Once
+}
+
+func duration(l *lua.State, index int) time.Duration {
+	return time.Duration(lua.CheckNumber(l, index) * float64(time.Second))
+}
+
+var library = []lua.RegistryFunction{
+	{Name: "spawn", Function: func(l *lua.State) int {
+		lua.CheckType(l, 1, lua.TypeFunction)
+		loopOf(l).spawn(l, l.Top()-1, nil)
+		return 0
+	}},
+	{Name: "sleep", Function: func(l *lua.State) int {
+		d := duration(l, 1)
+		stopped := loopOf(l).stopped
+		Await(l, func() {
+			select {
+			case <-time.After(d):
+			case <-stopped:
+			}
+		})
+		return 0
+	}},
+	{Name: "timer", Function: func(l *lua.State) int {
+		d := duration(l, 1)
+		lua.CheckType(l, 2, lua.TypeFunction)
+		t := &timer{stop: make(chan struct{})}
+		l.SetTop(2)
+		lp := loopOf(l)
+		lp.spawn(l, 0, func() bool {
+			select {
+			case <-time.After(d):
+				return true
+			case <-t.stop:
+			case <-lp.stopped:
+			}
+			return false
+		})
+		l.PushUserData(t)
+		metaTable(l, timerMetaTable, timerMethods)
+		l.SetMetaTable(-2)
+		return 1
+	}},
+}
+
+var timerMethods = []lua.RegistryFunction{
+	{Name: "stop", Function: func(l *lua.State) int {
+		t := lua.CheckUserData(l, 1, timerMetaTable).(*timer)
+		stopped := false
+		t.once.Do(func() {
+			close(t.stop)
+			stopped = true
+		})
+		l.PushBoolean(stopped)
+		return 1
+	}},
+}
+
+var channelMethods = []lua.RegistryFunction{
+	{Name: "receive", Function: func(l *lua.State) int {
+		ch := lua.CheckUserData(l, 1, channelMetaTable).(reflect.Value)
+		cases := []reflect.SelectCase{{Dir: reflect.SelectRecv, Chan: ch}, {Dir: reflect.SelectRecv}}
+		if !l.IsNoneOrNil(2) {
+			cases[1].Chan = reflect.ValueOf(time.After(duration(l, 2)))
+		}
+		if lp := loopOf(l); lp != nil {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(lp.stopped)})
+		}
+		var chosen int
+		var v reflect.Value
+		var ok bool
+		Await(l, func() { chosen, v, ok = reflect.Select(cases) })
+		switch {
+		case chosen == 1:
+			l.PushNil()
+			l.PushString("timeout")
+			return 2
+		case !ok:
+			l.PushNil()
+			l.PushString("closed")
+			return 2
+		}
+		push(l, v.Interface())
+		return 1
+	}},
+}
+
+// metaTable pushes the metatable registered as name, registering one with
+// the given methods if there is none yet.
+func metaTable(l *lua.State, name string, methods []lua.RegistryFunction) {
+	if lua.NewMetaTable(l, name) {
+		l.PushValue(-1)
+		l.SetField(-2, "__index")
+		lua.SetFunctions(l, methods, 0)
+	}
+}
+
+func open(l *lua.State) int {
+	lua.NewLibrary(l, library)
+	return 1
+}
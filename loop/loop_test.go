@@ -0,0 +1,115 @@
+package loop
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/go-lua"
+)
+
+func TestLoop(t *testing.T) {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	var order []string
+	l.Register("log", func(l *lua.State) int {
+		order = append(order, lua.CheckString(l, 1))
+		return 0
+	})
+	l.Register("fetch", func(l *lua.State) int {
+		url := lua.CheckString(l, 1)
+		var body string
+		Await(l, func() {
+			time.Sleep(20 * time.Millisecond)
+			body = "<" + url + ">"
+		})
+		l.PushString(body)
+		return 1
+	})
+	ch := make(chan interface{}, 1)
+	PushChannel(l, ch)
+	l.SetGlobal("events")
+	lp := New(l)
+	if err := lua.LoadString(l, `
+    local loop = require("loop")
+    local start = os.clock()
+    for i = 1, 50 do
+      loop.spawn(function(n)
+        local body = fetch("/" .. n)
+        assert(body == "</" .. n .. ">", body)
+        if n == 50 then log("fetched") end
+      end, i)
+    end
+    loop.timer(0.01, function() log("timer") end)
+    loop.timer(0.01, function() log("stopped") end):stop()
+    loop.sleep(0.03)
+    log("slept")
+    local v, err = events:receive(0.01)
+    assert(v == nil and err == "timeout")
+    log("waiting")
+    assert(events:receive() == 42)
+    assert(select(2, events:receive()) == "closed")
+    error("done")
+  `); err != nil {
+		t.Fatal(err)
+	}
+	lp.Spawn(0)
+	l.PushString("go")
+	l.PushGoFunction(func(l *lua.State) int {
+		Await(l, func() {
+			time.Sleep(60 * time.Millisecond)
+			ch <- 42
+			close(ch)
+		})
+		return 0
+	})
+	l.Insert(-2)
+	lp.Spawn(1)
+	start := time.Now()
+	err := lp.Run()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("ran for %v, the threads did not run concurrently", elapsed)
+	}
+	var le *lua.LuaError
+	if !errors.As(err, &le) || !strings.HasSuffix(le.Message, ": done") {
+		t.Errorf("unexpected error %v", err)
+	}
+	if got := strings.Join(order, " "); got != "timer fetched slept waiting" {
+		t.Errorf("ran %s", got)
+	}
+	if l.Top() != 0 {
+		t.Errorf("%d values left on the stack", l.Top())
+	}
+}
+
+func TestRunContext(t *testing.T) {
+	goroutines := runtime.NumGoroutine()
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	lp := New(l)
+	if err := lua.LoadString(l, `
+    local loop = require("loop")
+    for i = 1, 10 do loop.spawn(loop.sleep, 0.05) end
+    loop.timer(60, function() end)
+    loop.sleep(60)
+  `); err != nil {
+		t.Fatal(err)
+	}
+	lp.Spawn(0)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := lp.RunContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("unexpected error %v", err)
+	} else if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("stopped after %v", elapsed)
+	}
+	for start := time.Now(); runtime.NumGoroutine() > goroutines; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("%d goroutines left running, %d before", runtime.NumGoroutine(), goroutines)
+		}
+	}
+}
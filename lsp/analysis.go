@@ -0,0 +1,367 @@
+package lsp
+
+import (
+	"net/url"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/Shopify/go-lua"
+	"github.com/Shopify/go-lua/ast"
+)
+
+// A document is an open text document and what is known about it.
+type document struct {
+	uri         string
+	lines       []string
+	chunk       *ast.Chunk // nil when the text does not parse
+	res         *resolution
+	diagnostics []diagnostic
+}
+
+// chunkName returns the name Load would be given for the document by DoFile.
+func chunkName(uri string) string {
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		return u.Path
+	}
+	return uri
+}
+
+func newDocument(uri, text string) *document {
+	d := &document{uri: uri, lines: strings.Split(text, "\n"), diagnostics: []diagnostic{}}
+	l := lua.NewState()
+	if err := l.Load(strings.NewReader(text), "@"+chunkName(uri), "t"); err != nil {
+		message, _ := l.ToString(-1)
+		from := ast.Position{Line: 1, Column: 1}
+		if e, ok := err.(*lua.CompileError); ok && e.Line > 0 {
+			from = ast.Position{Line: e.Line, Column: e.Column}
+		}
+		line := from.Line
+		to := ast.Position{Line: line, Column: len(d.line(line)) + 1}
+		d.diagnostics = append(d.diagnostics, diagnostic{
+			Range:    d.toRange(ast.Span{From: from, To: to}),
+			Severity: 1,
+			Source:   "go-lua",
+			Message:  message,
+		})
+	}
+	if chunk, err := ast.Parse(chunkName(uri), strings.NewReader(text)); err == nil {
+		d.chunk, d.res = chunk, resolve(chunk)
+	}
+	return d
+}
+
+func (d *document) line(n int) string {
+	if n < 1 || n > len(d.lines) {
+		return ""
+	}
+	return strings.TrimSuffix(d.lines[n-1], "\r")
+}
+
+// toPosition converts a byte column to a UTF-16 one, as LSP counts them.
+func (d *document) toPosition(p ast.Position) position {
+	line := d.line(p.Line)
+	column := p.Column - 1
+	if column > len(line) {
+		column = len(line)
+	} else if column < 0 {
+		column = 0
+	}
+	n := 0
+	for _, r := range line[:column] {
+		n += len(utf16.Encode([]rune{r}))
+	}
+	return position{Line: p.Line - 1, Character: n}
+}
+
+func (d *document) fromPosition(p position) ast.Position {
+	line, n := d.line(p.Line+1), 0
+	for i, r := range line {
+		if n >= p.Character {
+			return ast.Position{Line: p.Line + 1, Column: i + 1}
+		}
+		if r == utf8.RuneError {
+			n++
+		} else {
+			n += len(utf16.Encode([]rune{r}))
+		}
+	}
+	return ast.Position{Line: p.Line + 1, Column: len(line) + 1}
+}
+
+func (d *document) toRange(s ast.Span) rangeLSP {
+	return rangeLSP{Start: d.toPosition(s.From), End: d.toPosition(s.To)}
+}
+
+func before(a, b ast.Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+func contains(n ast.Node, p ast.Position) bool {
+	return !before(p, n.Start()) && (before(p, n.End()) || p == n.End())
+}
+
+// nameAt returns the innermost name or dotted field at p, and the expression
+// indexed by the field.
+func (d *document) nameAt(p ast.Position) (name *ast.Name, field *ast.String, of ast.Expr) {
+	ast.Inspect(d.chunk, func(n ast.Node) bool {
+		if !contains(n, p) {
+			return false
+		}
+		switch n := n.(type) {
+		case *ast.Name:
+			name, field = n, nil
+		case *ast.Index:
+			if k, ok := n.Key.(*ast.String); ok && n.Dot && contains(k, p) {
+				name, field, of = nil, k, n.X
+			}
+		}
+		return true
+	})
+	return
+}
+
+// A binding is a local variable and the part of the source where it is
+// visible.
+type binding struct {
+	decl    *ast.Name
+	param   bool
+	visible ast.Span
+}
+
+// A resolution maps the names in a chunk to the local variables they refer
+// to. Names that are not in the map are globals.
+type resolution struct {
+	refs     map[*ast.Name]*binding
+	bindings []*binding
+}
+
+type resolver struct {
+	*resolution
+	scopes [][]*binding
+	ends   []ast.Position
+}
+
+func resolve(c *ast.Chunk) *resolution {
+	r := &resolver{resolution: &resolution{refs: make(map[*ast.Name]*binding)}}
+	r.open(c.Block.To)
+	r.block(c.Block)
+	r.close()
+	return r.resolution
+}
+
+func (r *resolver) open(end ast.Position) {
+	r.scopes, r.ends = append(r.scopes, nil), append(r.ends, end)
+}
+
+func (r *resolver) close() {
+	r.scopes, r.ends = r.scopes[:len(r.scopes)-1], r.ends[:len(r.ends)-1]
+}
+
+func (r *resolver) declare(n *ast.Name, param bool, from ast.Position) {
+	b := &binding{decl: n, param: param, visible: ast.Span{From: from, To: r.ends[len(r.ends)-1]}}
+	r.scopes[len(r.scopes)-1] = append(r.scopes[len(r.scopes)-1], b)
+	r.bindings = append(r.bindings, b)
+	r.refs[n] = b
+}
+
+func (r *resolver) use(n *ast.Name) {
+	for i := len(r.scopes) - 1; i >= 0; i-- {
+		for j := len(r.scopes[i]) - 1; j >= 0; j-- {
+			if b := r.scopes[i][j]; b.decl.Name == n.Name {
+				r.refs[n] = b
+				return
+			}
+		}
+	}
+}
+
+func (r *resolver) scoped(b *ast.Block, end ast.Position) {
+	r.open(end)
+	r.block(b)
+	r.close()
+}
+
+func (r *resolver) block(b *ast.Block) {
+	for _, s := range b.Stmts {
+		r.statement(s)
+	}
+}
+
+func (r *resolver) statement(s ast.Stmt) {
+	switch s := s.(type) {
+	case *ast.Local:
+		r.expressions(s.Values)
+		for _, n := range s.Names {
+			r.declare(n, false, s.End())
+		}
+	case *ast.LocalFunction:
+		r.declare(s.Name, false, s.Name.End())
+		r.function(s.Func)
+	case *ast.Assign:
+		r.expressions(s.Values)
+		r.expressions(s.Targets)
+	case *ast.CallStmt:
+		r.expression(s.Call)
+	case *ast.Do:
+		r.scoped(s.Body, s.End())
+	case *ast.While:
+		r.expression(s.Cond)
+		r.scoped(s.Body, s.End())
+	case *ast.Repeat:
+		r.open(s.End())
+		r.block(s.Body)
+		r.expression(s.Cond)
+		r.close()
+	case *ast.If:
+		for _, c := range s.Clauses {
+			r.expression(c.Cond)
+			r.scoped(c.Body, c.End())
+		}
+		if s.Else != nil {
+			r.scoped(s.Else, s.End())
+		}
+	case *ast.NumericFor:
+		r.expressions([]ast.Expr{s.Init, s.Limit})
+		if s.Step != nil {
+			r.expression(s.Step)
+		}
+		r.open(s.End())
+		r.declare(s.Var, false, s.Body.From)
+		r.block(s.Body)
+		r.close()
+	case *ast.GenericFor:
+		r.expressions(s.Exprs)
+		r.open(s.End())
+		for _, n := range s.Names {
+			r.declare(n, false, s.Body.From)
+		}
+		r.block(s.Body)
+		r.close()
+	case *ast.FunctionStmt:
+		r.use(s.Name[0])
+		r.function(s.Func)
+	case *ast.Return:
+		r.expressions(s.Values)
+	}
+}
+
+func (r *resolver) function(f *ast.Function) {
+	r.open(f.End())
+	for _, n := range f.Params {
+		r.declare(n, true, f.Body.From)
+	}
+	r.block(f.Body)
+	r.close()
+}
+
+func (r *resolver) expressions(es []ast.Expr) {
+	for _, e := range es {
+		r.expression(e)
+	}
+}
+
+func (r *resolver) expression(e ast.Expr) {
+	switch e := e.(type) {
+	case *ast.Name:
+		r.use(e)
+	case *ast.Function:
+		r.function(e)
+	case *ast.Table:
+		for _, f := range e.Fields {
+			if f.Key != nil && !f.Named {
+				r.expression(f.Key)
+			}
+			r.expression(f.Value)
+		}
+	case *ast.Binary:
+		r.expression(e.X)
+		r.expression(e.Y)
+	case *ast.Unary:
+		r.expression(e.X)
+	case *ast.Paren:
+		r.expression(e.X)
+	case *ast.Index:
+		r.expression(e.X)
+		if !e.Dot {
+			r.expression(e.Key)
+		}
+	case *ast.Call:
+		r.expression(e.Fn)
+		r.expressions(e.Args)
+	}
+}
+
+// symbols returns the functions and variables declared in b, with the
+// declarations inside functions as children.
+func (d *document) symbols(b *ast.Block, top bool) []documentSymbol {
+	symbols := []documentSymbol{}
+	add := func(name string, kind int, node, selection ast.Node, f *ast.Function) {
+		s := documentSymbol{
+			Name:           name,
+			Kind:           kind,
+			Range:          d.toRange(ast.Span{From: node.Start(), To: node.End()}),
+			SelectionRange: d.toRange(ast.Span{From: selection.Start(), To: selection.End()}),
+		}
+		if f != nil {
+			s.Detail = "function" + signature(f)
+			s.Children = d.symbols(f.Body, false)
+		}
+		symbols = append(symbols, s)
+	}
+	for _, s := range b.Stmts {
+		switch s := s.(type) {
+		case *ast.FunctionStmt:
+			names := make([]string, len(s.Name))
+			for i, n := range s.Name {
+				names[i] = n.Name
+			}
+			name, kind := strings.Join(names, "."), symbolFunction
+			if s.Func.Method {
+				name = strings.Join(names[:len(names)-1], ".") + ":" + names[len(names)-1]
+				kind = symbolMethod
+			}
+			add(name, kind, s, ast.Span{From: s.Name[0].From, To: s.Name[len(s.Name)-1].To}, s.Func)
+		case *ast.LocalFunction:
+			add(s.Name.Name, symbolFunction, s, s.Name, s.Func)
+		case *ast.Local:
+			for i, n := range s.Names {
+				if i < len(s.Values) {
+					if f, ok := s.Values[i].(*ast.Function); ok {
+						add(n.Name, symbolFunction, s, n, f)
+						continue
+					}
+				}
+				if top {
+					add(n.Name, symbolVariable, s, n, nil)
+				}
+			}
+		case *ast.Assign:
+			for i, t := range s.Targets {
+				var f *ast.Function
+				if i < len(s.Values) {
+					f, _ = s.Values[i].(*ast.Function)
+				}
+				if n, ok := t.(*ast.Name); ok && (top || f != nil) && d.res.refs[n] == nil {
+					kind := symbolVariable
+					if f != nil {
+						kind = symbolFunction
+					}
+					add(n.Name, kind, s, n, f)
+				}
+			}
+		}
+	}
+	return symbols
+}
+
+func signature(f *ast.Function) string {
+	var params []string
+	for _, p := range f.Params {
+		params = append(params, p.Name)
+	}
+	if f.IsVararg {
+		params = append(params, "...")
+	}
+	return "(" + strings.Join(params, ", ") + ")"
+}
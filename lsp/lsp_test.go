@@ -0,0 +1,213 @@
+package lsp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/go-lua"
+)
+
+const uri = "file:///flows/checkout.lua"
+
+const script = `local cart = {}
+
+local function total(items, tax)
+	local sum = 0
+	for _, item in ipairs(items) do
+		sum = sum + item.price
+	end
+	return sum * tax
+end
+
+function cart.checkout(items)
+	http.post("/checkout", total(items, 1.2))
+	return string.format("%d", #items)
+end
+
+return cart
+`
+
+// session sends the requests to a server and returns what it wrote, keyed by
+// request id, with the notifications under their method names.
+func session(t *testing.T, requests ...interface{}) map[string][]json.RawMessage {
+	var in, out bytes.Buffer
+	id := 0
+	for _, r := range requests {
+		m := r.(map[string]interface{})
+		if _, ok := m["id"]; ok {
+			id++
+			m["id"] = id
+		}
+		m["jsonrpc"] = "2.0"
+		if err := writeMessage(&in, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s := NewServer(Config{
+		Libraries: map[string][]lua.RegistryFunction{"http": {{Name: "post"}, {Name: "get"}}},
+		Functions: []lua.RegistryFunction{{Name: "sleep"}},
+	})
+	if err := s.Serve(&in, &out); err != nil {
+		t.Fatal(err)
+	}
+	results := make(map[string][]json.RawMessage)
+	r := bufio.NewReader(&out)
+	for {
+		b, err := readMessage(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		var m struct {
+			ID     *int
+			Method string
+			Result json.RawMessage
+			Params json.RawMessage
+			Error  *responseError
+		}
+		if err := json.Unmarshal(b, &m); err != nil {
+			t.Fatal(err)
+		}
+		if m.Error != nil {
+			t.Errorf("request %d failed: %s", *m.ID, m.Error.Message)
+		} else if m.ID != nil {
+			results[fmt.Sprint(*m.ID)] = append(results[fmt.Sprint(*m.ID)], m.Result)
+		} else {
+			results[m.Method] = append(results[m.Method], m.Params)
+		}
+	}
+	return results
+}
+
+func request(method string, params interface{}) map[string]interface{} {
+	return map[string]interface{}{"id": nil, "method": method, "params": params}
+}
+
+func notify(method string, params interface{}) map[string]interface{} {
+	return map[string]interface{}{"method": method, "params": params}
+}
+
+func open(text string) map[string]interface{} {
+	return notify("textDocument/didOpen", map[string]interface{}{
+		"textDocument": map[string]interface{}{"uri": uri, "languageId": "lua", "version": 1, "text": text},
+	})
+}
+
+func at(method string, line, character int) map[string]interface{} {
+	return request(method, map[string]interface{}{
+		"textDocument": map[string]string{"uri": uri},
+		"position":     map[string]int{"line": line, "character": character},
+	})
+}
+
+func TestDiagnostics(t *testing.T) {
+	bad := "local x = 1\nif x then\n  y = = 2\nend\n"
+	r := session(t, request("initialize", map[string]interface{}{}), open(bad), notify("exit", nil))
+	diagnostics := r["textDocument/publishDiagnostics"]
+	if len(diagnostics) != 1 {
+		t.Fatalf("expected diagnostics, got %v", r)
+	}
+	l := lua.NewState()
+	lua.LoadBuffer(l, bad, "@/flows/checkout.lua", "t")
+	message, _ := l.ToString(-1)
+	var p publishDiagnosticsParams
+	json.Unmarshal(diagnostics[0], &p)
+	if len(p.Diagnostics) != 1 || p.Diagnostics[0].Message != message {
+		t.Fatalf("expected %q, got %+v", message, p.Diagnostics)
+	}
+	if got, want := p.Diagnostics[0].Range, (rangeLSP{position{2, 6}, position{2, 9}}); got != want {
+		t.Errorf("expected range %v, got %v", want, got)
+	}
+}
+
+func TestNavigation(t *testing.T) {
+	r := session(t,
+		request("initialize", map[string]interface{}{}),
+		notify("initialized", map[string]interface{}{}),
+		open(script),
+		request("textDocument/documentSymbol", map[string]interface{}{"textDocument": map[string]string{"uri": uri}}),
+		at("textDocument/definition", 5, 9),   // sum, in the loop
+		at("textDocument/definition", 11, 31), // items, a parameter
+		at("textDocument/hover", 12, 17),      // format
+		at("textDocument/hover", 11, 3),       // http
+		at("textDocument/hover", 5, 9),        // sum
+		request("shutdown", nil),
+		notify("exit", nil),
+	)
+	var symbols []documentSymbol
+	json.Unmarshal(r["2"][0], &symbols)
+	var names []string
+	for _, s := range symbols {
+		names = append(names, s.Name)
+		for _, c := range s.Children {
+			names = append(names, s.Name+"/"+c.Name)
+		}
+	}
+	if got, want := strings.Join(names, " "), "cart total cart.checkout"; got != want {
+		t.Errorf("expected symbols %s, got %s", want, got)
+	}
+	for id, want := range map[string]location{
+		"3": {uri, rangeLSP{position{3, 7}, position{3, 10}}},
+		"4": {uri, rangeLSP{position{10, 23}, position{10, 28}}},
+	} {
+		var got location
+		json.Unmarshal(r[id][0], &got)
+		if got != want {
+			t.Errorf("request %s: expected %v, got %v", id, want, got)
+		}
+	}
+	for id, want := range map[string]string{
+		"5": "function string.format",
+		"6": "table http",
+		"7": "local sum",
+	} {
+		var got hover
+		json.Unmarshal(r[id][0], &got)
+		if !strings.Contains(got.Contents.Value, want) {
+			t.Errorf("request %s: expected hover with %q, got %q", id, want, got.Contents.Value)
+		}
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	valid := "local request = {}\nlocal function handle()\n  string.upper('')\n  http.get('')\n  re()\nend\n"
+	typing := "local request = {}\nlocal function handle()\n  string.\n  http.\n  re\nend\n"
+	r := session(t,
+		request("initialize", map[string]interface{}{}),
+		open(valid),
+		notify("textDocument/didChange", map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": uri, "version": 2},
+			"contentChanges": []map[string]string{{"text": typing}},
+		}),
+		at("textDocument/completion", 2, 9),
+		at("textDocument/completion", 3, 7),
+		at("textDocument/completion", 4, 4),
+	)
+	labels := func(id string) string {
+		var items []completionItem
+		json.Unmarshal(r[id][0], &items)
+		var s []string
+		for _, i := range items {
+			s = append(s, i.Label)
+		}
+		return " " + strings.Join(s, " ") + " "
+	}
+	for id, want := range map[string][]string{
+		"2": {" format ", " rep ", " upper "},
+		"3": {" get ", " post "},
+		"4": {" handle ", " request ", " sleep ", " string ", " http "},
+	} {
+		got := labels(id)
+		for _, w := range want {
+			if !strings.Contains(got, w) {
+				t.Errorf("request %s: expected %s in%s", id, w, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,360 @@
+// Package lsp implements a Language Server Protocol server for Lua scripts
+// run by go-lua.
+//
+// The server reports syntax errors exactly as Load does, lists the functions
+// and variables a document declares, jumps to the declarations of locals and
+// upvalues, and offers hover and completion for globals: the standard
+// library tables built by OpenLibraries, and the functions the host
+// registers.
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Shopify/go-lua"
+	"github.com/Shopify/go-lua/ast"
+)
+
+// Config describes the globals the host makes available to scripts.
+type Config struct {
+	// Libraries lists the functions of each global table the host
+	// registers, for example with lua.NewLibrary or lua.Require.
+	Libraries map[string][]lua.RegistryFunction
+
+	// Functions lists the global functions the host registers.
+	Functions []lua.RegistryFunction
+}
+
+// A global is a global variable known to the server.
+type global struct {
+	kind   string // the Lua type name
+	origin string
+	fields map[string]string // field names to type names, for tables
+}
+
+// A Server serves one client over a connection.
+type Server struct {
+	globals     map[string]*global
+	mu          sync.Mutex
+	documents   map[string]*document
+	initialized bool
+	shutdown    bool
+	out         io.Writer
+}
+
+// NewServer returns a server for scripts run in a State with the standard
+// libraries opened and the globals described by c.
+func NewServer(c Config) *Server {
+	s := &Server{globals: make(map[string]*global), documents: make(map[string]*document)}
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	l.PushGlobalTable()
+	for l.PushNil(); l.Next(-2); l.Pop(1) {
+		name, ok := l.ToString(-2)
+		if !ok || l.TypeOf(-2) != lua.TypeString {
+			continue
+		}
+		g := &global{kind: lua.TypeNameOf(l, -1), origin: "go-lua standard library"}
+		if name != "_G" && l.IsTable(-1) {
+			g.fields = make(map[string]string)
+			for l.PushNil(); l.Next(-2); l.Pop(1) {
+				if l.TypeOf(-2) == lua.TypeString {
+					field, _ := l.ToString(-2)
+					g.fields[field] = lua.TypeNameOf(l, -1)
+				}
+			}
+		}
+		s.globals[name] = g
+	}
+	l.Pop(1)
+	for name, functions := range c.Libraries {
+		g, ok := s.globals[name]
+		if !ok || g.fields == nil {
+			g = &global{kind: "table", origin: "host", fields: make(map[string]string)}
+			s.globals[name] = g
+		}
+		for _, f := range functions {
+			g.fields[f.Name] = "function"
+		}
+	}
+	for _, f := range c.Functions {
+		s.globals[f.Name] = &global{kind: "function", origin: "host"}
+	}
+	return s
+}
+
+// Serve reads requests from r and writes responses and notifications to w
+// until the client sends exit or r is exhausted. Messages are framed with
+// Content-Length headers, as over stdio.
+func (s *Server) Serve(r io.Reader, w io.Writer) error {
+	s.out = w
+	in := bufio.NewReader(r)
+	for {
+		b, err := readMessage(in)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var m message
+		if err := json.Unmarshal(b, &m); err != nil {
+			if err := s.reply(nil, nil, &responseError{codeParseError, err.Error()}); err != nil {
+				return err
+			}
+			continue
+		}
+		if m.Method == "exit" {
+			return nil
+		}
+		result, rerr := s.handle(m)
+		if m.ID == nil {
+			continue // a notification
+		} else if err := s.reply(m.ID, result, rerr); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Server) reply(id *json.RawMessage, result interface{}, err *responseError) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		return writeMessage(s.out, errorResponse{JSONRPC: "2.0", ID: id, Error: *err})
+	}
+	return writeMessage(s.out, response{JSONRPC: "2.0", ID: id, Result: result})
+}
+
+func (s *Server) notify(method string, params interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writeMessage(s.out, notification{JSONRPC: "2.0", Method: method, Params: params})
+}
+
+func (s *Server) handle(m message) (interface{}, *responseError) {
+	if !s.initialized && m.Method != "initialize" {
+		return nil, &responseError{codeNotInitialized, "server not initialized"}
+	} else if s.shutdown {
+		return nil, &responseError{codeInvalidRequest, "server is shutting down"}
+	}
+	params := func(v interface{}) *responseError {
+		if err := json.Unmarshal(m.Params, v); err != nil {
+			return &responseError{codeInvalidParams, err.Error()}
+		}
+		return nil
+	}
+	var p textDocumentPositionParams
+	switch m.Method {
+	case "initialize":
+		s.initialized = true
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				"textDocumentSync":       1, // full
+				"documentSymbolProvider": true,
+				"definitionProvider":     true,
+				"hoverProvider":          true,
+				"completionProvider":     map[string]interface{}{"triggerCharacters": []string{".", ":"}},
+			},
+			"serverInfo": map[string]string{"name": "golua-lsp"},
+		}, nil
+	case "initialized", "$/cancelRequest", "$/setTrace", "workspace/didChangeConfiguration":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case "textDocument/didOpen":
+		var p didOpenParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		s.open(p.TextDocument.URI, p.TextDocument.Text)
+		return nil, nil
+	case "textDocument/didChange":
+		var p didChangeParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		if n := len(p.ContentChanges); n > 0 {
+			s.open(p.TextDocument.URI, p.ContentChanges[n-1].Text)
+		}
+		return nil, nil
+	case "textDocument/didClose":
+		var p documentParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		delete(s.documents, p.TextDocument.URI)
+		s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: p.TextDocument.URI, Diagnostics: []diagnostic{}})
+		return nil, nil
+	case "textDocument/documentSymbol":
+		var p documentParams
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		d := s.documents[p.TextDocument.URI]
+		if d == nil || d.chunk == nil {
+			return []documentSymbol{}, nil
+		}
+		return d.symbols(d.chunk.Block, true), nil
+	case "textDocument/definition":
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		return s.definition(p), nil
+	case "textDocument/hover":
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		return s.hover(p), nil
+	case "textDocument/completion":
+		if err := params(&p); err != nil {
+			return nil, err
+		}
+		return s.completion(p), nil
+	}
+	return nil, &responseError{codeMethodNotFound, fmt.Sprintf("method not found: %s", m.Method)}
+}
+
+func (s *Server) open(uri, text string) {
+	d := newDocument(uri, text)
+	if d.chunk == nil {
+		if old := s.documents[uri]; old != nil {
+			// Keep navigating the last version that parsed.
+			d.chunk, d.res = old.chunk, old.res
+		}
+	}
+	s.documents[uri] = d
+	s.notify("textDocument/publishDiagnostics", publishDiagnosticsParams{URI: uri, Diagnostics: d.diagnostics})
+}
+
+func (s *Server) document(p textDocumentPositionParams) (*document, ast.Position) {
+	d := s.documents[p.TextDocument.URI]
+	if d == nil || d.chunk == nil {
+		return nil, ast.Position{}
+	}
+	return d, d.fromPosition(p.Position)
+}
+
+func (s *Server) definition(p textDocumentPositionParams) interface{} {
+	d, pos := s.document(p)
+	if d == nil {
+		return nil
+	}
+	if name, _, _ := d.nameAt(pos); name != nil {
+		if b := d.res.refs[name]; b != nil {
+			return location{URI: d.uri, Range: d.toRange(b.decl.Span)}
+		}
+	}
+	return nil
+}
+
+func (s *Server) hover(p textDocumentPositionParams) interface{} {
+	d, pos := s.document(p)
+	if d == nil {
+		return nil
+	}
+	name, field, of := d.nameAt(pos)
+	var text string
+	var span ast.Span
+	switch {
+	case name != nil && d.res.refs[name] != nil:
+		b := d.res.refs[name]
+		kind := "local"
+		if b.param {
+			kind = "parameter"
+		}
+		text = fmt.Sprintf("```lua\n%s %s\n```\nDeclared on line %d.", kind, name.Name, b.decl.From.Line)
+		span = name.Span
+	case name != nil && s.globals[name.Name] != nil:
+		g := s.globals[name.Name]
+		text = fmt.Sprintf("```lua\n%s %s\n```\nGlobal from the %s.", g.kind, name.Name, g.origin)
+		span = name.Span
+	case field != nil:
+		lib, ok := of.(*ast.Name)
+		if !ok || d.res.refs[lib] != nil || s.globals[lib.Name] == nil {
+			return nil
+		}
+		kind, ok := s.globals[lib.Name].fields[field.Value]
+		if !ok {
+			return nil
+		}
+		text = fmt.Sprintf("```lua\n%s %s.%s\n```\nFrom the %s.", kind, lib.Name, field.Value, s.globals[lib.Name].origin)
+		span = field.Span
+	default:
+		return nil
+	}
+	r := d.toRange(span)
+	return hover{Contents: markupContent{Kind: "markdown", Value: text}, Range: &r}
+}
+
+var member = regexp.MustCompile(`([A-Za-z_][A-Za-z0-9_]*)\s*[.:]\s*([A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func completionKind(typeName string) int {
+	switch typeName {
+	case "function":
+		return completionFunction
+	case "table":
+		return completionModule
+	}
+	return completionValue
+}
+
+func (s *Server) completion(p textDocumentPositionParams) interface{} {
+	items := []completionItem{}
+	d := s.documents[p.TextDocument.URI]
+	if d == nil {
+		return items
+	}
+	pos := d.fromPosition(p.Position)
+	line := d.line(pos.Line)
+	if pos.Column-1 <= len(line) {
+		line = line[:pos.Column-1]
+	}
+	if m := member.FindStringSubmatch(line); m != nil {
+		if g := s.globals[m[1]]; g != nil && !s.isLocal(d, m[1], pos) {
+			for name, kind := range g.fields {
+				items = append(items, completionItem{Label: name, Kind: completionKind(kind), Detail: kind + " " + m[1] + "." + name})
+			}
+		}
+		return sorted(items)
+	}
+	seen := make(map[string]bool)
+	if d.res != nil {
+		for i := len(d.res.bindings) - 1; i >= 0; i-- {
+			b := d.res.bindings[i]
+			if !seen[b.decl.Name] && contains(b.visible, pos) {
+				seen[b.decl.Name] = true
+				items = append(items, completionItem{Label: b.decl.Name, Kind: completionVariable, Detail: "local"})
+			}
+		}
+	}
+	for name, g := range s.globals {
+		if !seen[name] {
+			items = append(items, completionItem{Label: name, Kind: completionKind(g.kind), Detail: g.kind})
+		}
+	}
+	return sorted(items)
+}
+
+func (s *Server) isLocal(d *document, name string, pos ast.Position) bool {
+	if d.res == nil {
+		return false
+	}
+	for _, b := range d.res.bindings {
+		if b.decl.Name == name && contains(b.visible, pos) {
+			return true
+		}
+	}
+	return false
+}
+
+func sorted(items []completionItem) []completionItem {
+	sort.Slice(items, func(i, j int) bool { return strings.Compare(items[i].Label, items[j].Label) < 0 })
+	return items
+}
@@ -1,11 +1,14 @@
 package lua
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"runtime"
 	"strings"
+	"sync/atomic"
 )
 
 // MultipleReturns is the argument for argCount or resultCount in ProtectedCall and Call.
@@ -28,7 +31,9 @@ var (
 	FileError   = errors.New("file error")
 )
 
-// A RuntimeError is an error raised internally by the Lua VM or through Error.
+// A RuntimeError is the message of an error raised internally by the Lua VM
+// or through Error. Such errors are returned as a *LuaError, which unwraps
+// to its RuntimeError.
 type RuntimeError string
 
 func (r RuntimeError) Error() string { return "runtime error: " + string(r) }
@@ -194,9 +199,7 @@ type Hook func(state *State, activationRecord Debug)
 // A Function is a Go function intended to be called from Lua.
 type Function func(state *State) int
 
-// TODO XMove(from, to State, n int)
-//
-// Set functions (stack -> Lua)
+// TODO Set functions (stack -> Lua)
 // RawSetValue(index int, p interface{})
 //
 // Debug API
@@ -232,11 +235,17 @@ type State struct {
 	hookMask              byte
 	allowHook             bool
 	internalHook          bool
+	stats                 atomic.Pointer[stats]
 	baseHookCount         int
 	hookCount             int
 	hooker                Hook
+	hooks                 []*debugHook
+	debugger              *debugger
+	compiledEngines       *compiledEngine // free engines of executeCompiled
+	coroutine             *coroutine
 	upValues              *openUpValue
 	errorFunction         int      // current error handling function (stack index)
+	luaProtected          bool     // whether errors are caught by pcall or xpcall
 	baseCallInfo          callInfo // callInfo for first level (go calling lua)
 	protectFunction       func()
 }
@@ -249,6 +258,14 @@ type globalState struct {
 	panicFunction      Function // to be called in unprotected errors
 	version            *float64 // pointer to version number
 	memoryErrorMessage string
+	engine             Engine
+	optimizationLevel  int
+	allocationHook     AllocHook
+	propagatePanics    bool
+	goTracebacks       bool
+	errorTracebacks    bool
+	laneSetup          func(*State)
+	inlineCacheEpoch   uint32 // bumped when a table marked tableInlineCached is modified
 	// seed uint // randomized seed for hashes
 	// upValueHead upValue // head of double-linked list of all open upvalues
 }
@@ -349,6 +366,7 @@ func (l *State) CallWithContinuation(argCount, resultCount, context int, continu
 		l.call(f, resultCount, false) // just do the call
 	}
 	l.adjustResults(resultCount)
+	l.publishStats()
 }
 
 // ProtectedCall calls a function in protected mode. Both argCount and
@@ -373,7 +391,8 @@ func (l *State) CallWithContinuation(argCount, resultCount, context int, continu
 //
 // The possible errors are the following:
 //
-//    RuntimeError  a runtime error
+//    *LuaError     a runtime error
+//    *PanicError   a panic in the VM
 //    MemoryError   allocating memory, the error handler is not called
 //    ErrorError    running the error handler
 //
@@ -387,6 +406,13 @@ func (l *State) ProtectedCall(argCount, resultCount, errorFunction int) error {
 //
 // http://www.lua.org/manual/5.2/manual.html#lua_pcallk
 func (l *State) ProtectedCallWithContinuation(argCount, resultCount, errorFunction, context int, continuation Function) (err error) {
+	return l.protectedCallWithContinuation(argCount, resultCount, errorFunction, context, continuation, false)
+}
+
+// protectedCallWithContinuation is ProtectedCallWithContinuation, called by
+// pcall and xpcall with luaProtected set, as their errors are caught by Lua
+// code and need no traceback.
+func (l *State) protectedCallWithContinuation(argCount, resultCount, errorFunction, context int, continuation Function, luaProtected bool) (err error) {
 	if apiCheck && continuation != nil && l.callInfo.isLua() {
 		panic("cannot use continuations inside hooks")
 	}
@@ -402,6 +428,8 @@ func (l *State) ProtectedCallWithContinuation(argCount, resultCount, errorFuncti
 
 	f := l.top - (argCount + 1)
 
+	oldLuaProtected := l.luaProtected
+	l.luaProtected = luaProtected
 	if continuation == nil || l.nonYieldableCallCount > 0 {
 		err = l.protectedCall(func() { l.call(f, resultCount, false) }, f, errorFunction)
 	} else {
@@ -413,7 +441,9 @@ func (l *State) ProtectedCallWithContinuation(argCount, resultCount, errorFuncti
 		l.callInfo.clearCallStatus(callStatusYieldableProtected)
 		l.errorFunction = c.oldErrorFunction
 	}
+	l.luaProtected = oldLuaProtected
 	l.adjustResults(resultCount)
+	l.publishStats()
 	return
 }
 
@@ -465,6 +495,149 @@ func NewState() *State {
 	return l
 }
 
+// NewThread creates a new thread, pushes it on the stack, and returns a
+// pointer to a State that represents this new thread. The new thread shares
+// with l all global objects (such as tables), but has an independent
+// execution stack, and inherits the hooks of l.
+//
+// Threads can't yield, but each can run on its own goroutine, as long as
+// only one of the threads sharing global objects runs at a time.
+//
+// http://www.lua.org/manual/5.2/manual.html#lua_newthread
+func (l *State) NewThread() *State {
+	t := &State{allowHook: true, global: l.global, nonYieldableCallCount: 1}
+	for _, h := range l.hooks {
+		c := *h
+		t.hooks = append(t.hooks, &c)
+	}
+	t.hookMask, t.internalHook = l.hookMask&maskStats, l.internalHook
+	t.stats.Store(l.stats.Load())
+	t.debugger = l.debugger
+	t.installHooks()
+	t.initializeStack()
+	l.apiPush(t)
+	return t
+}
+
+// XMove exchanges values between different threads of the same global state.
+// It pops n values from the stack of l, and pushes them onto the stack of to.
+//
+// http://www.lua.org/manual/5.2/manual.html#lua_xmove
+func (l *State) XMove(to *State, n int) {
+	if l == to {
+		return
+	}
+	l.checkElementCount(n)
+	if apiCheck && l.global != to.global {
+		panic("moving among independent states")
+	}
+	to.checkStack(n)
+	l.top -= n
+	for i := 0; i < n; i++ {
+		to.push(l.stack[l.top+i])
+	}
+}
+
+// A coroutine runs a thread started by Resume on its own goroutine.
+type coroutine struct {
+	resume   chan struct{}
+	events   chan suspension
+	canceled context.Context // done when the thread is canceled
+	cancel   func()
+	exited   chan struct{} // receives when the goroutine exits
+}
+
+// A suspension is sent by the goroutine of a coroutine when it waits in Await
+// or returns, in which case ready is nil.
+type suspension struct {
+	ready chan struct{}
+	err   error
+}
+
+// Resume starts or continues the thread l. To start it, push the function to
+// call and its arguments onto the stack of l, as for ProtectedCall. Resume
+// returns when the function returns, or when a Go function it calls waits in
+// Await. In the latter case, ready receives when the wait is over, and the
+// next call to Resume continues the thread, after blocking until then if
+// needed; argCount is ignored when continuing.
+//
+// When the function returns, ready is nil, and the stack of l holds its
+// results, or the error value if err is not nil, as after ProtectedCall.
+//
+// The thread runs on its own goroutine, so l, and the threads sharing its
+// global objects, must not be used between a call to Resume and its return.
+// They may be used while l waits. A thread that won't be resumed must be
+// canceled with Cancel, for its goroutine to exit.
+func (l *State) Resume(argCount int) (ready <-chan struct{}, err error) {
+	c := l.coroutine
+	if c == nil {
+		c = &coroutine{resume: make(chan struct{}), events: make(chan suspension), exited: make(chan struct{}, 1)}
+		c.canceled, c.cancel = context.WithCancel(context.Background())
+		l.coroutine = c
+		go func() {
+			defer func() { c.exited <- struct{}{} }()
+			err := l.ProtectedCall(argCount, MultipleReturns, 0)
+			l.coroutine = nil
+			c.events <- suspension{err: err}
+		}()
+	} else {
+		c.resume <- struct{}{}
+	}
+	s := <-c.events
+	if s.ready == nil {
+		return nil, s.err
+	}
+	return s.ready, nil
+}
+
+// Cancel abandons the thread l, waiting in Await after a call to Resume, so
+// that its goroutine exits once the function passed to Await returns, rather
+// than waiting forever to be resumed. The deferred calls of the Go functions
+// running in l are run, but none of its Lua code. Cancel returns once they
+// have run and the goroutine exited, so it blocks until the function passed
+// to Await returns. Cancel does nothing if l isn't waiting. l must not be
+// used after it was canceled, but the threads sharing its global objects may.
+func (l *State) Cancel() {
+	if c := l.coroutine; c != nil {
+		c.cancel()
+		<-c.exited
+	}
+}
+
+// Await calls f, which must not use l. Called by a Go function running in a
+// thread started by Resume, it suspends the thread while f runs, so that the
+// host can run other threads, and returns once the thread is resumed after f
+// returned. Otherwise, Await just calls f.
+//
+// Await lets Go functions wait for Go work, such as a channel or a network
+// call, in straight-line code, without the continuations Lua yields need:
+//
+//	l.Register("fetch", func(l *lua.State) int {
+//	  url := lua.CheckString(l, 1)
+//	  var body string
+//	  lua.Await(l, func() { body = get(url) })
+//	  l.PushString(body)
+//	  return 1
+//	})
+func Await(l *State, f func()) {
+	c := l.coroutine
+	if c == nil {
+		f()
+		return
+	}
+	ready := make(chan struct{}, 1)
+	c.events <- suspension{ready: ready}
+	defer func() {
+		ready <- struct{}{}
+		select {
+		case <-c.resume:
+		case <-c.canceled.Done():
+			runtime.Goexit()
+		}
+	}()
+	f()
+}
+
 func apiCheckStackIndex(index int, v value) {
 	if apiCheck && (v == none || isPseudoIndex(index)) {
 		panic(fmt.Sprintf("index %d not in the stack", index))
@@ -1038,6 +1211,7 @@ func (l *State) RawGetValue(index int, p interface{}) {
 // http://www.lua.org/manual/5.2/manual.html#lua_createtable
 func (l *State) CreateTable(arrayCount, recordCount int) {
 	l.apiPush(newTableWithSize(arrayCount, recordCount))
+	l.tableCreated(arrayCount, recordCount)
 }
 
 // MetaTable pushes onto the stack the metatable of the value at index.  If
@@ -1109,7 +1283,7 @@ func (l *State) RawSet(index int) {
 	l.checkElementCount(2)
 	t := l.indexToValue(index).(*table)
 	t.put(l, l.stack[l.top-2], l.stack[l.top-1])
-	t.invalidateTagMethodCache()
+	t.invalidateTagMethodCache(l)
 	l.top -= 2
 }
 
@@ -1155,7 +1329,7 @@ func (l *State) SetMetaTable(index int) {
 	}
 	switch v := l.indexToValue(index).(type) {
 	case *table:
-		v.metaTable = mt
+		v.setMetaTable(l, mt)
 	case *userData:
 		v.metaTable = mt
 	default:
@@ -1225,11 +1399,14 @@ func (l *State) Register(name string, f Function) {
 }
 
 func (l *State) setErrorObject(err error, oldTop int) {
-	switch err {
-	case MemoryError:
+	pe, isPanic := err.(*PanicError)
+	switch {
+	case err == MemoryError:
 		l.stack[oldTop] = l.global.memoryErrorMessage
-	case ErrorError:
+	case err == ErrorError:
 		l.stack[oldTop] = "error in error handling"
+	case isPanic:
+		l.stack[oldTop] = pe.Error()
 	default:
 		l.stack[oldTop] = l.stack[l.top-1]
 	}
@@ -1237,7 +1414,7 @@ func (l *State) setErrorObject(err error, oldTop int) {
 }
 
 func (l *State) protectedCall(f func(), oldTop, errorFunc int) error {
-	callInfo, allowHook, nonYieldableCallCount, errorFunction := l.callInfo, l.allowHook, l.nonYieldableCallCount, l.errorFunction
+	callInfo, allowHook, nonYieldableCallCount, errorFunction, luaProtected := l.callInfo, l.allowHook, l.nonYieldableCallCount, l.errorFunction, l.luaProtected
 	l.errorFunction = errorFunc
 	err := l.protect(f)
 	if err != nil {
@@ -1246,7 +1423,7 @@ func (l *State) protectedCall(f func(), oldTop, errorFunc int) error {
 		l.callInfo, l.allowHook, l.nonYieldableCallCount = callInfo, allowHook, nonYieldableCallCount
 		// TODO l.shrinkStack()
 	}
-	l.errorFunction = errorFunction
+	l.errorFunction, l.luaProtected = errorFunction, luaProtected
 	return err
 }
 
@@ -1460,7 +1637,11 @@ func (l *State) PushLightUserData(d interface{}) { l.apiPush(d) }
 
 // PushUserData is similar to PushLightUserData, but pushes a full userdata
 // onto the stack.
-func (l *State) PushUserData(d interface{}) { l.apiPush(&userData{data: d}) }
+func (l *State) PushUserData(d interface{}) {
+	u := &userData{data: d}
+	l.apiPush(u)
+	l.userDataCreated(u)
+}
 
 // Length of the value at index; it is equivalent to the # operator in
 // Lua. The result is pushed on the stack.
@@ -2,7 +2,11 @@ package lua
 
 import (
 	"fmt"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestPushFStringPointer(t *testing.T) {
@@ -29,3 +33,122 @@ func TestToBooleanOutOfRange(t *testing.T) {
 		}
 	}
 }
+
+func TestNewThread(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	if err := DoString(l, "count = 0; function increment(n) count = count + n; return count end"); err != nil {
+		t.Fatal(err)
+	}
+	l1 := l.NewThread()
+	if !l.IsThread(-1) || l.ToThread(-1) != l1 || l1.PushThread() {
+		t.Fatal("the thread is not on the stack, or is the main thread")
+	}
+	l1.Pop(1)
+	l.Global("increment")
+	l.PushInteger(2)
+	l.XMove(l1, 2)
+	if l.Top() != 1 || l1.Top() != 2 {
+		t.Fatalf("%d and %d values on the stacks", l.Top(), l1.Top())
+	}
+	if err := l1.ProtectedCall(1, 1, 0); err != nil {
+		t.Fatal(err)
+	} else if n, _ := l1.ToInteger(-1); n != 2 {
+		t.Errorf("increment returned %d", n)
+	}
+	l.Global("count")
+	if n, _ := l.ToInteger(-1); n != 2 {
+		t.Errorf("count %d in the main thread", n)
+	}
+}
+
+func TestResume(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	futures := make(map[string]chan string)
+	l.Register("wait", func(l *State) int {
+		name := CheckString(l, 1)
+		var v string
+		Await(l, func() { v = <-futures[name] })
+		l.PushString(v)
+		return 1
+	})
+	l.Register("explode", func(l *State) int {
+		Await(l, func() { panic("boom") })
+		return 0
+	})
+	if err := DoString(l, `function both(a, b) return wait(a) .. " " .. wait(b) end`); err != nil {
+		t.Fatal(err)
+	}
+	futures["a"], futures["b"] = make(chan string, 1), make(chan string, 1)
+	l1, l2 := l.NewThread(), l.NewThread()
+	l.Pop(2)
+	l1.Global("both")
+	l1.PushString("a")
+	l1.PushString("b")
+	ready, err := l1.Resume(2)
+	if ready == nil || err != nil {
+		t.Fatalf("thread did not wait: %v", err)
+	}
+	l2.Global("explode")
+	if ready2, err := l2.Resume(0); ready2 == nil || err != nil {
+		t.Fatalf("thread did not wait: %v", err)
+	} else if _, err := l2.Resume(0); err == nil || !strings.Contains(err.Error(), "panic: boom") {
+		t.Errorf("unexpected error %v", err)
+	}
+	futures["a"] <- "hello"
+	<-ready
+	if ready, err = l1.Resume(0); ready == nil || err != nil {
+		t.Fatalf("thread did not wait again: %v", err)
+	}
+	select {
+	case <-ready:
+		t.Fatal("ready before the future")
+	default:
+	}
+	futures["b"] <- "world"
+	if ready, err = l1.Resume(0); ready != nil || err != nil {
+		t.Fatalf("thread did not return: %v", err)
+	} else if s, _ := l1.ToString(-1); s != "hello world" || l1.Top() != 1 {
+		t.Errorf("returned %q, %d values", s, l1.Top())
+	}
+	futures["a"] <- "direct"
+	if err := DoString(l, `assert(wait("a") == "direct")`); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	l := NewState()
+	var deferred atomic.Int32
+	l.Register("wait", func(l *State) int {
+		defer func() {
+			l.PushInteger(int(deferred.Add(1)))
+			l.SetGlobal("unwound")
+		}()
+		ch := make(chan struct{}, 1)
+		ch <- struct{}{}
+		Await(l, func() { <-ch })
+		return 0
+	})
+	goroutines := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		l1 := l.NewThread()
+		l.Pop(1)
+		l1.Global("wait")
+		if ready, err := l1.Resume(0); ready == nil || err != nil {
+			t.Fatalf("thread did not wait: %v", err)
+		}
+		l1.Cancel()
+		l.Global("unwound")
+		if n, _ := l.ToInteger(-1); n != i+1 {
+			t.Fatalf("Cancel returned before the deferred calls ran: %d of %d", n, i+1)
+		}
+		l.Pop(1)
+	}
+	for start := time.Now(); runtime.NumGoroutine() > goroutines; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("%d goroutines left running, %d before", runtime.NumGoroutine(), goroutines)
+		}
+	}
+}
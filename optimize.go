@@ -0,0 +1,388 @@
+package lua
+
+import "math"
+
+// SetOptimizationLevel sets how much Load optimizes the bytecode it compiles
+// from source text. Binary chunks are loaded as they are.
+//
+// Level 0, the default, keeps the code as generated. Level 1 threads jumps,
+// removes unreachable code and no-op jumps, and drops redundant MOVE
+// instructions. Level 2 also propagates constants through locals that are
+// never reassigned, and folds the tests that become constant as a result.
+//
+// The optimized code is still valid Lua 5.2 bytecode that Dump can write, and
+// the debug information (lines and local variables) is kept consistent.
+func SetOptimizationLevel(l *State, level int) { l.global.optimizationLevel = level }
+
+func (p *prototype) optimize(level int) {
+	for i := range p.prototypes {
+		p.prototypes[i].optimize(level)
+	}
+	if level >= 2 {
+		p.propagateConstants()
+		p.foldComparisons()
+	}
+	for changed := true; changed; {
+		changed = p.threadJumps()
+		changed = p.removeDeadCode() || changed
+	}
+}
+
+// registersWritten returns the range of registers i may write. to is
+// math.MaxInt when i may clobber every register from from on, and the range is
+// empty when i writes no register.
+func registersWritten(i instruction) (from, to int) {
+	a := i.a()
+	switch i.opCode() {
+	case opMove, opLoadConstant, opLoadConstantEx, opLoadBool, opGetUpValue, opGetTableUp, opGetTable,
+		opAdd, opSub, opMul, opDiv, opMod, opPow, opUnaryMinus, opNot, opLength, opTestSet, opTForLoop:
+		return a, a
+	case opLoadNil:
+		return a, a + i.b()
+	case opSelf:
+		return a, a + 1
+	case opForPrep:
+		return a, a + 2
+	case opForLoop:
+		return a, a + 3
+	case opConcat:
+		if b := i.b(); b < a {
+			return b, math.MaxInt
+		}
+		return a, math.MaxInt
+	case opNewTable, opClosure, opCall, opTailCall:
+		return a, math.MaxInt
+	case opTForCall:
+		return a + 3, math.MaxInt
+	case opVarArg:
+		if b := i.b(); b != 0 {
+			return a, a + b - 2
+		}
+		return a, math.MaxInt
+	}
+	return 0, -1
+}
+
+func writes(i instruction, r int) bool {
+	from, to := registersWritten(i)
+	return from <= r && r <= to
+}
+
+// skipsNext reports whether i implicitly consumes or skips the instruction
+// after it, which therefore can't be removed on its own.
+func skipsNext(i instruction) bool {
+	switch op := i.opCode(); op {
+	case opLoadBool:
+		return i.c() != 0
+	case opLoadConstantEx, opTForCall:
+		return true
+	case opSetList:
+		return i.c() == 0
+	default:
+		return testTMode(op)
+	}
+}
+
+func isJump(op opCode) bool {
+	return op == opJump || op == opForLoop || op == opForPrep || op == opTForLoop
+}
+
+func jumpTarget(i instruction, at int) int { return at + 1 + i.sbx() }
+
+func (p *prototype) jumpTargets() []bool {
+	targets := make([]bool, len(p.code)+1)
+	for at, i := range p.code {
+		if isJump(i.opCode()) {
+			targets[jumpTarget(i, at)] = true
+		}
+	}
+	return targets
+}
+
+func (p *prototype) pinned() []bool {
+	pinned := make([]bool, len(p.code))
+	for at, i := range p.code[:len(p.code)-1] {
+		pinned[at+1] = skipsNext(i)
+	}
+	return pinned
+}
+
+// threadJumps retargets jumps whose destination is an unconditional jump that
+// closes no upvalues.
+func (p *prototype) threadJumps() (changed bool) {
+	for at := range p.code {
+		i := &p.code[at]
+		if i.opCode() != opJump {
+			continue
+		}
+		target := jumpTarget(*i, at)
+		for n := 0; n < len(p.code) && target != at; n++ {
+			if j := p.code[target]; j.opCode() == opJump && j.a() == 0 && jumpTarget(j, target) != target {
+				target = jumpTarget(j, target)
+			} else {
+				break
+			}
+		}
+		if sbx := target - at - 1; sbx != i.sbx() {
+			i.setSBx(sbx)
+			changed = true
+		}
+	}
+	return
+}
+
+// removeDeadCode removes unreachable instructions, jumps to the next
+// instruction and redundant moves.
+func (p *prototype) removeDeadCode() bool {
+	code, pinned, targets := p.code, p.pinned(), p.jumpTargets()
+	reachable := make([]bool, len(code))
+	for work := []int{0}; len(work) > 0; {
+		at := work[len(work)-1]
+		work = work[:len(work)-1]
+		if at >= len(code) || reachable[at] {
+			continue
+		}
+		reachable[at] = true
+		switch i := code[at]; i.opCode() {
+		case opJump, opForPrep:
+			work = append(work, jumpTarget(i, at))
+		case opForLoop, opTForLoop:
+			work = append(work, jumpTarget(i, at), at+1)
+		case opReturn:
+		case opLoadConstantEx, opSetList:
+			if skipsNext(i) {
+				work = append(work, at+2)
+			} else {
+				work = append(work, at+1)
+			}
+		default:
+			if skipsNext(i) {
+				work = append(work, at+1, at+2)
+			} else {
+				work = append(work, at+1)
+			}
+		}
+	}
+	dead, removed := make([]bool, len(code)), false
+	for at, i := range code {
+		if pinned[at] && (at == 0 || !dead[at-1]) {
+			continue
+		}
+		switch {
+		case !reachable[at]:
+		case i.opCode() == opJump && i.a() == 0 && i.sbx() == 0:
+		case i.opCode() == opMove && i.a() == i.b():
+		case i.opCode() == opMove && at > 0 && !targets[at] && !dead[at-1] &&
+			code[at-1].opCode() == opMove && code[at-1].a() == i.b() && code[at-1].b() == i.a():
+		default:
+			continue
+		}
+		dead[at], removed = true, true
+	}
+	if removed {
+		p.removeInstructions(dead)
+	}
+	return removed
+}
+
+// removeInstructions deletes the dead instructions, retargeting jumps and
+// remapping the debug information. A jump to a dead instruction lands on the
+// next live one.
+func (p *prototype) removeInstructions(dead []bool) {
+	newPC := make([]int, len(p.code)+1)
+	n := len(p.code)
+	newPC[n] = n - countTrue(dead)
+	for at := n - 1; at >= 0; at-- {
+		if dead[at] {
+			newPC[at] = newPC[at+1]
+		} else {
+			newPC[at] = newPC[at+1] - 1
+		}
+	}
+	code, lineInfo := p.code[:0], p.lineInfo[:0]
+	for at, i := range p.code {
+		if dead[at] {
+			continue
+		}
+		if isJump(i.opCode()) {
+			i.setSBx(newPC[jumpTarget(i, at)] - newPC[at] - 1)
+		}
+		code, lineInfo = append(code, i), append(lineInfo, p.lineInfo[at])
+	}
+	p.code, p.lineInfo = code, lineInfo
+	for i := range p.localVariables {
+		v := &p.localVariables[i]
+		v.startPC, v.endPC = pc(newPC[v.startPC]), pc(newPC[v.endPC])
+	}
+}
+
+func countTrue(b []bool) (n int) {
+	for _, v := range b {
+		if v {
+			n++
+		}
+	}
+	return
+}
+
+// register returns the register that holds the local variable at index.
+func (p *prototype) register(index int) (r int) {
+	v := p.localVariables[index]
+	for _, w := range p.localVariables[:index] {
+		if w.startPC <= v.startPC && v.startPC < w.endPC {
+			r++
+		}
+	}
+	return
+}
+
+// rkConstant returns the index of k in the constant table, adding it when
+// needed, or false if it can't be addressed as an RK operand.
+func (p *prototype) rkConstant(k value) (int, bool) {
+	for i, c := range p.constants {
+		if c == k && i <= maxIndexRK {
+			return i, true
+		}
+	}
+	if len(p.constants) > maxIndexRK {
+		return 0, false
+	}
+	p.constants = append(p.constants, k)
+	return len(p.constants) - 1, true
+}
+
+// initialValue finds the instruction that loads a constant into register r
+// just before startPC, and returns that constant. It gives up when control can
+// reach startPC through a jump, as it does after an and or an or expression,
+// since another path may load another value.
+func (p *prototype) initialValue(r int, startPC int, targets []bool) (load instruction, k value, ok bool) {
+	for at := startPC - 1; at >= 0; at-- {
+		i := p.code[at]
+		if targets[at+1] {
+			return
+		} else if !writes(i, r) {
+			if isJump(i.opCode()) || skipsNext(i) || i.opCode() == opReturn {
+				return
+			}
+			continue
+		} else if at > 0 && skipsNext(p.code[at-1]) {
+			return
+		}
+		switch i.opCode() {
+		case opLoadConstant:
+			return i, p.constants[i.bx()], true
+		case opLoadBool:
+			return i, i.b() != 0, i.c() == 0
+		case opLoadNil:
+			return createABC(opLoadNil, 0, 0, 0), nil, true
+		}
+		return
+	}
+	return
+}
+
+// propagateConstants replaces reads of locals that are initialized with a
+// constant and never reassigned by the constant itself. Locals captured as
+// upvalues by nested functions may be assigned there and are left alone.
+func (p *prototype) propagateConstants() {
+	captured := make(map[int]bool)
+	for _, np := range p.prototypes {
+		for _, u := range np.upValues {
+			if u.isLocal {
+				captured[u.index] = true
+			}
+		}
+	}
+	targets := p.jumpTargets()
+	for index, v := range p.localVariables {
+		r, start, end := p.register(index), int(v.startPC), int(v.endPC)
+		if captured[r] || start == 0 || start >= end {
+			continue
+		}
+		load, k, ok := p.initialValue(r, start, targets)
+		if !ok {
+			continue
+		}
+		for _, i := range p.code[start:end] {
+			if writes(i, r) {
+				ok = false
+				break
+			}
+		}
+		if !ok {
+			continue
+		}
+		for at := start; at < end; at++ {
+			i := &p.code[at]
+			switch op := i.opCode(); {
+			case op == opMove && i.b() == r:
+				load.setA(i.a())
+				*i = load
+			case op == opTest && i.a() == r:
+				p.code[at] = foldedTest(isFalse(k) == (i.c() == 0))
+			case opMode(op) == iABC:
+				if bMode(op) == opArgK && i.b() == r {
+					if c, ok := p.rkConstant(k); ok {
+						i.setB(asConstant(c))
+					}
+				}
+				if cMode(op) == opArgK && i.c() == r {
+					if c, ok := p.rkConstant(k); ok {
+						i.setC(asConstant(c))
+					}
+				}
+			}
+		}
+	}
+}
+
+// foldedTest replaces a test whose outcome is known. The jump that follows it
+// is either taken or skipped; removeDeadCode cleans up afterwards.
+func foldedTest(taken bool) instruction {
+	offset := 1
+	if taken {
+		offset = 0
+	}
+	i := createABx(opJump, 0, 0)
+	i.setSBx(offset)
+	return i
+}
+
+// foldComparisons replaces comparisons between two constants.
+func (p *prototype) foldComparisons() {
+	for at, i := range p.code {
+		op := i.opCode()
+		if op != opEqual && op != opLessThan && op != opLessOrEqual || !isConstant(i.b()) || !isConstant(i.c()) {
+			continue
+		}
+		b, c := p.constants[constantIndex(i.b())], p.constants[constantIndex(i.c())]
+		var result bool
+		switch nb, nc, sb, sc := numberOrString(b, c); {
+		case op == opEqual:
+			result = b == c
+		case nb && nc:
+			if op == opLessThan {
+				result = b.(float64) < c.(float64)
+			} else {
+				result = b.(float64) <= c.(float64)
+			}
+		case sb && sc:
+			if op == opLessThan {
+				result = b.(string) < c.(string)
+			} else {
+				result = b.(string) <= c.(string)
+			}
+		default:
+			continue // an error at run time
+		}
+		p.code[at] = foldedTest(result == (i.a() != 0))
+	}
+}
+
+func numberOrString(b, c value) (nb, nc, sb, sc bool) {
+	_, nb = b.(float64)
+	_, nc = c.(float64)
+	_, sb = b.(string)
+	_, sc = c.(string)
+	return
+}
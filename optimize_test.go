@@ -0,0 +1,168 @@
+package lua
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestOptimizationLevels(t *testing.T) {
+	defer func(level int) { testOptimizationLevel = level }(testOptimizationLevel)
+	for _, level := range []int{1, 2} {
+		testOptimizationLevel = level
+		for _, s := range vmSuite {
+			t.Run(fmt.Sprintf("%d/%s", level, s.name), s.test)
+		}
+		t.Run(fmt.Sprintf("%d/Optimizer", level), testOptimizer)
+	}
+}
+
+func testOptimizer(t *testing.T) {
+	testString(t, `
+	local DEBUG, N, name, none = false, 10, "n", nil
+	local x = 0
+	if DEBUG then error("unreachable") end
+	if not DEBUG then x = x + 1 end
+	if none then error("unreachable") end
+	for i = 1, N do x = x + N end
+	assert(x == 101)
+	local t = {}
+	t[name] = N
+	assert(t.n == 10 and t[name] == N)
+	if N < 5 then error("unreachable") elseif N == 10 then x = 0 end
+	assert(x == 0)
+	local captured = 1
+	local function bump() captured = captured + 1 end
+	bump()
+	assert(captured == 2)
+	local count = 0
+	while true do
+		count = count + 1
+		if count > 3 then break end
+	end
+	assert(count == 4)
+	for i = 1, 3 do
+		for j = 1, 3 do
+			if j == 2 then goto continue end
+			count = count + 1
+			::continue::
+		end
+	end
+	assert(count == 10)
+	local a, b = 1, 2
+	a, b = b, a
+	assert(a == 2 and b == 1)
+	local s = ""
+	for _, v in ipairs({"a", "b"}) do s = s .. v end
+	assert(s == "ab")
+	local f = function(...) local n = select("#", ...) return n end
+	assert(f(1, 2, 3) == 3)
+	`)
+}
+
+func loadOptimized(t *testing.T, level int, s string) *prototype {
+	l := NewState()
+	SetOptimizationLevel(l, level)
+	if err := LoadString(l, s); err != nil {
+		t.Fatal(err)
+	}
+	return l.ToValue(-1).(*luaClosure).prototype
+}
+
+func TestOptimizerRemovesDeadCode(t *testing.T) {
+	s := `local DEBUG, N = false, 10
+		local x = 0
+		if DEBUG then print("debugging") end
+		for i = 1, N do x = x + N end
+		return x`
+	p0, p2 := loadOptimized(t, 0, s), loadOptimized(t, 2, s)
+	if len(p2.code) >= len(p0.code) {
+		t.Errorf("expected fewer instructions, got %d, was %d", len(p2.code), len(p0.code))
+	}
+	if len(p2.lineInfo) != len(p2.code) {
+		t.Errorf("line info has %d entries for %d instructions", len(p2.lineInfo), len(p2.code))
+	}
+	for _, i := range p2.code {
+		switch i.opCode() {
+		case opTest, opGetTableUp:
+			t.Errorf("unexpected %s in optimized code", i.String())
+		case opAdd:
+			if !isConstant(i.c()) {
+				t.Errorf("expected constant operand in %s", i.String())
+			}
+		}
+	}
+	for _, v := range p2.localVariables {
+		if v.startPC > v.endPC || int(v.endPC) > len(p2.code) {
+			t.Errorf("local %s has invalid range [%d, %d)", v.name, v.startPC, v.endPC)
+		}
+	}
+}
+
+func TestOptimizerThreadsJumps(t *testing.T) {
+	s := `local x = ...
+		while x do
+			if x > 1 then x = x - 1 else break end
+		end
+		return x`
+	p := loadOptimized(t, 1, s)
+	for at, i := range p.code {
+		if i.opCode() != opJump {
+			continue
+		}
+		if i.sbx() == 0 && i.a() == 0 && (at == 0 || !testTMode(p.code[at-1].opCode())) {
+			t.Errorf("no-op jump at %d", at)
+		}
+		if j := p.code[jumpTarget(i, at)]; j.opCode() == opJump && j.a() == 0 {
+			t.Errorf("jump at %d to jump at %d", at, jumpTarget(i, at))
+		}
+	}
+}
+
+func TestOptimizedDump(t *testing.T) {
+	l := NewState()
+	OpenLibraries(l)
+	SetOptimizationLevel(l, 2)
+	s := `local N, unit = 3, "x"
+		local t = {}
+		for i = 1, N do t[#t + 1] = unit:rep(i) end
+		if N > 5 then return "unreachable" end
+		return table.concat(t, ",")`
+	if err := LoadString(l, s); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := l.Dump(&b); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Load(&b, "optimized", "b"); err != nil {
+		t.Fatal(err)
+	}
+	l.Call(0, 1)
+	if r, _ := l.ToString(-1); r != "x,xx,xxx" {
+		t.Errorf("expected x,xx,xxx, got %q", r)
+	}
+}
+
+func TestOptimizedAndOr(t *testing.T) {
+	tests := []struct {
+		source   string
+		expected float64
+	}{
+		{"g = true; local x = g and 1 or 2; return x + 0", 1},
+		{"local c = true; local x = c and 1 or 2; return x + 0", 1},
+		{"g = 5; local x = g or 7; return x + 0", 5},
+	}
+	for _, level := range []int{0, 1, 2} {
+		for _, tt := range tests {
+			l := NewState()
+			SetOptimizationLevel(l, level)
+			if err := DoString(l, tt.source); err != nil {
+				t.Fatal(err)
+			}
+			if x, _ := l.ToNumber(-1); x != tt.expected {
+				t.Errorf("level %d: %q returned %v, expected %v", level, tt.source, x, tt.expected)
+			}
+		}
+	}
+}
@@ -658,15 +658,19 @@ func (l *State) parse(r io.ByteReader, name string) *luaClosure {
 	p.function = f
 	p.mainFunction()
 	// TODO assertions about parser state
+	if level := l.global.optimizationLevel; level > 0 {
+		f.f.optimize(level)
+	}
 	c := l.newLuaClosure(f.f)
 	l.push(c)
 	return c
 }
 
-func (l *State) checkMode(mode, x string) {
+func (l *State) checkMode(mode, x, name string) {
 	if mode != "" && !strings.Contains(mode, x[:1]) {
-		l.push(fmt.Sprintf("attempt to load a %s chunk (mode is '%s')", x, mode))
-		l.throw(SyntaxError)
+		message := fmt.Sprintf("attempt to load a %s chunk (mode is '%s')", x, mode)
+		l.push(message)
+		l.throw(&CompileError{Chunk: strings.TrimLeft(name, "@="), Message: message, text: message})
 	}
 }
 
@@ -676,14 +680,14 @@ func protectedParser(l *State, r io.Reader, name, chunkMode string) error {
 		var closure *luaClosure
 		b := bufio.NewReader(r)
 		if c, err := b.ReadByte(); err != nil {
-			l.checkMode(chunkMode, "text")
+			l.checkMode(chunkMode, "text", name)
 			closure = l.parse(b, name)
 		} else if c == Signature[0] {
-			l.checkMode(chunkMode, "binary")
+			l.checkMode(chunkMode, "binary", name)
 			b.UnreadByte()
 			closure, _ = l.undump(b, name) // TODO handle err
 		} else {
-			l.checkMode(chunkMode, "text")
+			l.checkMode(chunkMode, "text", name)
 			b.UnreadByte()
 			closure = l.parse(b, name)
 		}
@@ -143,3 +143,29 @@ func comparePrototypes(t *testing.T, a, b *prototype) {
 		comparePrototypes(t, &a.prototypes[i], &b.prototypes[i])
 	}
 }
+
+func BenchmarkParse(b *testing.B) {
+	var source strings.Builder
+	for i := 0; i < 200; i++ {
+		source.WriteString(`
+-- sums the squares of the numbers in t
+local function sumOfSquares(t, offset)
+  local sum = 0.5e1 + 0x10
+  for i, v in ipairs(t) do
+    sum = sum + v * v -- accumulate
+  end
+  return sum + (offset or 0), "sum of squares", [[long
+  string]]
+end
+`)
+	}
+	s := source.String()
+	b.SetBytes(int64(len(s)))
+	l := NewState()
+	for i := 0; i < b.N; i++ {
+		if err := LoadString(l, s); err != nil {
+			b.Fatal(err)
+		}
+		l.Pop(1)
+	}
+}
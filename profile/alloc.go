@@ -0,0 +1,138 @@
+package profile
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Shopify/go-lua"
+)
+
+// An AllocationSite counts the objects of one kind created by a line of Lua
+// code, including those created by the Go functions it calls.
+type AllocationSite struct {
+	// Chunk is the name of the line's chunk, without its '@' or '=' prefix.
+	// It is empty for objects created while no Lua function was running.
+	Chunk string
+	Line  int
+	Kind  lua.Allocation
+
+	Objects int64 // the number of objects created
+	Bytes   int64 // their approximate total size
+}
+
+// An AllocProfile holds the allocations recorded by an allocation profile.
+type AllocProfile struct {
+	// Sites lists the lines that created objects, by decreasing Bytes.
+	Sites []AllocationSite
+
+	b     *builder
+	start time.Time
+}
+
+// A site identifies an AllocationSite.
+type site struct {
+	chunk string
+	line  int
+	kind  lua.Allocation
+}
+
+type allocProfile struct {
+	previous lua.AllocHook
+	b        *builder
+	names    map[function]string // Lua names of functions, by source and line
+	sites    map[site]*AllocationSite
+	stack    []uint64
+	start    time.Time
+}
+
+var allocProfiles = make(map[*lua.State]*allocProfile)
+
+// StartAllocProfile starts an allocation profile of l, recording the call
+// stack and size of each table, Lua function, concatenated string and
+// userdata that it and its threads create. StartAllocProfile returns an error
+// if l is already being profiled.
+func StartAllocProfile(l *lua.State) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if allocProfiles[l] != nil {
+		return errors.New("allocation profiling already in use")
+	}
+	p := &allocProfile{
+		previous: lua.AllocationHook(l),
+		b:        newBuilder(),
+		names:    make(map[function]string),
+		sites:    make(map[site]*AllocationSite),
+		start:    time.Now(),
+	}
+	allocProfiles[l] = p
+	lua.SetAllocationHook(l, p.allocated)
+	return nil
+}
+
+// StopAllocProfile stops the allocation profile of l and returns it, or nil if
+// l is not being profiled. It restores the allocation hook l had when
+// profiling started.
+func StopAllocProfile(l *lua.State) *AllocProfile {
+	mu.Lock()
+	p := allocProfiles[l]
+	delete(allocProfiles, l)
+	mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	lua.SetAllocationHook(l, p.previous)
+	r := &AllocProfile{Sites: make([]AllocationSite, 0, len(p.sites)), b: p.b, start: p.start}
+	for _, s := range p.sites {
+		r.Sites = append(r.Sites, *s)
+	}
+	sort.Slice(r.Sites, func(i, j int) bool {
+		a, b := r.Sites[i], r.Sites[j]
+		switch {
+		case a.Bytes != b.Bytes:
+			return a.Bytes > b.Bytes
+		case a.Chunk != b.Chunk:
+			return a.Chunk < b.Chunk
+		case a.Line != b.Line:
+			return a.Line < b.Line
+		}
+		return a.Kind < b.Kind
+	})
+	return r
+}
+
+// Write writes p as a heap profile in the pprof format, with the number and
+// size of the objects created by each call stack, labeled by kind of object.
+func (p *AllocProfile) Write(w io.Writer) error {
+	return p.b.write(w,
+		[]valueType{{"alloc_objects", "count"}, {"alloc_space", "bytes"}},
+		valueType{"space", "bytes"}, 1, p.start)
+}
+
+func (p *allocProfile) allocated(l *lua.State, kind lua.Allocation, size int) {
+	p.stack = stack(l, p.b, p.names, p.stack[:0], false)
+	p.b.addLabeled([]label{{"object", kind.String()}}, p.stack, 1, int64(size))
+	k := site{kind: kind}
+	for level := 0; ; level++ {
+		f, ok := lua.Stack(l, level)
+		if !ok {
+			break
+		}
+		if d, _ := lua.Info(l, "Sl", f); d.What != "Go" {
+			k.chunk, k.line = d.Source, d.CurrentLine
+			if strings.HasPrefix(k.chunk, "@") || strings.HasPrefix(k.chunk, "=") {
+				k.chunk = k.chunk[1:]
+			}
+			break
+		}
+	}
+	s := p.sites[k]
+	if s == nil {
+		s = &AllocationSite{Chunk: k.chunk, Line: k.line, Kind: kind}
+		p.sites[k] = s
+	}
+	s.Objects++
+	s.Bytes += int64(size)
+}
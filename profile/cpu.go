@@ -0,0 +1,162 @@
+// Package profile profiles the Lua code run by go-lua States, writing
+// profiles in the pprof format read by go tool pprof.
+//
+//	profile.StartCPUProfile(l, f, 0)
+//	lua.DoFile(l, "flow.lua")
+//	profile.StopCPUProfile(l)
+//
+// CPU profiling adds a debug hook to the State, which runs along with the
+// State's other hooks, and allocation profiling sets its allocation hook,
+// which is restored when profiling stops.
+package profile
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/go-lua"
+)
+
+// DefaultInterval is the number of instructions between samples used by
+// StartCPUProfile when given an interval of 0.
+const DefaultInterval = 1000
+
+type cpuProfile struct {
+	w        io.Writer
+	interval int
+	remove   func() // removes the sampling hook
+	b        *builder
+	names    map[function]string // Lua names of functions, by source and line
+	stack    []uint64
+	start    time.Time
+	last     time.Time
+}
+
+var (
+	mu          sync.Mutex
+	cpuProfiles = make(map[*lua.State]*cpuProfile)
+)
+
+// StartCPUProfile starts a CPU profile of l, sampling its call stack every
+// interval instructions of Lua code. Each sample counts the time elapsed since
+// the previous one, which includes the time spent in Go functions called from
+// Lua. StartCPUProfile returns an error if l is already being profiled.
+func StartCPUProfile(l *lua.State, w io.Writer, interval int) error {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if cpuProfiles[l] != nil {
+		return errors.New("cpu profiling already in use")
+	}
+	p := &cpuProfile{
+		w:        w,
+		interval: interval,
+		b:        newBuilder(),
+		names:    make(map[function]string),
+		start:    time.Now(),
+	}
+	p.last = p.start
+	cpuProfiles[l] = p
+	p.remove = lua.AddDebugHook(l, p.sample, lua.MaskCount, interval)
+	return nil
+}
+
+// StopCPUProfile stops the CPU profile of l, if any, and writes it.
+func StopCPUProfile(l *lua.State) error {
+	mu.Lock()
+	p := cpuProfiles[l]
+	delete(cpuProfiles, l)
+	mu.Unlock()
+	if p == nil {
+		return nil
+	}
+	p.remove()
+	return p.b.write(p.w,
+		[]valueType{{"samples", "count"}, {"cpu", "nanoseconds"}},
+		valueType{"instructions", "count"}, int64(p.interval), p.start)
+}
+
+func (p *cpuProfile) sample(l *lua.State, _ lua.Debug) {
+	elapsed := time.Since(p.last)
+	p.stack = stack(l, p.b, p.names, p.stack[:0], true)
+	p.b.add(p.stack, 1, int64(elapsed))
+	p.last = time.Now() // not counting the time spent sampling
+}
+
+// stack appends the locations of l's active calls, innermost first. Go
+// functions are identified by their Go symbols when push is set, which pushes
+// each of them on the stack for a moment, and by their Lua names otherwise.
+func stack(l *lua.State, b *builder, names map[function]string, locations []uint64, push bool) []uint64 {
+	what := "nSl"
+	if push {
+		what = "nSlf"
+	}
+	for level := 0; ; level++ {
+		f, ok := lua.Stack(l, level)
+		if !ok {
+			return locations
+		}
+		d, _ := lua.Info(l, what, f)
+		var fn function
+		if d.What == "Go" {
+			fn = function{name: "?"}
+			if push {
+				fn = goFunction(l.ToGoFunction(-1))
+			}
+			if d.Name != "" {
+				fn.name = d.Name
+			}
+		} else {
+			fn = luaFunction(d, names)
+		}
+		if push {
+			l.Pop(1)
+		}
+		line := d.CurrentLine
+		if line < 0 {
+			line = fn.startLine
+		}
+		locations = append(locations, b.location(fn, line))
+	}
+}
+
+func luaFunction(d lua.Debug, names map[function]string) function {
+	fn := function{file: d.ShortSource, startLine: d.LineDefined}
+	if strings.HasPrefix(d.Source, "@") || strings.HasPrefix(d.Source, "=") {
+		fn.file = d.Source[1:]
+	}
+	name, ok := names[fn]
+	if !ok {
+		switch {
+		case d.What == "main":
+			name = "main chunk"
+		case d.Name != "":
+			name = d.Name
+		default:
+			name = fmt.Sprintf("function <%s:%d>", d.ShortSource, d.LineDefined)
+		}
+		names[fn] = name
+	}
+	fn.name, fn.systemName = name, name
+	return fn
+}
+
+func goFunction(f lua.Function) function {
+	if f == nil {
+		return function{name: "?"}
+	}
+	rf := runtime.FuncForPC(reflect.ValueOf(f).Pointer())
+	if rf == nil {
+		return function{name: "?"}
+	}
+	file, line := rf.FileLine(rf.Entry())
+	return function{name: rf.Name(), systemName: rf.Name(), file: file, startLine: line}
+}
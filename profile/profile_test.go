@@ -0,0 +1,260 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/Shopify/go-lua"
+)
+
+// A decoded profile holds the fields of a pprof profile the tests check.
+type decoded struct {
+	sampleTypes []string
+	samples     [][]int64            // values
+	stacks      [][]uint64           // location IDs
+	lines       map[uint64][2]uint64 // location ID to function ID and line
+	functions   map[uint64]string    // function ID to name
+	strings     []string
+}
+
+func fields(t *testing.T, b []byte, f func(field int, varint uint64, bytes []byte)) {
+	for len(b) > 0 {
+		key, n := varint(b)
+		b = b[n:]
+		switch key & 7 {
+		case 0:
+			x, n := varint(b)
+			b = b[n:]
+			f(int(key>>3), x, nil)
+		case 2:
+			length, n := varint(b)
+			b = b[n:]
+			f(int(key>>3), 0, b[:length])
+			b = b[length:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+}
+
+func varint(b []byte) (x uint64, n int) {
+	for shift := uint(0); ; shift += 7 {
+		x |= uint64(b[n]&0x7f) << shift
+		if n++; b[n-1] < 0x80 {
+			return
+		}
+	}
+}
+
+func packed(b []byte) (xs []uint64) {
+	for len(b) > 0 {
+		x, n := varint(b)
+		xs, b = append(xs, x), b[n:]
+	}
+	return
+}
+
+func decode(t *testing.T, r io.Reader) *decoded {
+	z, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &decoded{lines: make(map[uint64][2]uint64), functions: make(map[uint64]string)}
+	var types []uint64
+	names := make(map[uint64]uint64)
+	fields(t, b, func(field int, x uint64, m []byte) {
+		switch field {
+		case 1:
+			fields(t, m, func(field int, x uint64, _ []byte) {
+				if field == 1 {
+					types = append(types, x)
+				}
+			})
+		case 2:
+			var stack []uint64
+			var values []int64
+			fields(t, m, func(field int, _ uint64, m []byte) {
+				if field == 1 {
+					stack = packed(m)
+				} else if field == 2 {
+					for _, v := range packed(m) {
+						values = append(values, int64(v))
+					}
+				}
+			})
+			p.stacks, p.samples = append(p.stacks, stack), append(p.samples, values)
+		case 4:
+			var id uint64
+			fields(t, m, func(field int, x uint64, m []byte) {
+				if field == 1 {
+					id = x
+				} else if field == 4 {
+					var line [2]uint64
+					fields(t, m, func(field int, x uint64, _ []byte) { line[field-1] = x })
+					p.lines[id] = line
+				}
+			})
+		case 5:
+			var id, name uint64
+			fields(t, m, func(field int, x uint64, _ []byte) {
+				if field == 1 {
+					id = x
+				} else if field == 2 {
+					name = x
+				}
+			})
+			names[id] = name
+		case 6:
+			p.strings = append(p.strings, string(m))
+		}
+	})
+	for _, s := range types {
+		p.sampleTypes = append(p.sampleTypes, p.strings[s])
+	}
+	for id, name := range names {
+		p.functions[id] = p.strings[name]
+	}
+	return p
+}
+
+// leaf returns the function and line of the innermost location of stack.
+func (p *decoded) leaf(stack []uint64) (string, int) {
+	line := p.lines[stack[0]]
+	return p.functions[line[0]], int(line[1])
+}
+
+const fib = `local function fib(n)
+  if n < 2 then return n end
+  return fib(n - 1) + fib(n - 2)
+end
+return fib(20)
+`
+
+func TestCPUProfile(t *testing.T) {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	var hooked bool
+	lua.SetDebugHook(l, func(*lua.State, lua.Debug) { hooked = true }, lua.MaskLine, 0)
+	var buf bytes.Buffer
+	if err := StartCPUProfile(l, &buf, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartCPUProfile(l, &buf, 10); err == nil {
+		t.Error("started a second profile of the same State")
+	}
+	if err := lua.DoString(l, fib); err != nil {
+		t.Fatal(err)
+	}
+	if err := StopCPUProfile(l); err != nil {
+		t.Fatal(err)
+	}
+	if !hooked {
+		t.Error("the State's hook did not run while profiling")
+	}
+	hooked = false
+	if lua.DoString(l, "local x = 1"); !hooked {
+		t.Error("the State's hook did not run after profiling")
+	}
+	p := decode(t, &buf)
+	if len(p.sampleTypes) != 2 || p.sampleTypes[0] != "samples" || p.sampleTypes[1] != "cpu" {
+		t.Errorf("sample types %v", p.sampleTypes)
+	}
+	var total, inFib int64
+	for i, stack := range p.stacks {
+		total += p.samples[i][0]
+		if name, line := p.leaf(stack); name == "fib" {
+			if line < 1 || line > 4 {
+				t.Errorf("sample in fib at line %d", line)
+			}
+			inFib += p.samples[i][0]
+		}
+	}
+	if total < 100 || inFib < total*9/10 {
+		t.Errorf("%d of %d samples in fib", inFib, total)
+	}
+}
+
+const allocations = `local t = {}
+for i = 1, 10 do
+  t[i] = {i, i + 1}
+  local f = function() return i end
+  local s = "item " .. i .. "!"
+  newUserData()
+end
+`
+
+func TestAllocProfile(t *testing.T) {
+	for _, e := range []lua.Engine{lua.EngineFunctionTable, lua.EngineSwitch, lua.EngineCompiled} {
+		testAllocProfile(t, e)
+	}
+}
+
+func testAllocProfile(t *testing.T, e lua.Engine) {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	lua.SetEngine(l, e)
+	l.Register("newUserData", func(l *lua.State) int {
+		l.PushUserData(42)
+		return 1
+	})
+	if err := StartAllocProfile(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := StartAllocProfile(l); err == nil {
+		t.Error("started a second profile of the same State")
+	}
+	if err := lua.LoadString(l, allocations); err != nil {
+		t.Fatal(err)
+	}
+	l.Call(0, 0)
+	p := StopAllocProfile(l)
+	if lua.AllocationHook(l) != nil {
+		t.Error("the allocation hook was not restored")
+	}
+	counts := make(map[site]int64)
+	for _, s := range p.Sites {
+		if s.Chunk != allocations || s.Bytes <= 0 {
+			t.Errorf("unexpected site %+v", s)
+		}
+		counts[site{line: s.Line, kind: s.Kind}] = s.Objects
+	}
+	expected := map[site]int64{
+		{line: 1, kind: lua.AllocTable}:    1,
+		{line: 3, kind: lua.AllocTable}:    10,
+		{line: 4, kind: lua.AllocClosure}:  10,
+		{line: 5, kind: lua.AllocString}:   10,
+		{line: 6, kind: lua.AllocUserData}: 10,
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("engine %d: allocations %v, expected %v", e, counts, expected)
+	}
+	var buf bytes.Buffer
+	if err := p.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	d := decode(t, &buf)
+	if len(d.sampleTypes) != 2 || d.sampleTypes[0] != "alloc_objects" || d.sampleTypes[1] != "alloc_space" {
+		t.Errorf("sample types %v", d.sampleTypes)
+	}
+	var objects, bytes int64
+	for i, stack := range d.stacks {
+		objects, bytes = objects+d.samples[i][0], bytes+d.samples[i][1]
+		if name, line := d.leaf(stack); name == "newUserData" && line != 0 {
+			t.Errorf("Go function at line %d", line)
+		}
+	}
+	var sum int64
+	for _, s := range p.Sites {
+		sum += s.Bytes
+	}
+	if objects != 41 || bytes != sum {
+		t.Errorf("%d objects of %d bytes, expected 41 of %d", objects, bytes, sum)
+	}
+}
@@ -0,0 +1,201 @@
+package profile
+
+import (
+	"compress/gzip"
+	"io"
+	"time"
+)
+
+// A builder accumulates a profile in the pprof format, as described by
+// https://github.com/google/pprof/blob/main/proto/profile.proto, keeping the
+// tables of strings, functions and locations it refers to.
+type builder struct {
+	strings   []string
+	stringIDs map[string]int64
+	functions map[function]uint64
+	locations map[location]uint64
+	funcs     buffer // encoded Function messages
+	locs      buffer // encoded Location messages
+	samples   map[string]*sample
+	order     []string // sample keys in the order first seen
+}
+
+// A function is a Lua or Go function. For Go functions, systemName is the
+// Go name and name the name Lua code calls it by.
+type function struct {
+	name, systemName, file string
+	startLine              int
+}
+
+type location struct {
+	function uint64
+	line     int
+}
+
+type sample struct {
+	locations []uint64
+	labels    []label
+	values    []int64
+}
+
+// A label is a key and string value attached to a sample.
+type label struct{ key, value string }
+
+func newBuilder() *builder {
+	b := &builder{
+		stringIDs: make(map[string]int64),
+		functions: make(map[function]uint64),
+		locations: make(map[location]uint64),
+		samples:   make(map[string]*sample),
+	}
+	b.string("")
+	return b
+}
+
+func (b *builder) string(s string) int64 {
+	id, ok := b.stringIDs[s]
+	if !ok {
+		id = int64(len(b.strings))
+		b.strings = append(b.strings, s)
+		b.stringIDs[s] = id
+	}
+	return id
+}
+
+func (b *builder) function(f function) uint64 {
+	id, ok := b.functions[f]
+	if !ok {
+		id = uint64(len(b.functions) + 1)
+		b.functions[f] = id
+		var m buffer
+		m.uint(1, id)
+		m.int(2, b.string(f.name))
+		m.int(3, b.string(f.systemName))
+		m.int(4, b.string(f.file))
+		m.int(5, int64(f.startLine))
+		b.funcs.message(5, m)
+	}
+	return id
+}
+
+func (b *builder) location(f function, line int) uint64 {
+	l := location{b.function(f), line}
+	id, ok := b.locations[l]
+	if !ok {
+		id = uint64(len(b.locations) + 1)
+		b.locations[l] = id
+		var m, ln buffer
+		m.uint(1, id)
+		ln.uint(1, l.function)
+		ln.int(2, int64(line))
+		m.message(4, ln)
+		b.locs.message(4, m)
+	}
+	return id
+}
+
+// add adds values to the sample for a stack of locations, innermost first.
+func (b *builder) add(locations []uint64, values ...int64) {
+	b.addLabeled(nil, locations, values...)
+}
+
+// addLabeled adds values to the sample for a stack of locations with labels.
+func (b *builder) addLabeled(labels []label, locations []uint64, values ...int64) {
+	key := make([]byte, 0, 8*len(locations))
+	for _, id := range locations {
+		key = appendVarint(key, id)
+	}
+	for _, l := range labels {
+		key = appendVarint(appendVarint(append(key, 0), uint64(b.string(l.key))), uint64(b.string(l.value)))
+	}
+	s, ok := b.samples[string(key)]
+	if !ok {
+		s = &sample{locations: append([]uint64(nil), locations...), labels: append([]label(nil), labels...), values: make([]int64, len(values))}
+		b.samples[string(key)] = s
+		b.order = append(b.order, string(key))
+	}
+	for i, v := range values {
+		s.values[i] += v
+	}
+}
+
+// A valueType names the type and unit of a sample value, such as "samples"
+// and "count".
+type valueType struct{ typ, unit string }
+
+func (b *builder) valueType(field int, t valueType) []byte {
+	var m buffer
+	m.int(1, b.string(t.typ))
+	m.int(2, b.string(t.unit))
+	var f buffer
+	f.message(field, m)
+	return f
+}
+
+// write writes the gzipped profile, whose samples hold values of types,
+// taken every period of periodType, from start until now.
+func (b *builder) write(w io.Writer, types []valueType, periodType valueType, period int64, start time.Time) error {
+	var p buffer
+	for _, t := range types {
+		p = append(p, b.valueType(1, t)...)
+	}
+	for _, key := range b.order {
+		s := b.samples[key]
+		var m, ids, values buffer
+		for _, id := range s.locations {
+			ids = appendVarint(ids, id)
+		}
+		for _, v := range s.values {
+			values = appendVarint(values, uint64(v))
+		}
+		m.bytes(1, ids)
+		m.bytes(2, values)
+		for _, l := range s.labels {
+			var lm buffer
+			lm.int(1, b.string(l.key))
+			lm.int(2, b.string(l.value))
+			m.message(3, lm)
+		}
+		p.message(2, m)
+	}
+	p = append(p, b.locs...)
+	p = append(p, b.funcs...)
+	p = append(p, b.valueType(11, periodType)...)
+	p.int(12, period)
+	p.int(9, start.UnixNano())
+	p.int(10, int64(time.Since(start)))
+	for _, s := range b.strings { // last, as the fields above add strings
+		p.bytes(6, []byte(s))
+	}
+	z := gzip.NewWriter(w)
+	if _, err := z.Write(p); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+// A buffer holds encoded protocol buffer fields.
+type buffer []byte
+
+func appendVarint(b []byte, x uint64) []byte {
+	for x >= 0x80 {
+		b = append(b, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(b, byte(x))
+}
+
+func (b *buffer) uint(field int, x uint64) {
+	if x != 0 {
+		*b = appendVarint(appendVarint(*b, uint64(field)<<3), x)
+	}
+}
+
+func (b *buffer) int(field int, x int64) { b.uint(field, uint64(x)) }
+
+func (b *buffer) bytes(field int, s []byte) {
+	*b = appendVarint(appendVarint(*b, uint64(field)<<3|2), uint64(len(s)))
+	*b = append(*b, s...)
+}
+
+func (b *buffer) message(field int, m buffer) { b.bytes(field, m) }
@@ -1,6 +1,7 @@
 package lua
 
 import (
+	"bufio"
 	"bytes"
 	"fmt"
 	"io"
@@ -48,6 +49,7 @@ const (
 	tkNumber
 	tkName
 	tkString
+	tkComment
 	reservedCount = tkWhile - firstReserved + 1
 )
 
@@ -57,7 +59,7 @@ var tokens []string = []string{
 	"in", "local", "nil", "not", "or", "repeat",
 	"return", "then", "true", "until", "while",
 	"..", "...", "==", ">=", "<=", "~=", "::", "<eof>",
-	"<number>", "<name>", "<string>",
+	"<number>", "<name>", "<string>", "<comment>",
 }
 
 type token struct {
@@ -75,6 +77,11 @@ type scanner struct {
 	source               string
 	lookAheadToken       token
 	token
+	read             int  // count of bytes read
+	lineStart        int  // offset of the current line
+	start, startLine int  // offset and line of the last token scanned
+	startColumn      int  // column of the last token scanned
+	raw              bool // return comments as tokens
 }
 
 func (s *scanner) assert(cond bool)           { s.l.assert(cond) }
@@ -99,14 +106,9 @@ func (s *scanner) tokenToString(t rune) string {
 }
 
 func (s *scanner) scanError(message string, token rune) {
-	buff := chunkID(s.source)
-	if token != 0 {
-		message = fmt.Sprintf("%s:%d: %s near %s", buff, s.lineNumber, message, s.tokenToString(token))
-	} else {
-		message = fmt.Sprintf("%s:%d: %s", buff, s.lineNumber, message)
-	}
-	s.l.push(message)
-	s.l.throw(SyntaxError)
+	err := s.syntaxErrorAt(message, token)
+	s.l.push(err.text)
+	s.l.throw(err)
 }
 
 func (s *scanner) incrementLineNumber() {
@@ -115,6 +117,7 @@ func (s *scanner) incrementLineNumber() {
 	if s.advance(); isNewLine(s.current) && s.current != old {
 		s.advance()
 	}
+	s.lineStart = s.offset()
 	if s.lineNumber++; s.lineNumber >= maxInt {
 		s.syntaxError("chunk has too many lines")
 	}
@@ -125,7 +128,16 @@ func (s *scanner) advance() {
 		s.current = endOfStream
 	} else {
 		s.current = rune(c)
+		s.read++
+	}
+}
+
+// offset returns the offset of the current character in the source.
+func (s *scanner) offset() int {
+	if s.current == endOfStream {
+		return s.read
 	}
+	return s.read - 1
 }
 
 func (s *scanner) saveAndAdvance() {
@@ -412,6 +424,8 @@ func (s *scanner) reservedOrName() token {
 func (s *scanner) scan() token {
 	const comment, str = true, false
 	for {
+		s.start, s.startLine = s.offset(), s.lineNumber
+		s.startColumn = s.start - s.lineStart + 1
 		switch c := s.current; c {
 		case '\n', '\r':
 			s.incrementLineNumber()
@@ -423,7 +437,9 @@ func (s *scanner) scan() token {
 			}
 			if s.advance(); s.current == '[' {
 				if sep := s.skipSeparator(); sep >= 0 {
-					_ = s.readMultiLine(comment, sep)
+					if _ = s.readMultiLine(comment, sep); s.raw {
+						return token{t: tkComment}
+					}
 					break
 				}
 				s.buffer.Reset()
@@ -431,6 +447,9 @@ func (s *scanner) scan() token {
 			for !isNewLine(s.current) && s.current != endOfStream {
 				s.advance()
 			}
+			if s.raw {
+				return token{t: tkComment}
+			}
 		case '[':
 			if sep := s.skipSeparator(); sep >= 0 {
 				return token{t: tkString, s: s.readMultiLine(str, sep)}
@@ -541,3 +560,101 @@ func (s *scanner) checkMatch(what, who rune, where int) {
 		}
 	}
 }
+
+// A TokenKind classifies the tokens returned by a Scanner.
+type TokenKind byte
+
+// Kinds of tokens.
+const (
+	TokenEOF     TokenKind = iota // end of the source
+	TokenName                     // identifier
+	TokenNumber                   // numeric literal
+	TokenString                   // short or long string literal
+	TokenKeyword                  // reserved word, such as "end"
+	TokenSymbol                   // operator or punctuation, such as "==" or "("
+	TokenComment                  // short or long comment, including the leading "--"
+)
+
+// A Token is a lexical element of Lua source.
+type Token struct {
+	Kind               TokenKind
+	Text               string  // the token exactly as written in the source
+	Value              string  // for strings, the contents with escapes resolved
+	Number             float64 // for numbers, the value
+	Line, Column       int     // position of the first byte; columns count bytes from 1
+	EndLine, EndColumn int     // position just past the last byte
+}
+
+// A Scanner splits Lua source into tokens with the same lexer that Load uses,
+// so it accepts exactly the dialect go-lua does. Unlike Load, it also returns
+// comments.
+type Scanner struct {
+	l    *State
+	s    scanner
+	text recorder
+}
+
+// A recorder keeps the bytes read through it, for Scanner to slice the text
+// of tokens from.
+type recorder struct {
+	r     io.ByteReader
+	bytes []byte
+}
+
+func (r *recorder) ReadByte() (byte, error) {
+	c, err := r.r.ReadByte()
+	if err == nil {
+		r.bytes = append(r.bytes, c)
+	}
+	return c, err
+}
+
+// NewScanner returns a Scanner reading the chunk named chunkName from r.
+func NewScanner(chunkName string, r io.Reader) *Scanner {
+	if chunkName == "" {
+		chunkName = "?"
+	}
+	l := NewState()
+	s := &Scanner{l: l, text: recorder{r: bufio.NewReader(r)}}
+	s.s = scanner{r: &s.text, lineNumber: 1, lastLine: 1, lookAheadToken: token{t: tkEOS}, l: l, source: chunkName, raw: true}
+	return s
+}
+
+// Scan returns the next token, or a token of kind TokenEOF at the end of the
+// source. A lexical error is the *CompileError Load would return.
+func (s *Scanner) Scan() (t Token, err error) {
+	if err = s.l.protectedCall(func() { t = s.scan() }, s.l.top, s.l.errorFunction); err != nil {
+		s.l.Pop(1)
+		return Token{}, err
+	}
+	return
+}
+
+func (s *Scanner) scan() Token {
+	tk := s.s.scan()
+	end := s.s.offset()
+	t := Token{
+		Text:      string(s.text.bytes[s.s.start:end]),
+		Line:      s.s.startLine,
+		Column:    s.s.startColumn,
+		EndLine:   s.s.lineNumber,
+		EndColumn: end - s.s.lineStart + 1,
+	}
+	switch r := tk.t; {
+	case r == tkEOS:
+		t.Kind = TokenEOF
+	case r == tkName:
+		t.Kind = TokenName
+	case r == tkNumber:
+		t.Kind, t.Number = TokenNumber, tk.n
+	case r == tkString:
+		t.Kind, t.Value = TokenString, tk.s
+	case r == tkComment:
+		t.Kind = TokenComment
+	case r < firstReserved+reservedCount && r >= firstReserved:
+		t.Kind = TokenKeyword
+	default:
+		t.Kind = TokenSymbol
+	}
+	return t
+}
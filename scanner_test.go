@@ -1,6 +1,7 @@
 package lua
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"testing"
@@ -62,3 +63,37 @@ func (t token) String() string {
 	}
 	return fmt.Sprintf("{t:%s, n:%f, s:%q}", tok, t.n, t.s)
 }
+
+func TestScannerTokens(t *testing.T) {
+	s := NewScanner("test", strings.NewReader("local s = [[a\nb]] -- note\n  x ~= 0x1F"))
+	expected := []Token{
+		{Kind: TokenKeyword, Text: "local", Line: 1, Column: 1, EndLine: 1, EndColumn: 6},
+		{Kind: TokenName, Text: "s", Line: 1, Column: 7, EndLine: 1, EndColumn: 8},
+		{Kind: TokenSymbol, Text: "=", Line: 1, Column: 9, EndLine: 1, EndColumn: 10},
+		{Kind: TokenString, Text: "[[a\nb]]", Value: "a\nb", Line: 1, Column: 11, EndLine: 2, EndColumn: 4},
+		{Kind: TokenComment, Text: "-- note", Line: 2, Column: 5, EndLine: 2, EndColumn: 12},
+		{Kind: TokenName, Text: "x", Line: 3, Column: 3, EndLine: 3, EndColumn: 4},
+		{Kind: TokenSymbol, Text: "~=", Line: 3, Column: 5, EndLine: 3, EndColumn: 7},
+		{Kind: TokenNumber, Text: "0x1F", Number: 31, Line: 3, Column: 8, EndLine: 3, EndColumn: 12},
+		{Kind: TokenEOF, Line: 3, Column: 12, EndLine: 3, EndColumn: 12},
+	}
+	for i, e := range expected {
+		if tok, err := s.Scan(); err != nil {
+			t.Fatal(err)
+		} else if tok != e {
+			t.Errorf("[%d] expected %+v but found %+v", i, e, tok)
+		}
+	}
+	if _, err := NewScanner("test", strings.NewReader("x = 'unfinished")).Scan(); err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	s = NewScanner("test", strings.NewReader("'unfinished"))
+	var e *CompileError
+	if _, err := s.Scan(); !errors.As(err, &e) || !errors.Is(err, SyntaxError) {
+		t.Errorf("unexpected error %v", err)
+	} else if e.Line != 1 || e.Column != 1 || e.Message != "unfinished string" || e.Near != "<eof>" {
+		t.Errorf("unexpected error %+v", e)
+	} else if err.Error() != `syntax error: [string "test"]:1: unfinished string near <eof>` {
+		t.Errorf("unexpected error %v", err)
+	}
+}
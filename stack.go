@@ -1,6 +1,10 @@
 package lua
 
-import "log"
+import (
+	"log"
+	"runtime/debug"
+	"time"
+)
 
 func (l *State) push(v value) {
 	l.stack[l.top] = v
@@ -231,6 +235,7 @@ func (l *State) newClosure(p *prototype, upValues []*upValue, base int) value {
 			c.upValues[i] = upValues[uv.index]
 		}
 	}
+	l.closureCreated(c)
 	return c
 }
 
@@ -250,6 +255,9 @@ func cached(p *prototype, upValues []*upValue, base int) *luaClosure {
 
 func (l *State) callGo(f value, function int, resultCount int) {
 	l.checkStack(MinStack)
+	if l.hookMask&maskStats != 0 && l.callInfo.isLua() {
+		defer l.stats.Load().goCall(f, time.Now())
+	}
 	l.pushGoFrame(function, resultCount)
 	if l.hookMask&MaskCall != 0 {
 		l.hook(HookCall, -1)
@@ -317,7 +325,7 @@ func (l *State) preCall(function int, resultCount int) bool {
 
 func (l *State) callHook(ci *callInfo) {
 	ci.savedPC++ // hooks assume 'pc' is already incremented
-	if pci := ci.previous; pci.isLua() && pci.code[pci.savedPC-1].opCode() == opTailCall {
+	if pci := ci.previous; pci != &l.baseCallInfo && pci.isLua() && pci.code[pci.savedPC-1].opCode() == opTailCall {
 		ci.setCallStatus(callStatusTail)
 		l.hook(HookTailCall, -1)
 	} else {
@@ -385,9 +393,13 @@ func (l *State) call(function int, resultCount int, allowYield bool) {
 	l.nestedGoCallCount--
 }
 
+// A luaError is the value of the panics that raise Lua errors, which
+// protect recovers.
+type luaError struct{ error }
+
 func (l *State) throw(errorCode error) {
 	if l.protectFunction != nil {
-		panic(errorCode)
+		panic(luaError{errorCode})
 	} else {
 		l.error = errorCode
 		if g := l.global.mainThread; g.protectFunction != nil {
@@ -402,12 +414,23 @@ func (l *State) throw(errorCode error) {
 	}
 }
 
+// protect calls f, returning the Lua error it raises. Panics in the Go
+// functions f calls are recovered here rather than in each call, and raised
+// as Lua errors from the Go function that panicked, where the stack is left.
 func (l *State) protect(f func()) (err error) {
-	nestedGoCallCount, protectFunction := l.nestedGoCallCount, l.protectFunction
+	nestedGoCallCount, protectFunction, callInfo := l.nestedGoCallCount, l.protectFunction, l.callInfo
 	l.protectFunction = func() {
 		if e := recover(); e != nil {
-			err = e.(error)
 			l.nestedGoCallCount, l.protectFunction = nestedGoCallCount, protectFunction
+			if le, ok := e.(luaError); ok {
+				err = le.error
+			} else if l.global.propagatePanics {
+				panic(e)
+			} else if l.callInfo != callInfo && !l.callInfo.isLua() { // a panic in a Go function
+				err = l.goPanicError(e)
+			} else { // a panic in the VM itself
+				err = &PanicError{Value: e, Stack: debug.Stack()}
+			}
 		}
 	}
 	defer l.protectFunction()
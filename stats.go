@@ -0,0 +1,241 @@
+package lua
+
+import (
+	"encoding/json"
+	"reflect"
+	"runtime"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// maskStats is set in hookMask while a State collects statistics, so that the
+// engines trace every instruction.
+const maskStats = 1 << 7
+
+// ExecutionStats are the statistics collected by a State since CollectStats
+// enabled them.
+type ExecutionStats struct {
+	// Instructions is the total number of instructions executed.
+	Instructions int64
+
+	// Opcodes counts the instructions executed by opcode, such as "GETTABLE".
+	Opcodes map[string]int64
+
+	// Operands counts the instructions that take a register or a constant as
+	// operand B or C by opcode and operand kinds, such as "ADD RK" for an ADD
+	// of a register and a constant.
+	Operands map[string]int64
+
+	// Functions lists the Lua functions run, by decreasing instructions.
+	Functions []FunctionStats
+
+	// GoFunctions lists the Go functions called from Lua, by decreasing
+	// time.
+	GoFunctions []GoFunctionStats
+}
+
+// FunctionStats counts the instructions executed by a Lua function.
+type FunctionStats struct {
+	Source       string
+	LineDefined  int
+	Instructions int64
+}
+
+// GoFunctionStats holds the calls to a Go function from Lua and the time
+// they took, including the time spent in Lua code they called.
+type GoFunctionStats struct {
+	Name  string
+	Calls int64
+	Time  time.Duration
+}
+
+type goStats struct {
+	calls int64
+	time  time.Duration
+}
+
+// statsCheck is the number of instructions between checks of whether to
+// publish the counts, which is done every statsInterval.
+const (
+	statsCheck    = 1 << 12
+	statsInterval = 100 * time.Millisecond
+)
+
+type counts struct {
+	operands    [][4]int64 // by opcode and constant operands
+	prototypes  map[*prototype]int64
+	goFunctions map[uintptr]goStats
+}
+
+// stats are counted without locking by the goroutine running the State and
+// its threads, which run one at a time, and published as snapshots for Stats.
+type stats struct {
+	counts
+	untilCheck int
+	published  time.Time
+	snapshot   atomic.Pointer[counts]
+}
+
+func (c *counts) copy() *counts {
+	d := &counts{operands: append([][4]int64(nil), c.operands...), prototypes: make(map[*prototype]int64, len(c.prototypes)), goFunctions: make(map[uintptr]goStats, len(c.goFunctions))}
+	for p, n := range c.prototypes {
+		d.prototypes[p] = n
+	}
+	for pc, g := range c.goFunctions {
+		d.goFunctions[pc] = g
+	}
+	return d
+}
+
+func (s *stats) publish() {
+	s.snapshot.Store(s.copy())
+	s.untilCheck, s.published = statsCheck, time.Now()
+}
+
+// CollectStats enables or disables the collection of execution statistics
+// for l. Enabling them starts from zero counts, and makes l trace every
+// instruction it executes, which slows it down. It must be called from the
+// goroutine running l, or while l isn't running.
+func CollectStats(l *State, enabled bool) {
+	if !enabled {
+		if l.hookMask&maskStats != 0 {
+			l.stats.Load().publish()
+		}
+		l.hookMask &^= maskStats
+		return
+	}
+	s := &stats{counts: counts{operands: make([][4]int64, len(opNames)), prototypes: make(map[*prototype]int64), goFunctions: make(map[uintptr]goStats)}}
+	s.publish()
+	l.stats.Store(s)
+	l.hookMask |= maskStats
+}
+
+// publishStats publishes the statistics of l when a call from Go returns to
+// it, so that Stats sees the counts of the calls done.
+func (l *State) publishStats() {
+	if l.hookMask&maskStats != 0 && l.callInfo == &l.baseCallInfo {
+		l.stats.Load().publish()
+	}
+}
+
+func (s *stats) instruction(ci *callInfo, p *prototype) {
+	i := ci.code[ci.savedPC]
+	op, kind := i.opCode(), 0
+	if opMode(op) == iABC {
+		if bMode(op) == opArgK && isConstant(i.b()) {
+			kind |= 1
+		}
+		if cMode(op) == opArgK && isConstant(i.c()) {
+			kind |= 2
+		}
+	}
+	s.operands[op][kind]++
+	s.prototypes[p]++
+	if s.untilCheck--; s.untilCheck <= 0 {
+		if time.Since(s.published) >= statsInterval {
+			s.publish()
+		} else {
+			s.untilCheck = statsCheck
+		}
+	}
+}
+
+func (s *stats) goCall(f value, start time.Time) {
+	var fn interface{}
+	switch f := f.(type) {
+	case *goClosure:
+		fn = f.function
+	case *goFunction:
+		fn = f.Function
+	}
+	pc := reflect.ValueOf(fn).Pointer()
+	g := s.goFunctions[pc]
+	g.calls++
+	g.time += time.Since(start)
+	s.goFunctions[pc] = g
+}
+
+// Stats returns the statistics collected by l, which are empty if
+// CollectStats was never enabled for it. It may be called from any goroutine,
+// while l runs. The statistics are those published last: when a call from Go
+// to l returned, when CollectStats disabled them, and every 100ms while l
+// runs Lua code.
+func Stats(l *State) ExecutionStats {
+	r := ExecutionStats{Opcodes: make(map[string]int64), Operands: make(map[string]int64)}
+	collected := l.stats.Load()
+	if collected == nil {
+		return r
+	}
+	s := collected.snapshot.Load()
+	for op, byKind := range s.operands {
+		for kind, n := range byKind {
+			if n == 0 {
+				continue
+			}
+			r.Instructions += n
+			r.Opcodes[opNames[op]] += n
+			if name := operandKinds(opCode(op), kind); name != "" {
+				r.Operands[opNames[op]+" "+name] += n
+			}
+		}
+	}
+	for p, n := range s.prototypes {
+		r.Functions = append(r.Functions, FunctionStats{Source: p.source, LineDefined: p.lineDefined, Instructions: n})
+	}
+	sort.Slice(r.Functions, func(i, j int) bool {
+		a, b := r.Functions[i], r.Functions[j]
+		if a.Instructions != b.Instructions {
+			return a.Instructions > b.Instructions
+		} else if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.LineDefined < b.LineDefined
+	})
+	for pc, g := range s.goFunctions {
+		name := "?"
+		if f := runtime.FuncForPC(pc); f != nil {
+			name = f.Name()
+		}
+		r.GoFunctions = append(r.GoFunctions, GoFunctionStats{Name: name, Calls: g.calls, Time: g.time})
+	}
+	sort.Slice(r.GoFunctions, func(i, j int) bool {
+		if a, b := r.GoFunctions[i], r.GoFunctions[j]; a.Time != b.Time {
+			return a.Time > b.Time
+		}
+		return r.GoFunctions[i].Name < r.GoFunctions[j].Name
+	})
+	return r
+}
+
+// operandKinds names the kinds of the B and C operands of op that may be
+// registers or constants, with R for a register and K for a constant.
+func operandKinds(op opCode, kind int) (s string) {
+	if opMode(op) != iABC {
+		return
+	}
+	for i, mode := range []byte{bMode(op), cMode(op)} {
+		if mode != opArgK {
+			continue
+		} else if kind&(1<<i) != 0 {
+			s += "K"
+		} else {
+			s += "R"
+		}
+	}
+	return
+}
+
+// A StatsVar is an expvar.Var publishing the statistics collected by a State
+// as JSON:
+//
+//	expvar.Publish("lua", lua.StatsVar{l})
+type StatsVar struct{ State *State }
+
+func (v StatsVar) String() string {
+	b, err := json.Marshal(Stats(v.State))
+	if err != nil {
+		return "{}"
+	}
+	return string(b)
+}
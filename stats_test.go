@@ -0,0 +1,76 @@
+package lua
+
+import (
+	"encoding/json"
+	"expvar"
+	"strings"
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	l.Register("count", func(l *State) int { return 0 })
+	CollectStats(l, true)
+	SetDebugHook(l, func(*State, Debug) {}, MaskCall, 0)
+	if DebugHookMask(l) != MaskCall {
+		t.Errorf("hook mask %d", DebugHookMask(l))
+	}
+	SetDebugHook(l, nil, 0, 0)
+	if err := DoString(l, `
+    local function add(a, b) return a + b end
+    local t = 0
+    for i = 1, 10 do t = add(t, i) + 1 end
+    count(t)
+  `); err != nil {
+		t.Fatal(err)
+	}
+	CollectStats(l, false)
+	if err := DoString(l, "local x = 1 + tonumber('2')"); err != nil {
+		t.Fatal(err)
+	}
+	s := Stats(l)
+	if s.Opcodes["ADD"] != 20 || s.Operands["ADD RR"] != 10 || s.Operands["ADD RK"] != 10 || s.Opcodes["CALL"] != 11 {
+		t.Errorf("opcodes %v, operands %v", s.Opcodes, s.Operands)
+	}
+	if _, ok := s.Operands["MOVE"]; ok {
+		t.Error("operand kinds for MOVE")
+	}
+	var total int64
+	for _, n := range s.Opcodes {
+		total += n
+	}
+	if len(s.Functions) != 2 || s.Functions[0].LineDefined != 0 || s.Functions[1].LineDefined != 2 || s.Functions[0].Instructions+s.Functions[1].Instructions != total || s.Instructions != total {
+		t.Errorf("functions %+v, %d instructions", s.Functions, total)
+	}
+	if len(s.GoFunctions) != 1 || s.GoFunctions[0].Calls != 1 || !strings.Contains(s.GoFunctions[0].Name, "TestStats") {
+		t.Errorf("Go functions %+v", s.GoFunctions)
+	}
+
+	var v expvar.Var = StatsVar{l}
+	var published ExecutionStats
+	if err := json.Unmarshal([]byte(v.String()), &published); err != nil {
+		t.Fatal(err)
+	} else if published.Instructions != total || published.Opcodes["ADD"] != 20 {
+		t.Errorf("published %+v", published)
+	}
+}
+
+func TestStatsWhileRunning(t *testing.T) {
+	l := newTestState()
+	OpenLibraries(l)
+	CollectStats(l, true)
+	done := make(chan struct{}, 1)
+	go func() {
+		for Stats(l).Instructions == 0 {
+		}
+		done <- struct{}{}
+	}()
+	if err := DoString(l, "local t = 0 for i = 1, 1e6 do t = t + i end"); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if s := Stats(l); s.Opcodes["ADD"] != 1e6 {
+		t.Errorf("opcodes %v", s.Opcodes)
+	}
+}
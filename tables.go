@@ -2,19 +2,38 @@ package lua
 
 import (
 	"math"
+	"strings"
+	"sync/atomic"
 )
 
 type table struct {
 	array         []value
 	hash          map[value]value
 	metaTable     *table
-	flags         byte
+	flags         uint32
 	iterationKeys []value
+	weak          *weakTable // holds the entries instead of array and hash, if not nil
 }
 
-func newTable() *table                     { return &table{hash: make(map[value]value)} }
-func (t *table) invalidateTagMethodCache() { t.flags = 0 }
-func (t *table) atString(k string) value   { return t.hash[k] }
+// tableInlineCached is set in table.flags when the table is a metatable or
+// an __index table whose contents were memoized by an inline cache.
+const tableInlineCached = 1 << tmCount
+
+func newTable() *table { return &table{hash: make(map[value]value)} }
+
+func (t *table) atString(k string) value {
+	if t.weak != nil {
+		return t.weak.at(k)
+	}
+	return t.hash[k]
+}
+
+func (t *table) invalidateTagMethodCache(l *State) {
+	if t.flags&tableInlineCached != 0 {
+		l.global.inlineCacheEpoch++
+	}
+	t.flags = 0
+}
 
 func newTableWithSize(arraySize, hashSize int) *table {
 	t := new(table)
@@ -30,7 +49,7 @@ func newTableWithSize(arraySize, hashSize int) *table {
 }
 
 func (l *State) fastTagMethod(table *table, event tm) value {
-	if table == nil || table.flags&1<<event != 0 {
+	if table == nil || table.flags&(1<<event) != 0 {
 		return nil
 	}
 	return table.tagMethod(event, l.global.tagMethodNames[event])
@@ -51,6 +70,9 @@ func (t *table) extendArray(last int) {
 }
 
 func (t *table) atInt(k int) value {
+	if t.weak != nil {
+		return t.weak.at(float64(k))
+	}
 	if 0 < k && k <= len(t.array) {
 		return t.array[k-1]
 	}
@@ -87,6 +109,12 @@ func (t *table) addOrInsertHash(k, v value) {
 }
 
 func (t *table) putAtInt(k int, v value) {
+	if t.weak != nil {
+		if t.weak.put(float64(k), v) {
+			t.iterationKeys = nil // invalidate iterations when adding an entry
+		}
+		return
+	}
 	if 0 < k && k <= len(t.array) {
 		t.array[k-1] = v
 	} else if k > 0 && v != nil && t.maybeResizeArray(k) {
@@ -99,6 +127,9 @@ func (t *table) putAtInt(k int, v value) {
 }
 
 func (t *table) at(k value) value {
+	if t.weak != nil {
+		return t.weak.at(k)
+	}
 	switch k := k.(type) {
 	case nil:
 		return nil
@@ -116,6 +147,12 @@ func (t *table) at(k value) value {
 }
 
 func (t *table) put(l *State, k, v value) {
+	if t.weak != nil && k != nil && k == k { // NaN keys aren't equal to themselves
+		if t.weak.put(k, v) {
+			t.iterationKeys = nil // invalidate iterations when adding an entry
+		}
+		return
+	}
 	switch k := k.(type) {
 	case nil:
 		l.runtimeError("table index is nil")
@@ -146,6 +183,9 @@ func (t *table) put(l *State, k, v value) {
 
 // OPT: tryPut is an optimized variant of the at/put pair used by setTableAt to avoid hashing the key twice.
 func (t *table) tryPut(l *State, k, v value) bool {
+	if t.weak != nil {
+		return false
+	}
 	switch k := k.(type) {
 	case nil:
 	case float64:
@@ -194,6 +234,9 @@ func (t *table) unboundSearch(j int) int {
 }
 
 func (t *table) length() int {
+	if t.weak != nil {
+		return t.unboundSearch(0)
+	}
 	j := len(t.array)
 	if j > 0 && t.array[j-1] == nil {
 		i := 0
@@ -222,6 +265,9 @@ func arrayIndex(k value) int {
 }
 
 func (l *State) next(t *table, key int) bool {
+	if t.weak != nil {
+		return l.weakNext(t, key)
+	}
 	i, k := 0, l.stack[key]
 	if k == nil { // first iteration
 	} else if i = arrayIndex(k); 0 < i && i <= len(t.array) {
@@ -261,3 +307,161 @@ func (l *State) next(t *table, key int) bool {
 	}
 	return false // no more elements
 }
+
+// A weakTable holds the entries of a table whose metatable has a __mode field
+// with 'k' or 'v', holding its weak keys or values, or both, by weak pointers.
+// Strings and other values that aren't objects are never weak. Entries whose
+// key or value was collected are missing from the table, and are eventually
+// removed from entries.
+//
+// A weak key is only collected once its value no longer refers to it: the
+// table is not an ephemeron table.
+type weakTable struct {
+	keys, values bool
+	entries      map[value]value
+	collected    atomic.Bool // set when a weak key or value may have been collected
+}
+
+// A weakReference is a weak key or value.
+type weakReference interface {
+	value() value // nil once collected
+}
+
+func dereference(v value) value {
+	if r, ok := v.(weakReference); ok {
+		return r.value()
+	}
+	return v
+}
+
+// key returns the key of the entry for k.
+func (w *weakTable) key(k value) value {
+	if w.keys {
+		return makeWeakReference(k, nil)
+	}
+	return k
+}
+
+// entry returns the key and value of an entry, with nil for collected ones.
+func (w *weakTable) entry(k, v value) (value, value) { return dereference(k), dereference(v) }
+
+func (w *weakTable) at(k value) value { return dereference(w.entries[w.key(k)]) }
+
+// put sets the value of the entry for k, and returns whether it added one.
+func (w *weakTable) put(k, v value) bool {
+	if w.collected.Swap(false) {
+		w.sweep()
+	}
+	wk := w.key(k)
+	old, present := w.entries[wk]
+	if v == nil {
+		delete(w.entries, wk)
+		return false
+	} else if !present && w.keys {
+		wk = makeWeakReference(k, w)
+	}
+	if w.values && (!present || dereference(old) != v) {
+		w.entries[wk] = makeWeakReference(v, w)
+	} else if !w.values {
+		w.entries[wk] = v
+	}
+	return !present
+}
+
+// sweep removes the entries whose key or value was collected.
+func (w *weakTable) sweep() {
+	for wk, wv := range w.entries {
+		if k, v := w.entry(wk, wv); k == nil || v == nil {
+			delete(w.entries, wk)
+		}
+	}
+}
+
+// weakMode returns whether the __mode field of mt makes keys and values weak.
+// Without weak pointers, they are always strong.
+func weakMode(mt *table) (keys, values bool) {
+	if weakPointers && mt != nil {
+		if mode, ok := mt.atString("__mode").(string); ok {
+			return strings.ContainsRune(mode, 'k'), strings.ContainsRune(mode, 'v')
+		}
+	}
+	return false, false
+}
+
+// setMetaTable sets the metatable of t, making t weak or strong as its mode
+// requires.
+func (t *table) setMetaTable(l *State, mt *table) {
+	t.metaTable = mt
+	t.invalidateTagMethodCache(l)
+	keys, values := weakMode(mt)
+	if w := t.weak; w != nil && w.keys == keys && w.values == values || w == nil && !keys && !values {
+		return
+	}
+	var entries [][2]value
+	t.forEach(func(k, v value) { entries = append(entries, [2]value{k, v}) })
+	t.array, t.hash, t.iterationKeys, t.weak = nil, make(map[value]value, len(entries)), nil, nil
+	if keys || values {
+		t.weak = &weakTable{keys: keys, values: values, entries: make(map[value]value, len(entries))}
+	}
+	for _, e := range entries {
+		t.put(nil, e[0], e[1]) // keys from a table are neither nil nor NaN
+	}
+}
+
+// forEach calls f with the key and value of each entry of t.
+func (t *table) forEach(f func(k, v value)) {
+	if w := t.weak; w != nil {
+		for k, v := range w.entries {
+			if k, v := w.entry(k, v); k != nil && v != nil {
+				f(k, v)
+			}
+		}
+		return
+	}
+	for i, v := range t.array {
+		if v != nil {
+			f(float64(i+1), v)
+		}
+	}
+	for k, v := range t.hash {
+		f(k, v)
+	}
+}
+
+func (l *State) weakNext(t *table, key int) bool {
+	w, k := t.weak, l.stack[key]
+	if t.iterationKeys == nil {
+		if k != nil {
+			if _, ok := w.entries[w.key(k)]; !ok {
+				l.runtimeError("invalid key to 'next'") // key not found
+			}
+		}
+		if w.collected.Swap(false) {
+			w.sweep()
+		}
+		j, keys := 0, make([]value, len(w.entries))
+		for wk := range w.entries {
+			keys[j] = wk
+			j++
+		}
+		t.iterationKeys = keys
+	}
+	found := k == nil
+	for i, wk := range t.iterationKeys {
+		if wk == nil { // skip deleted key
+		} else if v, present := w.entries[wk]; !present {
+			t.iterationKeys[i] = nil // mark key as deleted
+		} else if found {
+			if hk, hv := w.entry(wk, v); hk != nil && hv != nil {
+				l.stack[key], l.stack[key+1] = hk, hv
+				return true
+			}
+		} else if dereference(wk) == k {
+			found = true
+		}
+	}
+	if !found {
+		l.runtimeError("invalid key to 'next'")
+	}
+	return false // no more elements
+}
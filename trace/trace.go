@@ -0,0 +1,230 @@
+// Package trace records the Lua and Go function calls made by go-lua States
+// as a timeline, written in the Chrome trace event format read by Perfetto
+// and chrome://tracing.
+//
+//	trace.Start(l, f, &trace.Options{Chunks: []string{"flow.lua"}})
+//	lua.DoFile(l, "flow.lua")
+//	trace.Stop(l)
+//
+// Tracing adds call and return hooks to a State, which run along with its
+// other hooks.
+package trace
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Shopify/go-lua"
+)
+
+// Options select the calls to record. A call is recorded when it matches
+// both lists, and an empty list matches every call.
+type Options struct {
+	// Chunks lists the chunks whose functions are recorded, by the name given
+	// to Load with or without its '@' or '=' prefix. Go functions belong to
+	// the chunk of the Lua function that calls them.
+	Chunks []string
+
+	// Functions lists the names of the functions to record, as they are
+	// shown in the trace.
+	Functions []string
+}
+
+func (o *Options) matches(chunk, name string) bool {
+	if o == nil {
+		return true
+	}
+	return (len(o.Chunks) == 0 || contains(o.Chunks, chunk)) && (len(o.Functions) == 0 || contains(o.Functions, name))
+}
+
+func contains(list []string, s string) bool {
+	for _, t := range list {
+		if t == s || strings.TrimLeft(t, "@=") == strings.TrimLeft(s, "@=") {
+			return true
+		}
+	}
+	return false
+}
+
+// A call is a call that has begun and not yet returned.
+type call struct {
+	depth    int
+	recorded bool
+}
+
+type tracer struct {
+	w       *bufio.Writer
+	options *Options
+	remove  func() // removes the hook
+	start   time.Time
+	open    []call
+	events  int
+	err     error
+}
+
+// An event is a trace event, as described by
+// https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+type event struct {
+	Name     string            `json:"name,omitempty"`
+	Category string            `json:"cat,omitempty"`
+	Phase    string            `json:"ph"`
+	Time     float64           `json:"ts"` // in microseconds
+	Process  int               `json:"pid"`
+	Thread   int               `json:"tid"`
+	Args     map[string]string `json:"args,omitempty"`
+}
+
+var (
+	mu      sync.Mutex
+	tracers = make(map[*lua.State]*tracer)
+)
+
+// Start starts tracing the calls made by l, writing them to w. The calls
+// made until Stop is called are written as duration events with the
+// function's name, its source and line, and whether it was tail called. It
+// returns an error if l is already being traced.
+func Start(l *lua.State, w io.Writer, o *Options) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if tracers[l] != nil {
+		return errors.New("tracing already in use")
+	}
+	t := &tracer{
+		w:       bufio.NewWriter(w),
+		options: o,
+		start:   time.Now(),
+	}
+	tracers[l] = t
+	_, t.err = t.w.WriteString("[")
+	t.remove = lua.AddDebugHook(l, t.hook, lua.MaskCall|lua.MaskReturn, 0)
+	return nil
+}
+
+// Stop stops tracing l, if it is being traced, ending the calls still in
+// progress. It returns the first error writing the trace.
+func Stop(l *lua.State) error {
+	mu.Lock()
+	t := tracers[l]
+	delete(tracers, l)
+	mu.Unlock()
+	if t == nil {
+		return nil
+	}
+	t.remove()
+	t.end(0)
+	if t.err == nil {
+		_, t.err = t.w.WriteString("\n]\n")
+	}
+	if t.err == nil {
+		t.err = t.w.Flush()
+	}
+	return t.err
+}
+
+func (t *tracer) write(e event) {
+	if t.err != nil {
+		return
+	}
+	e.Time = float64(time.Since(t.start).Nanoseconds()) / 1e3
+	e.Process, e.Thread = 1, 1
+	b, err := json.Marshal(e)
+	if err != nil {
+		t.err = err
+		return
+	}
+	if t.events > 0 {
+		t.w.WriteByte(',')
+	}
+	t.events++
+	t.w.WriteString("\n")
+	_, t.err = t.w.Write(b)
+}
+
+// end ends the calls in progress deeper than depth, including those an error
+// unwound without a return event.
+func (t *tracer) end(depth int) {
+	for len(t.open) > 0 && t.open[len(t.open)-1].depth > depth {
+		if t.open[len(t.open)-1].recorded {
+			t.write(event{Phase: "E"})
+		}
+		t.open = t.open[:len(t.open)-1]
+	}
+}
+
+func depth(l *lua.State) (n int) {
+	for ; ; n++ {
+		if _, ok := lua.Stack(l, n); !ok {
+			return
+		}
+	}
+}
+
+func (t *tracer) hook(l *lua.State, ar lua.Debug) {
+	// End the returning call, or the one a tail call replaces, and any an
+	// error unwound. A tail call replaces its caller's frame once the hook
+	// returns.
+	d := depth(l)
+	if ar.Event == lua.HookTailCall {
+		d--
+	}
+	if t.end(d - 1); ar.Event == lua.HookReturn {
+		return
+	}
+	f, _ := lua.Stack(l, 0)
+	info, _ := lua.Info(l, "nSlf", f)
+	name, chunk, category, where := describe(l, info)
+	l.Pop(1)
+	if info.What == "Go" {
+		if caller, ok := lua.Stack(l, 1); ok {
+			c, _ := lua.Info(l, "Sl", caller)
+			chunk, where = c.Source, fmt.Sprintf("%s:%d", c.ShortSource, c.CurrentLine)
+		}
+	}
+	c := call{depth: d, recorded: t.options.matches(chunk, name)}
+	t.open = append(t.open, c)
+	if c.recorded {
+		args := map[string]string{"source": where}
+		if ar.Event == lua.HookTailCall {
+			args["tail call"] = "true"
+		}
+		t.write(event{Name: name, Category: category, Phase: "B", Args: args})
+	}
+}
+
+// describe returns the name of the function at the top of the stack, whose
+// information is d, and the chunk, category and place of its definition.
+func describe(l *lua.State, d lua.Debug) (name, chunk, category, where string) {
+	if d.What == "Go" {
+		name = d.Name
+		if f := l.ToGoFunction(-1); f != nil {
+			if rf := runtime.FuncForPC(reflect.ValueOf(f).Pointer()); rf != nil {
+				file, line := rf.FileLine(rf.Entry())
+				where = fmt.Sprintf("%s:%d", file, line)
+				if name == "" {
+					name = rf.Name()
+				}
+			}
+		}
+		if name == "" {
+			name = "?"
+		}
+		return name, "", "go", where
+	}
+	switch {
+	case d.What == "main":
+		name = "main chunk"
+	case d.Name != "":
+		name = d.Name
+	default:
+		name = fmt.Sprintf("function <%s:%d>", d.ShortSource, d.LineDefined)
+	}
+	return name, d.Source, "lua", fmt.Sprintf("%s:%d", d.ShortSource, d.LineDefined)
+}
@@ -0,0 +1,116 @@
+package trace
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/Shopify/go-lua"
+)
+
+const program = `local function leaf(x)
+  return string.rep("x", x)
+end
+
+local function tail(x)
+  return leaf(x)
+end
+
+local function fails()
+  error("boom")
+end
+
+for i = 1, 2 do
+  tail(i)
+end
+pcall(fails)
+return leaf(3)
+`
+
+func run(t *testing.T, o *Options) []event {
+	l := lua.NewState()
+	lua.OpenLibraries(l)
+	var b bytes.Buffer
+	if err := Start(l, &b, o); err != nil {
+		t.Fatal(err)
+	}
+	if err := Start(l, &b, o); err == nil {
+		t.Error("started a second trace of the same State")
+	}
+	if err := lua.LoadBuffer(l, program, "@program.lua", "t"); err != nil {
+		t.Fatal(err)
+	}
+	l.Call(0, 0)
+	if err := Stop(l); err != nil {
+		t.Fatal(err)
+	}
+	if err := lua.DoString(l, "return 1"); err != nil { // not traced
+		t.Fatal(err)
+	}
+	var events []event
+	if err := json.Unmarshal(b.Bytes(), &events); err != nil {
+		t.Fatalf("%v in %s", err, b.String())
+	}
+	return events
+}
+
+// timeline renders the begin and end events as a nested list of names.
+func timeline(t *testing.T, events []event) string {
+	var s []string
+	var stack []string
+	last := -1.0
+	for _, e := range events {
+		if e.Time < last {
+			t.Errorf("event %+v out of order", e)
+		}
+		last = e.Time
+		switch e.Phase {
+		case "B":
+			name := strings.NewReplacer("function <program.lua:1>", "leaf", "function <program.lua:", "<").Replace(e.Name)
+			if e.Args["tail call"] == "true" {
+				name += "*"
+			}
+			stack = append(stack, name)
+			s = append(s, name)
+		case "E":
+			if len(stack) == 0 {
+				t.Fatal("unbalanced end event")
+			}
+			stack = stack[:len(stack)-1]
+			s = append(s, "/")
+		}
+	}
+	if len(stack) != 0 {
+		t.Errorf("unended calls %v", stack)
+	}
+	return strings.Join(s, " ")
+}
+
+func TestTrace(t *testing.T) {
+	events := run(t, nil)
+	// Lua doesn't know the names of functions called by tail calls or from Go.
+	expected := "main chunk tail / leaf* rep / / tail / leaf* rep / / pcall <9> error / / / / leaf* rep / /"
+	if got := timeline(t, events); got != expected {
+		t.Errorf("got timeline\n%s\nexpected\n%s", got, expected)
+	}
+	for _, e := range events {
+		if e.Phase == "B" && e.Name == "function <program.lua:1>" && (e.Category != "lua" || e.Args["source"] != "program.lua:1") {
+			t.Errorf("unexpected event %+v", e)
+		} else if e.Phase == "B" && e.Name == "rep" && (e.Category != "go" || e.Args["source"] != "program.lua:2") {
+			t.Errorf("unexpected event %+v", e)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	if got := timeline(t, run(t, &Options{Functions: []string{"tail", "pcall"}})); got != "tail / tail / pcall /" {
+		t.Errorf("functions filtered to %s", got)
+	}
+	if got := timeline(t, run(t, &Options{Chunks: []string{"other.lua"}})); got != "" {
+		t.Errorf("chunks filtered to %s", got)
+	}
+	if got := timeline(t, run(t, &Options{Chunks: []string{"program.lua"}, Functions: []string{"rep"}})); got != "rep / rep / rep /" {
+		t.Errorf("chunks and functions filtered to %s", got)
+	}
+}
@@ -97,6 +97,9 @@ type prototype struct {
 	localVariables               []localVariable
 	upValues                     []upValueDesc
 	cache                        *luaClosure
+	inlineCaches                 []inlineCache
+	compiled                     []compiledOp
+	lineMap                      *lineMap // the lines and breakpoints of the debugger
 	source                       string
 	lineDefined, lastLineDefined int
 	parameterCount, maxStackSize int
@@ -110,6 +113,25 @@ func (p *prototype) upValueName(index int) string {
 	return "?"
 }
 
+// instance returns a copy of p and of its nested prototypes that shares their
+// code and constants, but none of the state the VM caches in them.
+func (p *prototype) instance() *prototype {
+	q := *p
+	q.cache, q.inlineCaches, q.compiled, q.lineMap = nil, nil, nil, nil
+	q.prototypes = make([]prototype, len(p.prototypes))
+	for i := range p.prototypes {
+		q.prototypes[i] = *p.prototypes[i].instance()
+	}
+	return &q
+}
+
+func (p *prototype) inlineCache(pc pc) *inlineCache {
+	if p.inlineCaches == nil {
+		p.inlineCaches = make([]inlineCache, len(p.code))
+	}
+	return &p.inlineCaches[pc]
+}
+
 func (p *prototype) lastLoad(reg int, lastPC pc) (loadPC pc, found bool) {
 	var ip, jumpTarget pc
 	for ; ip < lastPC; ip++ {
@@ -41,18 +41,90 @@ func (l *State) tableAt(t value, key value) value {
 	return nil
 }
 
+// An inlineCache memoizes, for a single GETTABLE, GETTABUP or SELF
+// instruction with a constant string key, where the key resolves when it
+// isn't present in the indexed object itself. Entries are keyed by the
+// object's metatable and are only valid for the epoch they were filled in.
+type inlineCache struct {
+	metaTable *table
+	epoch     uint32
+	value     value
+	generic   bool // the chain can't be memoized; always use tableAt
+}
+
+// OPT: cachedTableAt is tableAt with an inline cache for the __index chain.
+func (l *State) cachedTableAt(t value, key value, c *inlineCache) value {
+	k, ok := key.(string)
+	if !ok {
+		return l.tableAt(t, key)
+	}
+	var mt *table
+	switch o := t.(type) {
+	case *table:
+		if result := o.atString(k); result != nil {
+			return result
+		} else if mt = o.metaTable; mt == nil {
+			return nil
+		}
+	case *userData:
+		mt = o.metaTable
+	default:
+		mt = l.global.metaTable(t)
+	}
+	if mt == nil {
+		return l.tableAt(t, key)
+	} else if c.metaTable == mt && c.epoch == l.global.inlineCacheEpoch {
+		if c.generic {
+			return l.tableAt(t, key)
+		}
+		return c.value
+	}
+	return l.fillInlineCache(t, mt, k, c)
+}
+
+func (l *State) fillInlineCache(t value, mt *table, k string, c *inlineCache) value {
+	epoch := l.global.inlineCacheEpoch
+	fill := func(v value) value {
+		c.metaTable, c.epoch, c.value, c.generic = mt, epoch, v, false
+		return v
+	}
+	for loop, events := 0, mt; loop < maxTagLoop; loop++ {
+		events.flags |= tableInlineCached
+		switch tm := l.fastTagMethod(events, tmIndex).(type) {
+		case nil:
+			if _, ok := t.(*table); ok || loop > 0 {
+				return fill(nil)
+			}
+		case *table:
+			if tm.weak != nil {
+				break // its entries may be collected
+			}
+			tm.flags |= tableInlineCached
+			if result := tm.hash[k]; result != nil {
+				return fill(result)
+			} else if events = tm.metaTable; events != nil {
+				continue
+			}
+			return fill(nil)
+		}
+		break // a function or a non-table can't be memoized
+	}
+	c.metaTable, c.epoch, c.value, c.generic = mt, epoch, nil, true
+	return l.tableAt(t, k)
+}
+
 func (l *State) setTableAt(t value, key value, val value) {
 	for loop := 0; loop < maxTagLoop; loop++ {
 		var tm value
 		if table, ok := t.(*table); ok {
 			if table.tryPut(l, key, val) {
 				// previous non-nil value ==> metamethod irrelevant
-				table.invalidateTagMethodCache()
+				table.invalidateTagMethodCache(l)
 				return
 			} else if tm = l.fastTagMethod(table.metaTable, tmNewIndex); tm == nil {
 				// no metamethod
 				table.put(l, key, val)
-				table.invalidateTagMethodCache()
+				table.invalidateTagMethodCache(l)
 				return
 			}
 		} else if tm = l.tagMethodByObject(t, tmNewIndex); tm == nil {
@@ -209,7 +281,9 @@ func (l *State) concat(total int) {
 			for i, j := 0, len(ss)-1; i < j; i, j = i+1, j-1 {
 				ss[i], ss[j] = ss[j], ss[i]
 			}
-			put(len(ss), strings.Join(ss, ""))
+			s := strings.Join(ss, "")
+			put(len(ss), s)
+			l.stringCreated(s)
 		}
 		total -= n - 1 // created 1 new string from `n` strings
 		l.top -= n - 1 // popped `n` strings and pushed 1
@@ -219,6 +293,9 @@ func (l *State) concat(total int) {
 func (l *State) traceExecution() {
 	callInfo := l.callInfo
 	mask := l.hookMask
+	if mask&maskStats != 0 {
+		l.stats.Load().instruction(callInfo, l.prototype(callInfo))
+	}
 	countHook := mask&MaskCount != 0 && l.hookCount == 0
 	if countHook {
 		l.resetHookCount()
@@ -227,6 +304,9 @@ func (l *State) traceExecution() {
 		callInfo.clearCallStatus(callStatusHookYielded)
 		return
 	}
+	// The engines trace an instruction before fetching it. Hooks see it as
+	// fetched, as in Lua.
+	callInfo.savedPC++
 	if countHook {
 		l.hook(HookCount, -1)
 	}
@@ -234,11 +314,12 @@ func (l *State) traceExecution() {
 		p := l.prototype(callInfo)
 		npc := callInfo.savedPC - 1
 		newline := p.lineInfo[npc]
-		if npc == 0 || callInfo.savedPC <= l.oldPC || newline != p.lineInfo[l.oldPC-1] {
+		if npc == 0 || l.oldPC == 0 || npc < l.oldPC || newline != p.lineInfo[l.oldPC-1] {
 			l.hook(HookLine, int(newline))
 		}
 	}
 	l.oldPC = callInfo.savedPC
+	callInfo.savedPC--
 	if l.shouldYield {
 		if countHook {
 			l.hookCount = 1
@@ -265,6 +346,13 @@ func (e *engine) k(field int) value {
 	return e.frame[field]
 }
 
+func (e *engine) tableAt(t value, field int) value {
+	if isConstant(field) {
+		return e.l.cachedTableAt(t, e.constants[constantIndex(field)], e.closure.prototype.inlineCache(e.callInfo.savedPC-1))
+	}
+	return e.l.tableAt(t, e.frame[field])
+}
+
 func (e *engine) expectNext(expected opCode) instruction {
 	i := e.callInfo.step() // go to next instruction
 	if op := i.opCode(); op != expected {
@@ -289,10 +377,10 @@ func (e *engine) newFrame() {
 	e.constants = e.closure.prototype.constants
 }
 
-func (e *engine) hooked() bool { return e.l.hookMask&(MaskLine|MaskCount) != 0 }
+func (e *engine) hooked() bool { return e.l.hookMask&(MaskLine|MaskCount|maskStats) != 0 }
 
 func (e *engine) hook() {
-	if e.l.hookCount--; e.l.hookCount == 0 || e.l.hookMask&MaskLine != 0 {
+	if e.l.hookCount--; e.l.hookCount == 0 || e.l.hookMask&(MaskLine|maskStats) != 0 {
 		e.l.traceExecution()
 		e.frame = e.callInfo.frame
 	}
@@ -357,7 +445,7 @@ func init() {
 			return jumpTable[i.opCode()], i
 		},
 		func(e *engine, i instruction) (engineOp, instruction) { // opGetTableUp
-			tmp := e.l.tableAt(e.closure.upValue(i.b()), e.k(i.c()))
+			tmp := e.tableAt(e.closure.upValue(i.b()), i.c())
 			e.frame = e.callInfo.frame
 			e.frame[i.a()] = tmp
 			if e.hooked() {
@@ -367,7 +455,7 @@ func init() {
 			return jumpTable[i.opCode()], i
 		},
 		func(e *engine, i instruction) (engineOp, instruction) { // opGetTable
-			tmp := e.l.tableAt(e.frame[i.b()], e.k(i.c()))
+			tmp := e.tableAt(e.frame[i.b()], i.c())
 			e.frame = e.callInfo.frame
 			e.frame[i.a()] = tmp
 			if e.hooked() {
@@ -406,8 +494,10 @@ func init() {
 			a := i.a()
 			if b, c := float8(i.b()), float8(i.c()); b != 0 || c != 0 {
 				e.frame[a] = newTableWithSize(intFromFloat8(b), intFromFloat8(c))
+				e.l.tableCreated(intFromFloat8(b), intFromFloat8(c))
 			} else {
 				e.frame[a] = newTable()
+				e.l.tableCreated(0, 0)
 			}
 			clear(e.frame[a+1:])
 			if e.hooked() {
@@ -418,7 +508,7 @@ func init() {
 		},
 		func(e *engine, i instruction) (engineOp, instruction) { // opSelf
 			a, t := i.a(), e.frame[i.b()]
-			tmp := e.l.tableAt(t, e.k(i.c()))
+			tmp := e.tableAt(t, i.c())
 			e.frame = e.callInfo.frame
 			e.frame[a+1], e.frame[a] = t, tmp
 			if e.hooked() {
@@ -927,14 +1017,39 @@ func init() {
 	}
 }
 
-func (l *State) execute() { l.executeFunctionTable() }
+// An Engine is an implementation of the bytecode interpreter. All engines
+// run the same bytecode with the same semantics; they differ only in speed.
+type Engine byte
+
+// Engines available to SetEngine.
+const (
+	EngineFunctionTable Engine = iota // dispatch through a table of functions (the default)
+	EngineSwitch                      // dispatch through a switch statement
+	EngineCompiled                    // compile each function once into specialized Go closures
+)
+
+// SetEngine selects the interpreter used to execute Lua functions in l and
+// in every thread that shares its global state. It takes effect on the next
+// call into Lua.
+func SetEngine(l *State, e Engine) { l.global.engine = e }
+
+func (l *State) execute() {
+	switch l.global.engine {
+	case EngineSwitch:
+		l.executeSwitch()
+	case EngineCompiled:
+		l.executeCompiled()
+	default:
+		l.executeFunctionTable()
+	}
+}
 
 func (l *State) executeFunctionTable() {
 	ci := l.callInfo
 	closure, _ := l.stack[ci.function].(*luaClosure)
 	e := engine{callInfo: ci, frame: ci.frame, closure: closure, constants: closure.prototype.constants, l: l}
-	if l.hookMask&(MaskLine|MaskCount) != 0 {
-		if l.hookCount--; l.hookCount == 0 || l.hookMask&MaskLine != 0 {
+	if l.hookMask&(MaskLine|MaskCount|maskStats) != 0 {
+		if l.hookCount--; l.hookCount == 0 || l.hookMask&(MaskLine|maskStats) != 0 {
 			l.traceExecution()
 			e.frame = e.callInfo.frame
 		}
@@ -952,6 +1067,13 @@ func k(field int, constants []value, frame []value) value {
 	return frame[field]
 }
 
+func tableAt(l *State, ci *callInfo, t value, field int, constants []value, frame []value) value {
+	if isConstant(field) {
+		return l.cachedTableAt(t, constants[constantIndex(field)], l.prototype(ci).inlineCache(ci.savedPC-1))
+	}
+	return l.tableAt(t, frame[field])
+}
+
 func newFrame(l *State, ci *callInfo) (frame []value, closure *luaClosure, constants []value) {
 	// TODO l.assert(ci == l.callInfo)
 	frame = ci.frame
@@ -972,8 +1094,8 @@ func (l *State) executeSwitch() {
 	ci := l.callInfo
 	frame, closure, constants := newFrame(l, ci)
 	for {
-		if l.hookMask&(MaskLine|MaskCount) != 0 {
-			if l.hookCount--; l.hookCount == 0 || l.hookMask&MaskLine != 0 {
+		if l.hookMask&(MaskLine|MaskCount|maskStats) != 0 {
+			if l.hookCount--; l.hookCount == 0 || l.hookMask&(MaskLine|maskStats) != 0 {
 				l.traceExecution()
 				frame = ci.frame
 			}
@@ -996,11 +1118,11 @@ func (l *State) executeSwitch() {
 		case opGetUpValue:
 			frame[i.a()] = closure.upValue(i.b())
 		case opGetTableUp:
-			tmp := l.tableAt(closure.upValue(i.b()), k(i.c(), constants, frame))
+			tmp := tableAt(l, ci, closure.upValue(i.b()), i.c(), constants, frame)
 			frame = ci.frame
 			frame[i.a()] = tmp
 		case opGetTable:
-			tmp := l.tableAt(frame[i.b()], k(i.c(), constants, frame))
+			tmp := tableAt(l, ci, frame[i.b()], i.c(), constants, frame)
 			frame = ci.frame
 			frame[i.a()] = tmp
 		case opSetTableUp:
@@ -1015,13 +1137,15 @@ func (l *State) executeSwitch() {
 			a := i.a()
 			if b, c := float8(i.b()), float8(i.c()); b != 0 || c != 0 {
 				frame[a] = newTableWithSize(intFromFloat8(b), intFromFloat8(c))
+				l.tableCreated(intFromFloat8(b), intFromFloat8(c))
 			} else {
 				frame[a] = newTable()
+				l.tableCreated(0, 0)
 			}
 			clear(frame[a+1:])
 		case opSelf:
 			a, t := i.a(), frame[i.b()]
-			tmp := l.tableAt(t, k(i.c(), constants, frame))
+			tmp := tableAt(l, ci, t, i.c(), constants, frame)
 			frame = ci.frame
 			frame[a+1], frame[a] = t, tmp
 		case opAdd:
@@ -8,6 +8,19 @@ import (
 	"testing"
 )
 
+// testEngine and testOptimizationLevel configure States made by newTestState.
+var (
+	testEngine            = EngineFunctionTable
+	testOptimizationLevel = 0
+)
+
+func newTestState() *State {
+	l := NewState()
+	SetEngine(l, testEngine)
+	SetOptimizationLevel(l, testOptimizationLevel)
+	return l
+}
+
 func testString(t *testing.T, s string) { testStringHelper(t, s, false) }
 
 // Commented out to avoid a warning relating to the method not being used. Left here since it's useful for debugging.
@@ -25,7 +38,7 @@ func testNoPanicString(t *testing.T, s string) {
 }
 
 func testStringHelper(t *testing.T, s string, trace bool) {
-	l := NewState()
+	l := newTestState()
 	OpenLibraries(l)
 	LoadString(l, s)
 	if trace {
@@ -33,19 +46,19 @@ func testStringHelper(t *testing.T, s string, trace bool) {
 			ci := state.callInfo
 			p := state.prototype(ci)
 			println(stack(state.stack[ci.base():state.top]))
-			println(ci.code[ci.savedPC].String(), p.source, p.lineInfo[ci.savedPC])
+			println(ci.code[ci.savedPC-1].String(), p.source, p.lineInfo[ci.savedPC-1])
 		}, MaskCount, 1)
 	}
 	l.Call(0, 0)
 }
 
 func TestProtectedCall(t *testing.T) {
-	l := NewState()
+	l := newTestState()
 	OpenLibraries(l)
 	SetDebugHook(l, func(state *State, ar Debug) {
 		ci := state.callInfo
 		_ = stack(state.stack[ci.base():state.top])
-		_ = ci.code[ci.savedPC].String()
+		_ = ci.code[ci.savedPC-1].String()
 	}, MaskCount, 1)
 	LoadString(l, "assert(not pcall(bit32.band, {}))")
 	l.Call(0, 0)
@@ -86,7 +99,7 @@ func TestLua(t *testing.T) {
 			t.Skipf("'%s' skipped because it's non-portable & we're running Windows", v.name)
 		}
 		t.Log(v)
-		l := NewState()
+		l := newTestState()
 		OpenLibraries(l)
 		for _, s := range []string{"_port", "_no32", "_noformatA"} {
 			l.PushBoolean(true)
@@ -117,7 +130,7 @@ func TestLua(t *testing.T) {
 }
 
 func benchmarkSort(b *testing.B, program string) {
-	l := NewState()
+	l := newTestState()
 	OpenLibraries(l)
 	s := `a = {}
 		for i=1,%d do
@@ -140,7 +153,7 @@ func BenchmarkSort2(b *testing.B) {
 }
 
 func BenchmarkFibonnaci(b *testing.B) {
-	l := NewState()
+	l := newTestState()
 	s := `return function(n)
 			if n == 0 then
 				return 0
@@ -216,7 +229,7 @@ func TestCanRemoveNilObjectFromStack(t *testing.T) {
 		}
 	}()
 
-	l := NewState()
+	l := newTestState()
 	l.PushString("hello")
 	l.Remove(-1)
 	l.PushNil()
@@ -234,7 +247,7 @@ func TestTableUserdataEquality(t *testing.T) {
 		assert(b == false)
 	end`
 
-	l := NewState()
+	l := newTestState()
 	OpenLibraries(l)
 	LoadString(l, s)
 	if err := l.ProtectedCall(0, 1, 0); err != nil {
@@ -254,7 +267,7 @@ func TestUserDataEqualityNil(t *testing.T) {
 		assert(b == false)
 	end`
 
-	l := NewState()
+	l := newTestState()
 	OpenLibraries(l)
 	LoadString(l, s)
 	if err := l.ProtectedCall(0, 1, 0); err != nil {
@@ -276,7 +289,7 @@ func TestTableEqualityNil(t *testing.T) {
 }
 
 func TestTableNext(t *testing.T) {
-	l := NewState()
+	l := newTestState()
 	OpenLibraries(l)
 	l.CreateTable(10, 0)
 	for i := 1; i <= 4; i++ {
@@ -300,7 +313,7 @@ func TestTableNext(t *testing.T) {
 }
 
 func TestError(t *testing.T) {
-	l := NewState()
+	l := newTestState()
 	BaseOpen(l)
 	errorHandled := false
 	program := "error('error')"
@@ -323,7 +336,7 @@ func TestError(t *testing.T) {
 }
 
 func TestErrorf(t *testing.T) {
-	l := NewState()
+	l := newTestState()
 	BaseOpen(l)
 	program := "-- script that is bigger than the max ID size\nhelper()\n" + strings.Repeat("--", idSize)
 	expectedErrorMessage := chunkID(program) + ":2: error"
@@ -399,7 +412,7 @@ func TestConcurrentNext(t *testing.T) {
 }
 
 func TestLocIsCorrectOnRegisteredFuncCall(t *testing.T) {
-	l := NewState()
+	l := newTestState()
 	l.Register("barf", func(l *State) int {
 		Errorf(l, "Boom!")
 		return 0
@@ -421,7 +434,7 @@ func TestLocIsCorrectOnRegisteredFuncCall(t *testing.T) {
 }
 
 func TestLocIsCorrectOnFuncCall(t *testing.T) {
-	l := NewState()
+	l := newTestState()
 	if err := l.Load(strings.NewReader(`
 			function barf()
 				a = 3 + 2
@@ -442,7 +455,7 @@ func TestLocIsCorrectOnFuncCall(t *testing.T) {
 }
 
 func TestLocIsCorrectOnError(t *testing.T) {
-	l := NewState()
+	l := newTestState()
 	if err := l.Load(strings.NewReader(`
 			a = 3 - 3
 			b = 3 / q  -- line 3; errs!
@@ -458,3 +471,265 @@ func TestLocIsCorrectOnError(t *testing.T) {
 		}
 	}
 }
+
+func TestInlineCacheInvalidation(t *testing.T) {
+	testString(t, `
+	local Base = {}
+	Base.__index = Base
+	function Base:name() return "base" end
+	local Derived = setmetatable({}, Base)
+	Derived.__index = Derived
+	local o = setmetatable({}, Derived)
+	local function name(x) return x:name() end
+	for i = 1, 3 do assert(name(o) == "base") end
+	function Derived:name() return "derived" end
+	assert(name(o) == "derived")
+	o.name = function() return "own" end
+	assert(name(o) == "own")
+	o.name = nil
+	rawset(Derived, "name", nil)
+	assert(name(o) == "base")
+	setmetatable(Derived, {__index = function() return function() return "function" end end})
+	assert(name(o) == "function")
+	setmetatable(Derived, nil)
+	local function field(x) return x.missing end
+	assert(field(o) == nil)
+	Derived.missing = 1
+	assert(field(o) == 1)
+	Derived.__index = {missing = 2}
+	assert(field(o) == 2)
+	assert(field(setmetatable({}, {__index = Derived})) == 1)
+	assert(("x"):upper() == "X")
+	`)
+}
+
+func TestInlineCacheEpochPerState(t *testing.T) {
+	l1, l2 := newTestState(), newTestState()
+	BaseOpen(l1)
+	BaseOpen(l2)
+	s := `
+	local Base = {}
+	Base.__index = Base
+	function Base:name() return "base" end
+	local o = setmetatable({}, Base)
+	for i = 1, 3 do assert(o:name() == "base") end
+	return Base`
+	for _, l := range []*State{l1, l2} {
+		if err := DoString(l, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	epoch := l2.global.inlineCacheEpoch
+	l1.PushString("name")
+	l1.PushNil()
+	l1.SetTable(-3)
+	if l1.global.inlineCacheEpoch == 0 {
+		t.Error("a write to a cached metatable didn't invalidate the inline caches of its State")
+	}
+	if l2.global.inlineCacheEpoch != epoch {
+		t.Error("a write to a cached metatable invalidated the inline caches of another State")
+	}
+}
+
+func BenchmarkMethodCall(b *testing.B) {
+	l := newTestState()
+	BaseOpen(l)
+	s := `local Point = {}
+		Point.__index = Point
+		function Point:x() return self[1] end
+		local p = setmetatable({1}, Point)
+		return function(n)
+			local sum = 0
+			for i = 1, n do sum = sum + p:x() end
+			return sum
+		end`
+	LoadString(l, s)
+	if err := l.ProtectedCall(0, 1, 0); err != nil {
+		b.Error(err.Error())
+	}
+	l.PushInteger(b.N)
+	b.ResetTimer()
+	if err := l.ProtectedCall(1, 1, 0); err != nil {
+		b.Error(err.Error())
+	}
+}
+
+var engines = []struct {
+	name   string
+	engine Engine
+}{
+	{"switch", EngineSwitch},
+	{"compiled", EngineCompiled},
+}
+
+// vmSuite lists the VM and debugging tests that TestEngines and
+// TestOptimizationLevels repeat under different settings.
+var vmSuite = []struct {
+	name string
+	test func(*testing.T)
+}{
+	{"Lua", TestLua},
+	{"ProtectedCall", TestProtectedCall},
+	{"TailCallRecursive", TestTailCallRecursive},
+	{"TailCallRecursiveDiffFn", TestTailCallRecursiveDiffFn},
+	{"TailCallSameFn", TestTailCallSameFn},
+	{"NormalCall", TestNormalCall},
+	{"VarArgMeta", TestVarArgMeta},
+	{"CanRemoveNilObjectFromStack", TestCanRemoveNilObjectFromStack},
+	{"TableUserdataEquality", TestTableUserdataEquality},
+	{"UserDataEqualityNil", TestUserDataEqualityNil},
+	{"TableEqualityNil", TestTableEqualityNil},
+	{"TableNext", TestTableNext},
+	{"Error", TestError},
+	{"Errorf", TestErrorf},
+	{"PairsSplit", TestPairsSplit},
+	{"ConcurrentNext", TestConcurrentNext},
+	{"LocIsCorrectOnRegisteredFuncCall", TestLocIsCorrectOnRegisteredFuncCall},
+	{"LocIsCorrectOnFuncCall", TestLocIsCorrectOnFuncCall},
+	{"LocIsCorrectOnError", TestLocIsCorrectOnError},
+	{"InlineCacheInvalidation", TestInlineCacheInvalidation},
+	{"EngineSemantics", TestEngineSemantics},
+	{"LineHook", TestLineHook},
+	{"HookFunctionName", TestHookFunctionName},
+	{"CountHookLine", TestCountHookLine},
+	{"AddDebugHook", TestAddDebugHook},
+	{"DebugSetHook", TestDebugSetHook},
+	{"DebugSetHookThread", TestDebugSetHookThread},
+	{"Local", TestLocal},
+	{"Breakpoint", TestBreakpoint},
+	{"BreakpointWithHooks", TestBreakpointWithHooks},
+	{"Stepping", TestStepping},
+	{"UpValueByName", TestUpValueByName},
+	{"Stats", TestStats},
+	{"WeakTables", TestWeakTables},
+}
+
+// TestEngines runs the suite under each engine other than the default.
+func TestEngines(t *testing.T) {
+	defer func(e Engine) { testEngine = e }(testEngine)
+	for _, e := range engines {
+		testEngine = e.engine
+		for _, s := range vmSuite {
+			t.Run(e.name+"/"+s.name, s.test)
+		}
+	}
+}
+
+func TestEngineSemantics(t *testing.T) {
+	testString(t, `
+	local k, x, s = 2, 5, "a"
+	assert(x + 1 == 6 and x - 1 == 4 and x * 2 == 10 and x / 2 == 2.5 and x % 3 == 2 and x ^ 2 == 25)
+	assert(1 + x == 6 and 10 - x == 5 and k * x == 10 and x / k == 2.5 and -x == -5)
+	assert("10" + 1 == 11 and x .. s == "5a" and #s == 1 and not nil)
+	assert(x < 6 and 4 < x and x <= 5 and 5 <= x and not (x > 5) and s < "b" and s <= "a")
+	assert(x == 5 and x ~= "5" and s == "a" and (nil == nil) and x ~= nil)
+	local mt = {__add = function(a, b) return 42 end, __lt = function(a, b) return true end,
+		__le = function(a, b) return false end, __eq = function() return true end,
+		__unm = function() return -1 end, __len = function() return 7 end}
+	local a, b = setmetatable({}, mt), setmetatable({}, mt)
+	assert(a + 1 == 42 and 1 + a == 42 and a < 1 and 1 < a and not (a <= 1) and a == b and -a == -1 and #a == 7)
+	local t = {n = 1, [1] = "one", [3.5] = "x"}
+	t.m, t[2], t[k + 1] = 2, "two", "three"
+	assert(t.n + t.m == 3 and t[1] .. t[2] .. t[3] == "onetwothree" and t[3.5] == "x")
+	local sum = 0
+	for i = 10, 1, -2 do sum = sum + i end
+	assert(sum == 30)
+	for _, v in ipairs({1, 2, 3}) do sum = sum + v end
+	assert(sum == 36)
+	local function f(...) local a, b = ... return select("#", ...), a, b end
+	assert(f(1, nil, 3) == 3 and select(2, f(7, 8)) == 7)
+	local fs = {}
+	for i = 1, 3 do fs[i] = function() return i end end
+	assert(fs[1]() + fs[2]() + fs[3]() == 6)
+	local v = false or nil or "y"
+	assert(v == "y" and (1 and 2) == 2)
+	while true do
+		local captured = x
+		fs[4] = function() return captured end
+		if x then break end
+	end
+	assert(fs[4]() == 5)
+	assert(not pcall(function() return {} + 1 end))
+	assert(not pcall(function() for i = "a", 2 do end end))
+	`)
+}
+
+func BenchmarkEngines(b *testing.B) {
+	benchmarks := []struct {
+		name      string
+		benchmark func(*testing.B)
+	}{
+		{"Fibonnaci", BenchmarkFibonnaci},
+		{"MethodCall", BenchmarkMethodCall},
+		{"Sort2", BenchmarkSort2},
+	}
+	defer func(e Engine) { testEngine = e }(testEngine)
+	for _, e := range append([]struct {
+		name   string
+		engine Engine
+	}{{"functionTable", EngineFunctionTable}}, engines...) {
+		testEngine = e.engine
+		for _, bm := range benchmarks {
+			b.Run(e.name+"/"+bm.name, bm.benchmark)
+		}
+	}
+}
+
+func TestWeakTables(t *testing.T) {
+	if !weakPointers {
+		t.Skip("weak tables need the weak pointers of Go 1.24")
+	}
+	testString(t, `
+	local keys = setmetatable({}, {__mode = "k"})
+	local values = setmetatable({}, {__mode = "v"})
+	local kept = {}
+	local function fill()
+		for i = 1, 10 do
+			local k = {}
+			keys[k] = i
+			values[i] = {}
+		end
+		keys[kept], keys.name = "kept", "string keys are never collected"
+		values[20], values.name = kept, "nor are string values"
+	end
+	local function clear() local a, b, c, d, e, f, g, h, i, j end -- overwrite the registers fill used
+	local function count(t)
+		local n = 0
+		for _ in pairs(t) do n = n + 1 end
+		return n
+	end
+	fill()
+	assert(count(keys) == 12 and count(values) == 12 and #values == 10)
+	clear()
+	collectgarbage()
+	assert(count(keys) == 2 and keys[kept] == "kept", count(keys))
+	assert(count(values) == 2 and values[1] == nil and values[20] == kept and #values == 0, count(values))
+
+	keys[kept] = nil
+	assert(next(keys) == "name" and next(keys, "name") == nil)
+
+	setmetatable(values, nil)
+	values[1] = {}
+	clear()
+	collectgarbage()
+	assert(values[1] and values[20] == kept)
+
+	local methods = setmetatable({greet = function() return "hi" end}, {__mode = "kv"})
+	local object = setmetatable({}, {__index = methods})
+	for _ = 1, 2 do assert(object.greet() == "hi") end
+	methods.greet = nil
+	assert(object.greet == nil)
+	`)
+}
+
+func BenchmarkGoFunctionCall(b *testing.B) {
+	l := newTestState()
+	l.Register("f", func(l *State) int { return 0 })
+	l.PushInteger(b.N)
+	l.SetGlobal("n")
+	LoadString(l, "local f = f for i = 1, n do f() end")
+	b.ResetTimer()
+	if err := l.ProtectedCall(0, 0, 0); err != nil {
+		b.Error(err)
+	}
+}
@@ -0,0 +1,49 @@
+//go:build go1.24
+
+package lua
+
+import (
+	"runtime"
+	"weak"
+)
+
+// weakPointers is set when Go provides weak pointers, which weak tables need.
+const weakPointers = true
+
+type weakPointer[T any] struct{ pointer weak.Pointer[T] }
+
+func (r weakPointer[T]) value() value {
+	if p := r.pointer.Value(); p != nil {
+		return p
+	}
+	return nil
+}
+
+func (w *weakTable) collect() { w.collected.Store(true) }
+
+func makeWeakPointer[T any](p *T, w *weakTable) value {
+	if w != nil {
+		runtime.AddCleanup(p, (*weakTable).collect, w)
+	}
+	return weakPointer[T]{weak.Make(p)}
+}
+
+// makeWeakReference returns a weak reference to v, or v if it isn't an object. When
+// w is not nil, the collection of v is signaled to w.
+func makeWeakReference(v value, w *weakTable) value {
+	switch v := v.(type) {
+	case *table:
+		return makeWeakPointer(v, w)
+	case *luaClosure:
+		return makeWeakPointer(v, w)
+	case *goClosure:
+		return makeWeakPointer(v, w)
+	case *goFunction:
+		return makeWeakPointer(v, w)
+	case *userData:
+		return makeWeakPointer(v, w)
+	case *State:
+		return makeWeakPointer(v, w)
+	}
+	return v
+}
@@ -0,0 +1,9 @@
+//go:build !go1.24
+
+package lua
+
+// weakPointers is not set before Go 1.24, which added weak pointers. The
+// __mode field of metatables is then ignored, and all tables are strong.
+const weakPointers = false
+
+func makeWeakReference(v value, w *weakTable) value { return v }